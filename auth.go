@@ -0,0 +1,110 @@
+package srv
+
+import "errors"
+
+// ErrMissingScope is the reason given when a request for an endpoint that
+// requires scopes is rejected because the server has no Authorizer.
+var ErrMissingScope = errors.New("missing required scope")
+
+// authenticate is used to check a request or stream with the Authenticator
+// before it is dispatched; other frames, such as hellos, are not checked.
+// authenticated tells whether the connection has already passed the check with
+// AuthenticateOnce set, and is updated when it does. It returns nil if the frame
+// may be served. Otherwise, the frame is rejected like reject does, with
+// CodeUnauthorized; the connection is closed afterwards if the frame opens a
+// stream, or with AuthenticateOnce set.
+func (s *Server) authenticate(meta Metadata, client *Client, authenticated *bool) error {
+	if s.Authenticator == nil || *authenticated {
+		return nil
+	}
+	switch meta.EndpointType {
+	case EndpointRequest, EndpointOneWay, EndpointStream:
+	default:
+		return nil
+	}
+	err := s.Authenticator(meta, client.conn)
+
+	if err == nil {
+		*authenticated = s.AuthenticateOnce
+		return nil
+	}
+	s.maybeLogf("Could not authenticate %s frame for endpoint %v from %v: %v", EndpointTypeName(meta.EndpointType), meta.Endpoint, client.RemoteAddr(), err)
+
+	err = endStream(meta, s.reject(meta, client, CodeUnauthorized, err))
+
+	// With AuthenticateOnce, the connection is not trusted any further.
+	if re, ok := err.(recoverableError); ok && s.AuthenticateOnce {
+		return re.error
+	}
+	return err
+}
+
+// RequireScopes is used to make the endpoint named name, whatever its type,
+// only serve callers that the Authorizer grants all of the given scopes; see
+// Server.Authorizer. Requests reaching the endpoint through an alias require
+// the scopes of its target. Calling it again replaces the scopes, and calling
+// it without any makes the endpoint open again. The scopes are kept when the
+// endpoint is registered again.
+func (s *Server) RequireScopes(name string, scopes ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(scopes) == 0 {
+		delete(s.scopes, name)
+		return
+	}
+	s.scopes[name] = append([]string(nil), scopes...)
+}
+
+// AddRequestEndpointScoped is used to add a request endpoint that requires the
+// given scopes, like AddRequestEndpoint followed by RequireScopes.
+func (s *Server) AddRequestEndpointScoped(name string, endpoint RequestEndpoint, scopes ...string) {
+	s.RequireScopes(name, scopes...)
+	s.AddRequestEndpoint(name, endpoint)
+}
+
+// requiredScopes returns the scopes required by the endpoint that serves meta,
+// if any, resolving endpoint IDs and aliases.
+func (s *Server) requiredScopes(meta Metadata) []string {
+	name := meta.Endpoint
+
+	if meta.EndpointID != 0 && name == "" {
+		name, _ = s.endpointName(meta.EndpointID)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.requestEndpoints[name]; !ok && meta.EndpointType != EndpointStream {
+		if target, ok := s.aliases[name]; ok {
+			name = target
+		}
+	}
+	return s.scopes[name]
+}
+
+// authorize is used to check a request or stream for an endpoint that requires
+// scopes with the Authorizer, once it is authenticated. It returns nil if the
+// frame may be served, and rejects it like reject does, with CodeForbidden,
+// otherwise; the connection is closed afterwards if the frame opens a stream.
+func (s *Server) authorize(meta Metadata, client *Client) error {
+	switch meta.EndpointType {
+	case EndpointRequest, EndpointOneWay, EndpointStream:
+	default:
+		return nil
+	}
+	scopes := s.requiredScopes(meta)
+
+	if len(scopes) == 0 {
+		return nil
+	}
+	err := ErrMissingScope
+
+	if s.Authorizer != nil {
+		if err = s.Authorizer(meta, client.conn, scopes); err == nil {
+			return nil
+		}
+	}
+	s.maybeLogf("Could not authorize %s frame for endpoint %v from %v: %v", EndpointTypeName(meta.EndpointType), meta.Endpoint, client.RemoteAddr(), err)
+
+	return endStream(meta, s.reject(meta, client, CodeForbidden, err))
+}
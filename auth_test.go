@@ -0,0 +1,241 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+var errForbiddenUser = errors.New("user is not allowed")
+
+// allowUser returns an authenticator that only lets the given user through, and
+// counts its calls.
+func allowUser(id int64, calls *int32) func(meta Metadata, conn net.Conn) error {
+	return func(meta Metadata, conn net.Conn) error {
+		atomic.AddInt32(calls, 1)
+
+		if conn == nil {
+			return errors.New("no connection")
+		}
+		if meta.UserID != id {
+			return errForbiddenUser
+		}
+		return nil
+	}
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	tests := []struct {
+		name      string
+		once      bool
+		users     []int64
+		wantCodes []ErrorCode // The code of each request, zero when it is served.
+		wantCalls int32
+		wantEOF   bool // Whether the connection is closed afterwards.
+	}{
+		{"allowed", false, []int64{1, 1}, []ErrorCode{0, 0}, 2, false},
+		{"denied", false, []int64{2, 1}, []ErrorCode{CodeUnauthorized, 0}, 2, false},
+		{"allowed later", false, []int64{1, 2}, []ErrorCode{0, CodeUnauthorized}, 2, false},
+		{"once allowed", true, []int64{1, 2, 2}, []ErrorCode{0, 0, 0}, 1, false},
+		{"once denied", true, []int64{2}, []ErrorCode{CodeUnauthorized}, 1, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+
+			s := newEchoServer()
+			s.Authenticator = allowUser(1, &calls)
+			s.AuthenticateOnce = tt.once
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			// The hello frame is not checked.
+			if _, err := client.Handshake(); err != nil {
+				t.Fatalf("Handshake error = %v, want nil", err)
+			}
+			for i, user := range tt.users {
+				resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo", UserID: user}, Body: []byte("hello")})
+
+				if code, _ := ErrorCodeOf(err); code != tt.wantCodes[i] || (code == 0 && err != nil) {
+					t.Errorf("request %d: error = %v, want code %d", i, err, tt.wantCodes[i])
+				}
+				if tt.wantCodes[i] == 0 && string(resp.Body) != "hello" {
+					t.Errorf("request %d: body = %q, want %q", i, resp.Body, "hello")
+				}
+			}
+			if tt.wantEOF {
+				if _, err := client.ReadResponse(); err != io.EOF {
+					t.Errorf("error = %v, want %v", err, io.EOF)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestServerAuthenticatorStream(t *testing.T) {
+	for _, once := range []bool{false, true} {
+		once := once
+
+		t.Run(fmt.Sprintf("once=%v", once), func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+
+			s := newEchoServer()
+			s.Authenticator = allowUser(1, &calls)
+			reasons := make(chan error, 1)
+			s.OnConnClose = func(conn net.Conn, reason error) { reasons <- reason }
+			s.AuthenticateOnce = once
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			if _, err := client.Write(Metadata{EndpointType: EndpointStream, Endpoint: "echo", UserID: 2}.Encode()); err != nil {
+				t.Fatalf("Could not write stream header: %v", err)
+			}
+			// The data of the stream must not be read as frames.
+			go client.WriteMessage(Metadata{Endpoint: "echo", UserID: 1}.Encode())
+
+			_, err := client.ReadResponse()
+
+			if code, _ := ErrorCodeOf(err); code != CodeUnauthorized {
+				t.Errorf("error = %v, want code %d", err, CodeUnauthorized)
+			}
+			if reason := <-reasons; reason != errForbiddenUser {
+				t.Errorf("reason = %v, want %v", reason, errForbiddenUser)
+			}
+			if _, err = client.ReadResponse(); err != io.EOF {
+				t.Errorf("error = %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+// grantScopes returns an authorizer that grants each user the given scopes.
+func grantScopes(granted map[int64][]string) func(meta Metadata, conn net.Conn, scopes []string) error {
+	return func(meta Metadata, conn net.Conn, scopes []string) error {
+		for _, scope := range scopes {
+			found := false
+
+			for _, g := range granted[meta.UserID] {
+				found = found || g == scope
+			}
+			if !found {
+				return fmt.Errorf("user %d lacks scope %q", meta.UserID, scope)
+			}
+		}
+		return nil
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	authorizer := grantScopes(map[int64][]string{1: {"read"}, 2: {"read", "admin"}})
+
+	tests := []struct {
+		name       string
+		authorizer func(meta Metadata, conn net.Conn, scopes []string) error
+		meta       Metadata
+		wantCode   ErrorCode
+	}{
+		{"open endpoint", authorizer, Metadata{Endpoint: "echo", UserID: 3}, 0},
+		{"granted", authorizer, Metadata{Endpoint: "admin", UserID: 2}, 0},
+		{"lacking scope", authorizer, Metadata{Endpoint: "admin", UserID: 1}, CodeForbidden},
+		{"unknown user", authorizer, Metadata{Endpoint: "admin", UserID: 3}, CodeForbidden},
+		{"alias", authorizer, Metadata{Endpoint: "root", UserID: 1}, CodeForbidden},
+		{"alias granted", authorizer, Metadata{Endpoint: "root", UserID: 2}, 0},
+		{"endpoint ID", authorizer, Metadata{EndpointID: 3, UserID: 1}, CodeForbidden},
+		{"without authorizer", nil, Metadata{Endpoint: "admin", UserID: 2}, CodeForbidden},
+		{"open without authorizer", nil, Metadata{Endpoint: "echo", UserID: 2}, 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.AddRequestEndpointScoped("admin", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				_, err := io.Copy(w, r)
+				return err
+			}, "read", "admin")
+			s.AddRequestEndpointAlias("root", "admin")
+			s.Authorizer = tt.authorizer
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			if id := s.EndpointIDs()["admin"]; tt.meta.EndpointID != 0 && tt.meta.EndpointID != id {
+				t.Fatalf("admin ID = %d, want %d", id, tt.meta.EndpointID)
+			}
+			for i := 0; i < 2; i++ { // The connection stays usable after a rejection.
+				resp, err := client.Send(Request{Meta: tt.meta, Body: []byte("hello")})
+
+				if code, _ := ErrorCodeOf(err); code != tt.wantCode || (code == 0 && err != nil) {
+					t.Errorf("error = %v, want code %d", err, tt.wantCode)
+				}
+				if tt.wantCode == 0 && string(resp.Body) != "hello" {
+					t.Errorf("body = %q, want %q", resp.Body, "hello")
+				}
+			}
+		})
+	}
+}
+
+func TestServerRequireScopes(t *testing.T) {
+	s := newEchoServer()
+	s.RequireScopes("echo", "admin")
+	s.Authorizer = grantScopes(nil)
+	reasons := make(chan error, 1)
+	s.OnConnClose = func(conn net.Conn, reason error) { reasons <- reason }
+	stream := s.NewInMemoryClient()
+
+	defer stream.Close()
+
+	// Streams are checked as well, and their connection is closed, since the
+	// data of the stream must not be read as frames.
+	if _, err := stream.Write(Metadata{EndpointType: EndpointStream, Endpoint: "echo"}.Encode()); err != nil {
+		t.Fatalf("Could not write stream header: %v", err)
+	}
+	go stream.WriteMessage(Metadata{Endpoint: "echo"}.Encode())
+
+	_, err := stream.ReadResponse()
+
+	if code, _ := ErrorCodeOf(err); code != CodeForbidden {
+		t.Errorf("error = %v, want code %d", err, CodeForbidden)
+	}
+	if reason, want := <-reasons, `user 0 lacks scope "admin"`; reason == nil || reason.Error() != want {
+		t.Errorf("reason = %v, want %v", reason, want)
+	}
+	if _, err = stream.ReadResponse(); err != io.EOF {
+		t.Errorf("error = %v, want %v", err, io.EOF)
+	}
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	// Registering the endpoint again keeps its scopes.
+	s.AddRequestEndpoint("echo", s.RequestEndpoints()["echo"])
+
+	if _, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}}); err == nil {
+		t.Error("Should return an error")
+	}
+
+	// Without scopes, the endpoint is open again.
+	s.RequireScopes("echo")
+
+	if resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil || string(resp.Body) != "hello" {
+		t.Errorf("body = %q, %v, want %q", resp.Body, err, "hello")
+	}
+}
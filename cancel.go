@@ -0,0 +1,118 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Cancel is used to tell the server to stop working on the request in flight on
+// the connection, such as one whose caller gave up waiting. The endpoint sees
+// it through the context it was called with. The request is still
+// answered, with either the endpoint's response or an error frame, so it has to
+// be read as usual. A cancel frame that reaches the server after the request
+// was answered is ignored.
+func (c *Client) Cancel(endpoint string) (n int, err error) {
+	return c.WriteMeta(Metadata{EndpointType: EndpointCancel, Endpoint: endpoint})
+}
+
+// RequestContext returns the context a request endpoint was called with, for
+// code that only has its writer. The context is cancelled when the client sends
+// a cancel frame or its connection fails while the endpoint runs, when the
+// request's Timeout elapses, and when the server shuts down. w is the writer the
+// endpoint was called with, unwrapped as by ClientFromWriter; for any other
+// writer, a context that is never cancelled is returned.
+func RequestContext(w io.Writer) context.Context {
+	if rw, ok := unwrapResponseWriter(w); ok && rw.ctx != nil {
+		return rw.ctx
+	}
+	return context.Background()
+}
+
+// watchCancel is used to notice a cancellation while a request endpoint runs. It
+// reads from the connection in the background: a cancel frame or an error, such
+// as the connection being reset, cancel the request, while the first bytes of a
+// pipelined request only end the watch. So does the end of the connection,
+// since a client that closed its side has no more requests to send, but may
+// still be waiting for the response. What was read is kept for the next frame.
+// The returned function stops the watch, and must be called before the
+// connection is read again.
+//
+// Compressed connections are not watched, since interrupting the read would
+// leave the decompressor in an unusable state, and neither are connections
+// without support for deadlines, since the read could not be interrupted.
+func (c *Client) watchCancel(cancel context.CancelFunc) (stop func()) {
+	if c.r != nil || c.conn.SetReadDeadline(time.Time{}) != nil {
+		return func() {}
+	}
+	stopping := make(chan struct{})
+	canceling := make(chan struct{}) // Closed once a cancel frame is being read.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		// The protocol version, which tells the form of the header, comes first,
+		// followed by the endpoint type.
+		header := make([]byte, HeaderSize)
+		n, err := io.ReadFull(c.conn, header[:2])
+
+		if n > 0 {
+			switch {
+			case n == 2 && header[0] == protocolVersion && header[1] == EndpointCancel:
+				close(canceling)
+				cancel()
+
+				// The rest of the header is read as well, so that the client is
+				// not left blocked in the middle of writing it.
+				rest, _ := io.ReadFull(c.conn, header[2:])
+				n += rest
+			case n == 2 && c.compact && header[0] == protocolVersion|compactFlag && header[1] == EndpointCancel:
+				close(canceling)
+				cancel()
+
+				// A compact header only tells its size as it is decoded.
+				rest := &bytes.Buffer{}
+				decodeCompact(header[0], io.MultiReader(bytes.NewReader(header[1:2]), io.TeeReader(c.conn, rest)), make([]byte, HeaderEndpointSize))
+				c.unread = append(header[:2], rest.Bytes()...)
+				return
+			}
+			c.unread = header[:n]
+			return
+		}
+		select {
+		case <-stopping: // The read was interrupted by stop.
+		default:
+			if err != io.EOF {
+				cancel()
+			}
+		}
+	}()
+
+	return func() {
+		close(stopping)
+
+		select {
+		case <-canceling: // The rest of the cancel frame is on its way.
+		default:
+			c.conn.SetReadDeadline(time.Now()) // Unblocks the pending read.
+		}
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// canceledError is used to turn the error of an endpoint that gave up on a
+// cancelled or timed out request into an error frame, so that the connection
+// stays usable. Other errors are returned as is.
+func canceledError(ctx context.Context, err error) error {
+	if ctx.Err() == nil || !errors.Is(err, ctx.Err()) {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &Error{Code: CodeTimeout, Message: ErrRequestTimeout.Error()}
+	}
+	return &Error{Code: CodeCanceled, Message: err.Error()}
+}
@@ -0,0 +1,190 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newBlockingServer returns a server whose "block" endpoint waits for its
+// request to be cancelled, reporting the context's error on canceled.
+func newBlockingServer(started chan<- struct{}, canceled chan<- error) *Server {
+	s := newEchoServer()
+
+	s.AddRequestEndpoint("block", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		started <- struct{}{}
+
+		select {
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+			return nil
+		}
+	})
+	return s
+}
+
+func TestServerRequestCanceledOnReset(t *testing.T) {
+	started, canceled := make(chan struct{}, 1), make(chan error, 1)
+	s := newBlockingServer(started, canceled)
+	conn, err := net.Dial(ProtocolTCP, listenOn(t, s))
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	client := NewClientConn(conn)
+
+	if _, err := client.WriteDataString("block", ""); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	<-started
+
+	// Closing with no linger resets the connection.
+	conn.(*net.TCPConn).SetLinger(0)
+	client.Close()
+
+	if err := <-canceled; err == nil {
+		t.Error("context was not cancelled when the connection was reset")
+	}
+}
+
+func TestServerRequestNotCanceledOnHalfClose(t *testing.T) {
+	s := newEchoServer()
+	s.AddRequestEndpoint("slow", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+		_, err := io.WriteString(w, "done")
+		return err
+	})
+	conn, err := net.Dial(ProtocolTCP, listenOn(t, s))
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	client := NewClientConn(conn)
+
+	defer client.Close()
+
+	if _, err := client.WriteDataString("slow", ""); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+
+	// The client has no more requests to send, but still waits for the
+	// response.
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Could not close the write side: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "done" {
+		t.Errorf("body = %q, %v, want %q", body, err, "done")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	started, canceled := make(chan struct{}, 1), make(chan error, 1)
+	s := newBlockingServer(started, canceled)
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.WriteDataString("block", ""); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	<-started
+
+	if _, err := client.Cancel("block"); err != nil {
+		t.Fatalf("Could not cancel request: %v", err)
+	}
+	if err := <-canceled; err == nil {
+		t.Error("context was not cancelled by the cancel frame")
+	}
+	var e *Error
+
+	if _, _, err := client.ReadData(); !errors.As(err, &e) || e.Code != CodeCanceled {
+		t.Fatalf("error = %v, want code %d", err, CodeCanceled)
+	}
+
+	// A cancel frame arriving after the response is ignored, and the
+	// connection remains usable.
+	if _, err := client.Cancel("echo"); err != nil {
+		t.Fatalf("Could not cancel request: %v", err)
+	}
+	if _, err := client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+		t.Errorf("body = %q, %v, want %q", body, err, "hello")
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint RequestEndpoint
+	}{
+		{"context", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}},
+		{"abandoned", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			// The endpoint ignores its context, and writes its response
+			// long after the request timed out.
+			time.Sleep(time.Second)
+			_, err := io.Copy(w, r)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.AddRequestEndpoint("slow", tt.endpoint)
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			start := time.Now()
+
+			if _, err := client.WriteRequest(Request{Meta: Metadata{Endpoint: "slow", Timeout: 50 * time.Millisecond}, Body: []byte("late")}); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			var e *Error
+
+			if _, _, err := client.ReadData(); !errors.As(err, &e) || e.Code != CodeTimeout || !errors.Is(err, ErrRequestTimeout) {
+				t.Errorf("error = %v, want %v", err, ErrRequestTimeout)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("The timeout was reported after %v", elapsed)
+			}
+
+			// The connection carries on, while the endpoint is left to
+			// return on its own.
+			if _, err := client.WriteDataString("echo", "hello"); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+				t.Errorf("body = %q, %v, want %q", body, err, "hello")
+			}
+		})
+	}
+}
+
+func TestRequestContextOtherWriter(t *testing.T) {
+	if err := RequestContext(io.Discard).Err(); err != nil {
+		t.Errorf("error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,95 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// CapabilitiesEndpoint is the name of the built-in request endpoint that
+// describes the server to its clients. Every server created by this package
+// answers it, unless an endpoint of the same name is registered over it.
+const CapabilitiesEndpoint = "__capabilities"
+
+// ErrLayoutMismatch is returned when a peer uses a different header layout
+// than this build, meaning the two cannot exchange frames.
+var ErrLayoutMismatch = errors.New("header layout mismatch")
+
+// Capabilities describes what a server supports. It is returned as JSON by the
+// CapabilitiesEndpoint.
+type Capabilities struct {
+	HeaderSize            int `json:"header_size"`
+	HeaderEndpointSize    int `json:"header_endpoint_size"`
+	HeaderContentTypeSize int `json:"header_content_type_size"`
+	HeaderAcceptSize      int `json:"header_accept_size"`
+
+	// Compression lists the methods that can be passed to EnableCompression.
+	Compression []string `json:"compression,omitempty"`
+
+	// Endpoints maps the names of the request endpoints to their IDs; see
+	// Server.EndpointIDs. It is only filled in by servers.
+	Endpoints map[string]uint32 `json:"endpoints,omitempty"`
+}
+
+// LocalCapabilities returns the capabilities of this build of the package.
+func LocalCapabilities() Capabilities {
+	return Capabilities{
+		HeaderSize:            HeaderSize,
+		HeaderEndpointSize:    HeaderEndpointSize,
+		HeaderContentTypeSize: HeaderContentTypeSize,
+		HeaderAcceptSize:      HeaderAcceptSize,
+		Compression:           supportedCompression(),
+	}
+}
+
+// CheckLayout returns ErrLayoutMismatch if the header layout described by c
+// differs from the expected one.
+func (c Capabilities) CheckLayout(expected Capabilities) error {
+	if c.HeaderSize != expected.HeaderSize ||
+		c.HeaderEndpointSize != expected.HeaderEndpointSize ||
+		c.HeaderContentTypeSize != expected.HeaderContentTypeSize ||
+		c.HeaderAcceptSize != expected.HeaderAcceptSize {
+		return errors.Wrapf(ErrLayoutMismatch, "got %d byte header, want %d", c.HeaderSize, expected.HeaderSize)
+	}
+	return nil
+}
+
+// capabilitiesEndpoint is the built-in handler for the CapabilitiesEndpoint.
+func (s *Server) capabilitiesEndpoint(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+	caps := LocalCapabilities()
+	caps.Compression = s.compressionMethods()
+	caps.Endpoints = s.EndpointIDs()
+
+	return json.NewEncoder(w).Encode(caps)
+}
+
+// Capabilities is used to fetch the capabilities of the server.
+func (c *Client) Capabilities() (caps Capabilities, err error) {
+	if _, err = c.WriteData(CapabilitiesEndpoint, nil); err != nil {
+		return caps, err
+	}
+	_, body, err := c.ReadData()
+
+	if err != nil {
+		return caps, err
+	}
+	if err = json.Unmarshal(body, &caps); err != nil {
+		return caps, errors.Wrap(err, "could not decode capabilities")
+	}
+	c.caps = &caps
+	return caps, nil
+}
+
+// VerifyLayout is used to make sure the server uses the same header layout as
+// this client before exchanging any other frames. It fails fast with
+// ErrLayoutMismatch otherwise.
+func (c *Client) VerifyLayout() error {
+	caps, err := c.Capabilities()
+
+	if err != nil {
+		return err
+	}
+	return caps.CheckLayout(LocalCapabilities())
+}
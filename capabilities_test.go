@@ -0,0 +1,62 @@
+package srv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClientCapabilities(t *testing.T) {
+	s := NewInMemoryServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	caps, err := client.Capabilities()
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	want := LocalCapabilities()
+	want.Endpoints = map[string]uint32{CapabilitiesEndpoint: 1}
+
+	if !reflect.DeepEqual(caps, want) {
+		t.Errorf("capabilities = %#v, want %#v", caps, want)
+	}
+	if caps.HeaderSize != HeaderSize {
+		t.Errorf("header size = %v, want %v", caps.HeaderSize, HeaderSize)
+	}
+	if err = client.VerifyLayout(); err != nil {
+		t.Errorf("Should not return an error, got %v", err)
+	}
+}
+
+func TestCapabilitiesCheckLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected Capabilities
+		wantErr  bool
+	}{
+		{"same layout", LocalCapabilities(), false},
+		{"smaller header", Capabilities{HeaderSize: 225, HeaderEndpointSize: 100, HeaderContentTypeSize: 100}, true},
+		{"different field size", Capabilities{HeaderSize: HeaderSize, HeaderEndpointSize: 50, HeaderContentTypeSize: 150, HeaderAcceptSize: HeaderAcceptSize}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := LocalCapabilities().CheckLayout(tt.expected)
+
+			if tt.wantErr {
+				if errors.Cause(err) != ErrLayoutMismatch {
+					t.Errorf("error = %v, want %v", err, ErrLayoutMismatch)
+				}
+			} else if err != nil {
+				t.Errorf("Should not return an error, got %v", err)
+			}
+		})
+	}
+}
@@ -2,8 +2,13 @@ package srv
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
+	"math"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,43 +16,227 @@ import (
 
 var errConnectionClosed = errors.New("connection already closed")
 
+// ErrResponseTooLarge is returned when a frame declares a body larger than the
+// client's MaxResponseBody.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// ErrMessageTooLarge is returned by ReadMessage when a message is larger than
+// the client's MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrInvalidBodySize is returned when a frame declares a body size that is
+// negative or too large to be held in memory on this platform, such as one
+// beyond 2 GiB on 32-bit builds.
+var ErrInvalidBodySize = errors.New("invalid body size")
+
+// ErrUnexpectedFrame is returned by ReadMessage when the next frame is not a
+// message.
+var ErrUnexpectedFrame = errors.New("unexpected frame")
+
 // Client is used to interact with a `Server`. It implements the following
 // interfaces to make it easy to replace a raw `net.Conn`:
 //
 // - `io.Closer`
 // - `io.Reader`
 // - `io.Writer`
+// - `net.Conn`
 //
 // Because of this, it also implements all of the combinations of these
 // interfaces.
+//
+// Writes and framed reads may be made from different goroutines, such as one
+// writing requests while another reads responses: every write, and every frame
+// read with ReadResponse, ReadData, ReadMessage and the like, is done as a
+// whole, so frames are never interleaved. Several goroutines can also send
+// requests at once with Do. Otherwise, which goroutine reads the response to
+// which request is up to the caller, and reconnecting (see AutoReconnect) is
+// only safe while no other goroutine uses the client.
 type Client struct {
-	conn     net.Conn
-	protocol string
-	uri      string
-	closed   bool
+	// MaxResponseBody limits the size of the bodies the client will read, in
+	// bytes. The declared size is checked before anything is allocated, which
+	// protects the client from a misbehaving server claiming a huge body. A
+	// value of zero or less means there is no limit.
+	MaxResponseBody int64
+
+	// MaxMessageSize limits the size of the messages ReadMessage will read, in
+	// bytes, like MaxResponseBody does for other frames: the size declared in
+	// the header is checked before anything is allocated, and larger messages
+	// are turned down with ErrMessageTooLarge. Their body is left unread, so
+	// the connection is no longer in step with the peer; with
+	// CloseOnLargeMessage set, the client closes it right away. A value of
+	// zero or less means there is no limit besides MaxResponseBody. Servers set
+	// both on the clients of their streaming endpoints; see
+	// Server.MaxMessageSize.
+	MaxMessageSize      int64
+	CloseOnLargeMessage bool
+
+	// MaxRedirects is the number of redirects Send and SendContext follow for
+	// a request before giving up with ErrTooManyRedirects. A redirect to another
+	// endpoint is followed on the same connection; one to another server is
+	// followed over a new connection using the same protocol, which is closed
+	// once the response is read, and only for clients created with NewClient or
+	// NewClientTLS (in which case the new connection uses TLS as well).
+	// A value of zero or less means redirects are not followed, and are
+	// returned as a *Redirect instead.
+	MaxRedirects int
+
+	// CompactHeaders makes Handshake ask the server for compact headers, which
+	// shrink the header of typical frames from HeaderSize to a few dozen bytes;
+	// see Metadata.EncodeCompact. It has no effect after the handshake.
+	CompactHeaders bool
+
+	// AutoReconnect makes the client dial the server again, the way it was
+	// first dialled, once its connection failed, such as after the server
+	// restarted, instead of failing every call from then on. Only clients
+	// created with NewClient or NewClientTLS can reconnect, and only for
+	// requests: WriteRequest and its wrappers, such as WriteData, Notify and
+	// Send, reconnect before writing if a read or write failed since the last
+	// one, and write again over a new connection if the write fails. A read
+	// that fails, such as in ReadData, still returns its error, since the
+	// response is lost along with the connection, but the next request goes
+	// over a new connection.
+	//
+	// With ResendOnReconnect set as well, Send sends its request again, once,
+	// over a new connection if the connection ends before the response starts.
+	// The server may have gone away while serving the request, though, so the
+	// request may then reach it twice; it should only be set for requests that
+	// are safe to repeat.
+	//
+	// Streams are never resumed: once a stream header was written, the client
+	// no longer reconnects, and the failures of the stream are returned as
+	// they are. Options negotiated with Handshake do not carry over to a new
+	// connection either.
+	//
+	// ReconnectAttempts is the number of dials made before giving up, and
+	// ReconnectDelay the delay before the second, doubled for every other one
+	// (see NewClientRetry); zero or less means DefaultReconnectAttempts and
+	// DefaultReconnectDelay.
+	AutoReconnect     bool
+	ResendOnReconnect bool
+	ReconnectAttempts int
+	ReconnectDelay    time.Duration
+
+	conn        net.Conn
+	protocol    string
+	uri         string
+	tlsConfig   *tls.Config // The configuration the client was dialled with, if it uses TLS.
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeErr    error                       // The result of closing conn.
+	onClose     func()                      // Called once the client is closed, if set; see reactor.
+	r           io.Reader                   // Replaces conn for reads once compression is enabled.
+	w           FlushWriter                 // Replaces conn for writes once compression is enabled.
+	compression string                      // The negotiated compression method, if any.
+	compact     bool                        // Whether compact headers were negotiated.
+	caps        *Capabilities               // The capabilities last advertised by the server.
+	unread      []byte                      // Read ahead while watching for a cancellation.
+	wireR       *countingReader             // Counts the bytes read from conn once compression is enabled.
+	wireW       *countingWriter             // Counts the bytes written to conn once compression is enabled.
+	headerWire  int64                       // The bytes read from conn when the last header started.
+	headerSize  int64                       // The size of the last header read, which depends on its form.
+	rDeadline   time.Time                   // The read deadline last set on the client.
+	wDeadline   time.Time                   // The write deadline last set on the client.
+	bodyBuf     []byte                      // Reused for request bodies on the server; see Server.BodyBufferSize.
+	respBuf     *bytes.Buffer               // Reused for responses on the server; see Server.BodyBufferSize.
+	values      map[interface{}]interface{} // Values stored on the connection with Set.
+	counters    *serverCounters             // Counts the bytes of a connection served by a server, if set.
+	coalesce    *coalescer                  // Buffers the writes to conn, if set; see Server.FlushPolicy.
+	failed      atomic.Bool                 // Whether a read or write on conn failed; see Pool.
+	respDue     atomic.Int64                // When the response to the last request is due, in Unix nanoseconds, or zero; see ReadResponse.
+	streaming   atomic.Bool                 // Whether a stream was started on conn, which rules out reconnecting.
+	writeMu     sync.Mutex                  // Makes every write whole, so that frames are not interleaved.
+	readMu      sync.Mutex                  // Makes every framed read whole.
+	doMu        sync.Mutex                  // Serializes the round trips of Do.
+	valuesMu    sync.Mutex                  // Guards values.
 }
 
 // NewClientConn is used to create a new client from the net.Conn. This client
 // is mostly useful for server-side interactions, where the read functions come
 // in handy.
 func NewClientConn(conn net.Conn) *Client {
-	return &Client{conn: conn}
+	return &Client{conn: conn, done: make(chan struct{})}
 }
 
 // NewClient is used to return a new client that can be used to interact with a
 // server.
 func NewClient(protocol string, uri string) (*Client, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch protocol {
+	case ProtocolTCP, ProtocolUnix:
+		conn, err = net.Dial(protocol, uri)
+	case ProtocolUDP:
+		if conn, err = net.Dial(protocol, uri); err == nil {
+			conn = &datagramClient{Conn: conn}
+		}
+	default:
+		t, ok := platformTransports[protocol]
+
+		if !ok {
+			return nil, errInvalidProtocol
+		}
+		conn, err = t.dial(uri)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not dial")
+	}
+	return &Client{conn: conn, protocol: protocol, uri: uri, done: make(chan struct{})}, nil
+}
+
+// NewClientTLS is like NewClient, but it connects to a server listening with
+// TLS, such as with ListenTLS. The configuration decides how the server is
+// verified, such as with RootCAs when it uses a self-signed certificate, and
+// ServerName, which is otherwise taken from the uri. Certificates holds the
+// client certificate for mutual TLS, and a ClientSessionCache lets later
+// connections resume the session. Only TCP and Unix domain sockets are
+// supported.
+func NewClientTLS(protocol, uri string, cfg *tls.Config) (*Client, error) {
 	switch protocol {
 	case ProtocolTCP, ProtocolUnix:
 	default:
 		return nil, errInvalidProtocol
 	}
-	conn, err := net.Dial(protocol, uri)
+	conn, err := tls.Dial(protocol, uri, cfg)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "could not dial")
 	}
-	return &Client{conn: conn, protocol: protocol, uri: uri}, nil
+	return &Client{conn: conn, protocol: protocol, uri: uri, tlsConfig: cfg, done: make(chan struct{})}, nil
+}
+
+// NewClientRetry is like NewClient, but it keeps trying to connect if the dial
+// fails, up to the given number of attempts. The delay between attempts starts
+// at baseDelay and doubles each time, with random jitter so that many clients
+// started together do not retry in lockstep. This makes client startup
+// resilient to the server not being ready yet.
+func NewClientRetry(protocol, uri string, attempts int, baseDelay time.Duration) (*Client, error) {
+	var (
+		client *Client
+		err    error
+		delay  = baseDelay
+	)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(jitter(delay))
+			delay *= 2
+		}
+		client, err = NewClient(protocol, uri)
+
+		if err == nil || err == errInvalidProtocol {
+			return client, err
+		}
+	}
+	return nil, errors.Wrapf(err, "gave up after %d attempts", attempts)
+}
+
+// jitter returns a random duration between half of d and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
 // RemoteAddr is a wrapper around the conn's RemoteAddr func.
@@ -55,35 +244,65 @@ func (c *Client) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// LocalAddr is a wrapper around the conn's LocalAddr func.
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// AsConn returns the client as a `net.Conn`. This makes it possible to layer
+// other `net.Conn`-based protocols (a TLS session, an SSH transport, etc.) on
+// top of a streaming endpoint. Reads and writes go through the client, so they
+// fail once the client has been closed.
+func (c *Client) AsConn() net.Conn {
+	return c
+}
+
 // Write is used to implement io.Writer. Operations on a closed connection
 // result in an immediate failure. Otherwise, it defers to the underlying
 // `net.Conn`. **NOTE** this method has no knowledge of the structure of the
 // protocol, so it should be used only in special circumstances.
 func (c *Client) Write(b []byte) (n int, err error) {
-	if c.closed {
+	if c.isClosed() {
 		return 0, errConnectionClosed
 	}
-	return c.conn.Write(b)
+	c.writeMu.Lock()
+
+	defer func() {
+		c.writeMu.Unlock()
+
+		if err != nil {
+			c.failed.Store(true)
+		}
+		if c.counters != nil {
+			c.counters.bytesWritten.Add(int64(n))
+		}
+	}()
+	if c.w == nil {
+		return c.connWriter().Write(b)
+	}
+	if n, err = c.w.Write(b); err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
 }
 
 // WriteMeta is used to write the metadata to the connection.
 func (c *Client) WriteMeta(meta Metadata) (n int, err error) {
-	if c.closed {
+	if c.isClosed() {
 		return 0, errConnectionClosed
 	}
-	return c.Write(meta.Encode())
+	if meta.EndpointType == EndpointStream {
+		c.streaming.Store(true)
+	}
+	c.expectResponse(meta)
+
+	return c.Write(c.encodeMeta(meta))
 }
 
 // WriteData is used as a convenience wrapper around the Write operation. It
 // accepts an endpoint name and a byte slice as the body.
 func (c *Client) WriteData(endpoint string, body []byte) (n int, err error) {
-	if c.closed {
-		return 0, errConnectionClosed
-	}
-	meta := Metadata{BodySize: int64(len(body)), Endpoint: endpoint}
-	req := meta.Encode()
-
-	return c.Write(append(req, body...))
+	return c.WriteRequest(Request{Meta: Metadata{Endpoint: endpoint}, Body: body})
 }
 
 // WriteDataString is used as a convenience wrapper around the WriteData
@@ -94,7 +313,7 @@ func (c *Client) WriteDataString(endpoint, body string) (n int, err error) {
 
 // WriteDataReader accepts an endpoint name and an `io.Reader` as the body.
 func (c *Client) WriteDataReader(endpoint string, body io.Reader) (n int, err error) {
-	if c.closed {
+	if c.isClosed() {
 		return 0, errConnectionClosed
 	}
 	buf := &bytes.Buffer{}
@@ -104,28 +323,92 @@ func (c *Client) WriteDataReader(endpoint string, body io.Reader) (n int, err er
 		return 0, errors.Wrap(err, "could not copy from reader")
 	}
 	meta := Metadata{BodySize: bytes, Endpoint: endpoint}
-	req := meta.Encode()
+	req := c.encodeMeta(meta)
+	c.expectResponse(meta)
 
 	return c.Write(append(req, buf.Bytes()...))
 }
 
+// WriteTrailer is used to finish a multi-frame response. Any number of frames
+// can be written with WriteData beforehand; WriteTrailer then writes the
+// end-of-stream marker carrying the trailer, which may be nil.
+func (c *Client) WriteTrailer(endpoint string, trailer Trailer) (n int, err error) {
+	if c.isClosed() {
+		return 0, errConnectionClosed
+	}
+	body := trailer.Encode()
+	meta := Metadata{EndpointType: EndpointStreamEnd, BodySize: int64(len(body)), Endpoint: endpoint}
+
+	return c.Write(append(c.encodeMeta(meta), body...))
+}
+
+// WriteMessage is used to write a framed message on a streaming connection.
+//
+// Messages and raw bytes (written with Write and read with Read) can be mixed on
+// the same connection, for example to send control messages around a bulk
+// transfer. The client never reads ahead: ReadMessage consumes exactly one
+// frame, and Read consumes only what is asked of it. The protocol does not mark
+// where raw bytes begin or end, though, so both peers have to agree on it,
+// usually by announcing the length of the raw data in a message beforehand.
+func (c *Client) WriteMessage(body []byte) (n int, err error) {
+	if c.isClosed() {
+		return 0, errConnectionClosed
+	}
+	meta := Metadata{EndpointType: EndpointStream, BodySize: int64(len(body))}
+	c.streaming.Store(true)
+
+	return c.Write(append(c.encodeMeta(meta), body...))
+}
+
 // Read is used to implement io.Reader. Operations on a closed connection result
 // in an immediate failure. Otherwise, it defers to the underlying `net.Conn`.
 // **NOTE** this method has no knowledge of the structure of the protocol, so it
 // should be used only in special circumstances.
 func (c *Client) Read(b []byte) (n int, err error) {
-	if c.closed {
+	if c.isClosed() {
 		return 0, errConnectionClosed
 	}
-	return c.conn.Read(b)
+	defer func() {
+		if err != nil {
+			c.failed.Store(true)
+		}
+		if c.counters != nil {
+			c.counters.bytesRead.Add(int64(n))
+		}
+	}()
+	if len(c.unread) > 0 {
+		n = copy(b, c.unread)
+		c.unread = c.unread[n:]
+		return n, nil
+	}
+	if c.r == nil {
+		return c.conn.Read(b)
+	}
+	return c.r.Read(b)
 }
 
 // ReadMeta is used to read the metadata from a connection. It returns the
-// metadata and an error, if one occurred.
+// metadata and an error, if one occurred. It blocks until the whole header has
+// been read, however the connection splits it up.
 func (c *Client) ReadMeta() (meta Metadata, err error) {
-	header := make([]byte, headerSize)
+	return c.ReadMetaInto(make([]byte, HeaderSize))
+}
 
-	if _, err = c.Read(header); err != nil {
+// ReadMetaInto is like ReadMeta, but it reads the header into buf instead of
+// allocating a new buffer, so that a buffer can be reused across frames. buf
+// must be at least HeaderSize bytes long.
+func (c *Client) ReadMetaInto(buf []byte) (meta Metadata, err error) {
+	if len(buf) < HeaderSize {
+		return meta, errors.Wrapf(io.ErrShortBuffer, "%d byte buffer, header is %d", len(buf), HeaderSize)
+	}
+	header := buf[:HeaderSize]
+	c.headerWire = c.wireRead()
+	c.headerSize = HeaderSize
+
+	if c.compact {
+		return c.readCompactMeta(header)
+	}
+	if _, err = io.ReadFull(c, header); err != nil {
 		return meta, err
 	}
 	meta, err = DecodeMetadata(header)
@@ -141,10 +424,51 @@ func (c *Client) ReadMeta() (meta Metadata, err error) {
 }
 
 // ReadBody is used to read the body from a connection, with the metadata as a
-// reference (describing the size of the body).
+// reference (describing the size of the body). It blocks until the whole body
+// has been read, however the connection splits it up. If the connection ends
+// before any of the body arrives, io.EOF is returned as is; if it ends partway
+// through, the error wraps io.ErrUnexpectedEOF, since the body was truncated.
 func (c *Client) ReadBody(meta Metadata) (body []byte, err error) {
-	body = make([]byte, meta.BodySize)
-	_, err = c.Read(body)
+	if meta.BodySize < 0 || uint64(meta.BodySize) > math.MaxInt {
+		return nil, errors.Wrapf(ErrInvalidBodySize, "%d bytes", meta.BodySize)
+	}
+	if c.MaxResponseBody > 0 && meta.BodySize > c.MaxResponseBody {
+		return nil, errors.Wrapf(ErrResponseTooLarge, "%d bytes, limit is %d", meta.BodySize, c.MaxResponseBody)
+	}
+	if meta.BodySize > bodyChunkSize {
+		return c.readBodyChunked(meta)
+	}
+	return c.readBodyInto(meta, make([]byte, meta.BodySize))
+}
+
+// bodyChunkSize is the largest body ReadBody allocates up front. Larger bodies
+// are read into a buffer that grows as they arrive.
+const bodyChunkSize = 1 << 20
+
+// readBodyChunked is like ReadBody, but the buffer grows as the body arrives
+// rather than being allocated whole, so that a header declaring a huge body
+// costs no more than what the peer actually sends.
+func (c *Client) readBodyChunked(meta Metadata) (body []byte, err error) {
+	buf := bytes.NewBuffer(make([]byte, 0, bodyChunkSize))
+	n, err := io.CopyN(buf, c, meta.BodySize)
+
+	switch {
+	case err == nil:
+		return buf.Bytes(), nil
+	case err == io.EOF && n == 0:
+		return nil, err
+	case err == io.EOF:
+		return buf.Bytes(), errors.Wrap(io.ErrUnexpectedEOF, "could not read body")
+	default:
+		return buf.Bytes(), errors.Wrap(err, "could not read body")
+	}
+}
+
+// readBodyInto is like ReadBody, but it reads the body into buf, which must be
+// large enough to hold it, and returns the part of buf holding the body.
+func (c *Client) readBodyInto(meta Metadata, buf []byte) (body []byte, err error) {
+	body = buf[:meta.BodySize]
+	_, err = io.ReadFull(c, body)
 
 	switch err {
 	case io.EOF:
@@ -157,15 +481,84 @@ func (c *Client) ReadBody(meta Metadata) (body []byte, err error) {
 }
 
 // ReadData is used to read a request from the connection. It returns the
-// metadata, the body as a byte slice, and an error, if one occurred.
+// metadata, the body as a byte slice, and an error, if one occurred. If the
+// server rejected the request with an error frame, the error is an *Error.
 func (c *Client) ReadData() (meta Metadata, body []byte, err error) {
-	meta, err = c.ReadMeta()
+	resp, err := c.ReadResponse()
+	return resp.Meta, resp.Body, err
+}
+
+// ReadStream is used to read a multi-frame response. The callback is invoked
+// for every data frame until the end-of-stream marker is read, at which point
+// the trailer is returned. If the callback returns an error, reading stops and
+// the error is returned; the rest of the stream is left unread.
+func (c *Client) ReadStream(fn func(meta Metadata, body []byte) error) (Trailer, error) {
+	for {
+		meta, body, err := c.ReadData()
+
+		if err != nil {
+			return nil, err
+		}
+		if meta.EndpointType == EndpointStreamEnd {
+			return DecodeTrailer(body)
+		}
+		if err = fn(meta, body); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ReadAll is used to read a multi-frame response whole. The bodies of its data
+// frames are concatenated, and returned with the metadata of the first frame,
+// whose BodySize is set to the combined size. The trailer is dropped; use
+// ReadStream to get at it, or to handle frames as they arrive. MaxResponseBody
+// applies to the combined size as well as to every frame.
+func (c *Client) ReadAll() (meta Metadata, body []byte, err error) {
+	first := true
+
+	_, err = c.ReadStream(func(frame Metadata, b []byte) error {
+		if first {
+			meta, first = frame, false
+		}
+		body = append(body, b...)
+
+		if c.MaxResponseBody > 0 && int64(len(body)) > c.MaxResponseBody {
+			return errors.Wrapf(ErrResponseTooLarge, "%d bytes so far, limit is %d", len(body), c.MaxResponseBody)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return meta, nil, err
+	}
+	meta.BodySize = int64(len(body))
+
+	return meta, body, nil
+}
+
+// ReadMessage is used to read a message written with WriteMessage. It returns
+// ErrUnexpectedFrame if the next frame is not a message, which usually means the
+// peers disagree about where the raw bytes end, and ErrMessageTooLarge if the
+// message is larger than MaxMessageSize.
+func (c *Client) ReadMessage() (body []byte, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	meta, err := c.ReadMeta()
 
 	if err != nil {
-		return meta, body, err
+		return nil, err
+	}
+	if meta.EndpointType != EndpointStream {
+		return nil, errors.Wrapf(ErrUnexpectedFrame, "%s frame", EndpointTypeName(meta.EndpointType))
 	}
-	body, err = c.ReadBody(meta)
-	return meta, body, err
+	if c.MaxMessageSize > 0 && meta.BodySize > c.MaxMessageSize {
+		if c.CloseOnLargeMessage {
+			c.Close()
+		}
+		return nil, errors.Wrapf(ErrMessageTooLarge, "%d bytes, limit is %d", meta.BodySize, c.MaxMessageSize)
+	}
+	return c.ReadBody(meta)
 }
 
 // ReadDataString is used to wrap ReadData, returning a string instead of a
@@ -177,14 +570,55 @@ func (c *Client) ReadDataString() (meta Metadata, body string, err error) {
 
 // Close is used to implement io.Closer. Operations on a closed connection
 // result in an immediate failure. Otherwise, it defers to the underlying
-// `net.Conn`.
+// `net.Conn`. It is safe to call Close several times, including concurrently:
+// the connection is only closed once, and every call returns the result of
+// closing it.
 func (c *Client) Close() error {
-	c.closed = true
-	return c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.clearValues()
+		c.flushWrites()
+		c.closeErr = c.conn.Close()
+
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.closeErr
+}
+
+// Done returns a channel that is closed once the client has been closed, either
+// explicitly or by a wrapper such as MaxStreamDuration. Streaming endpoints can
+// select on it to notice that their connection has gone away.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // SetDeadline is used to set a deadline on the underlying connection to do some
 // IO.
 func (c *Client) SetDeadline(deadline time.Time) error {
+	c.rDeadline, c.wDeadline = deadline, deadline
 	return c.conn.SetDeadline(deadline)
 }
+
+// SetReadDeadline is used to set a read deadline on the underlying connection.
+func (c *Client) SetReadDeadline(deadline time.Time) error {
+	c.rDeadline = deadline
+	return c.conn.SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline is used to set a write deadline on the underlying
+// connection.
+func (c *Client) SetWriteDeadline(deadline time.Time) error {
+	c.wDeadline = deadline
+	return c.conn.SetWriteDeadline(deadline)
+}
@@ -1,23 +1,39 @@
 package srv
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestNewClient(t *testing.T) {
 	port := 12309
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 
-	go func() {
-		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("Could not start listener: %v", err)
+	}
+	defer listener.Close()
 
-		if err != nil {
-			t.Errorf("Could not start listener: %v", err)
-			t.Fail()
-		}
+	go func() {
 		for {
-			conn, _ := listener.Accept()
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
 			conn.Close()
 		}
 	}()
@@ -63,3 +79,680 @@ func TestNewClient(t *testing.T) {
 		})
 	}
 }
+
+func TestNewClientRetry(t *testing.T) {
+	// Reserve a free port, then release it so that nothing is listening yet.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Could not start listener: %v", err)
+	}
+	uri := listener.Addr().String()
+	listener.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		listener, err := net.Listen("tcp", uri)
+
+		if err != nil {
+			t.Errorf("Could not start listener: %v", err)
+			return
+		}
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	client, err := NewClientRetry(ProtocolTCP, uri, 10, 10*time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	client.Close()
+
+	if _, err = NewClientRetry("foo", uri, 10, time.Second); err != errInvalidProtocol {
+		t.Errorf("error = %v, want %v", err, errInvalidProtocol)
+	}
+	if _, err = NewClientRetry(ProtocolTCP, uri, 2, time.Millisecond); err == nil {
+		t.Error("Should return an error once the attempts are exhausted")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, d := range []time.Duration{0, time.Nanosecond, time.Millisecond, time.Second} {
+		for i := 0; i < 100; i++ {
+			if got := jitter(d); got < d/2 || got > d {
+				t.Fatalf("jitter(%v) = %v, want between %v and %v", d, got, d/2, d)
+			}
+		}
+	}
+}
+
+func TestClientAsConn(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := NewClientConn(serverConn).AsConn()
+	client := NewClientConn(clientConn).AsConn()
+
+	defer server.Close()
+	defer client.Close()
+
+	// A simple line protocol: the server answers each line with its uppercase.
+	go func() {
+		input := bufio.NewScanner(server)
+
+		for input.Scan() {
+			fmt.Fprintln(server, strings.ToUpper(input.Text()))
+		}
+	}()
+
+	output := bufio.NewScanner(client)
+
+	for _, line := range []string{"hello", "world"} {
+		if _, err := fmt.Fprintln(client, line); err != nil {
+			t.Fatalf("Could not write line: %v", err)
+		}
+		if !output.Scan() {
+			t.Fatalf("Could not read line: %v", output.Err())
+		}
+		if got, want := output.Text(), strings.ToUpper(line); got != want {
+			t.Errorf("line = %v, want %v", got, want)
+		}
+	}
+	if client.LocalAddr() == nil || client.RemoteAddr() == nil {
+		t.Error("Expected addresses to be reported")
+	}
+}
+
+func TestClientReadStream(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := NewClientConn(serverConn)
+	client := NewClientConn(clientConn)
+	rows := []string{"one", "two", "three"}
+
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		for _, row := range rows {
+			server.WriteDataString("rows", row)
+		}
+		server.WriteTrailer("rows", Trailer{"count": strconv.Itoa(len(rows))})
+	}()
+
+	var got []string
+
+	trailer, err := client.ReadStream(func(meta Metadata, body []byte) error {
+		got = append(got, string(body))
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	if strings.Join(got, ",") != strings.Join(rows, ",") {
+		t.Errorf("frames = %v, want %v", got, rows)
+	}
+	if trailer["count"] != "3" {
+		t.Errorf("trailer = %v, want count of 3", trailer)
+	}
+}
+
+func TestNewClientTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newEchoServer()
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	addr := listenOnTLS(t, s)
+	_, port, _ := net.SplitHostPort(addr)
+
+	tests := []struct {
+		name     string
+		protocol string
+		uri      string
+		cfg      *tls.Config
+		wantErr  bool
+	}{
+		{"trusted certificate", ProtocolTCP, addr, &tls.Config{RootCAs: pool}, false},
+		{"custom server name", ProtocolTCP, addr, &tls.Config{RootCAs: pool, ServerName: "localhost"}, false},
+		{"server name from the uri", ProtocolTCP, net.JoinHostPort("localhost", port), &tls.Config{RootCAs: pool}, false},
+		{"wrong server name", ProtocolTCP, addr, &tls.Config{RootCAs: pool, ServerName: "example.com"}, true},
+		{"untrusted certificate", ProtocolTCP, addr, &tls.Config{}, true},
+		{"invalid protocol", "udp", addr, &tls.Config{RootCAs: pool}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, err := NewClientTLS(tt.protocol, tt.uri, tt.cfg)
+
+			if tt.wantErr {
+				if err == nil {
+					client.Close()
+					t.Fatal("Should return an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not connect: %v", err)
+			}
+			defer client.Close()
+
+			resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+			if err != nil || string(resp.Body) != "hello" {
+				t.Errorf("response = %q, %v, want %q", resp.Body, err, "hello")
+			}
+			if client.ConnState().TLS == nil {
+				t.Error("The connection does not use TLS")
+			}
+		})
+	}
+}
+
+func TestClientReadAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int64
+		want    string
+		wantErr error
+	}{
+		{"no limit", 0, "onetwothree", nil},
+		{"within limit", 11, "onetwothree", nil},
+		{"combined size over limit", 10, "", ErrResponseTooLarge},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConn, clientConn := net.Pipe()
+			server := NewClientConn(serverConn)
+			client := NewClientConn(clientConn)
+			client.MaxResponseBody = tt.max
+
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				for _, row := range []string{"one", "two", "three"} {
+					server.WriteDataString("rows", row)
+				}
+				server.WriteTrailer("rows", Trailer{"count": "3"})
+			}()
+
+			meta, body, err := client.ReadAll()
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+			if err == nil && (meta.Endpoint != "rows" || meta.BodySize != int64(len(tt.want))) {
+				t.Errorf("metadata = %#v, want endpoint rows and a body size of %d", meta, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestClientMaxResponseBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int64
+		bodySize int64
+		wantErr  error
+	}{
+		{"no limit", 0, 5, nil},
+		{"within limit", 5, 5, nil},
+		{"declared size over limit", 1024, MaxInt, ErrResponseTooLarge},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConn, clientConn := net.Pipe()
+			server := NewClientConn(serverConn)
+			client := NewClientConn(clientConn)
+			client.MaxResponseBody = tt.max
+
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				meta := Metadata{Endpoint: "huge", BodySize: tt.bodySize}
+				server.Write(append(meta.Encode(), "hello"...))
+			}()
+
+			_, _, err := client.ReadData()
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientReadBodyChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		want    string
+		wantErr error
+	}{
+		{"whole", []string{"hello world"}, "hello world", nil},
+		{"small chunks", []string{"he", "l", "lo ", "wor", "ld"}, "hello world", nil},
+		{"one byte at a time", strings.Split("hello world", ""), "hello world", nil},
+		{"nothing before the close", nil, "", io.EOF},
+		{"truncated", []string{"hello"}, "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConn, clientConn := net.Pipe()
+			client := NewClientConn(clientConn)
+
+			defer client.Close()
+
+			go func() {
+				for _, chunk := range tt.chunks {
+					serverConn.Write([]byte(chunk))
+				}
+				serverConn.Close()
+			}()
+
+			body, err := client.ReadBody(Metadata{BodySize: int64(len("hello world"))})
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientReadBodyHugeSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		bodySize int64
+		sent     int
+		wantErr  error
+		intSize  int // The size of int the case applies to, or zero for any.
+	}{
+		{"huge", 1 << 62, 1024, io.ErrUnexpectedEOF, 64},
+		{"largest int", math.MaxInt, 1024, io.ErrUnexpectedEOF, 0},
+		{"nothing sent", 1 << 40, 0, io.EOF, 64},
+		{"over a chunk", bodyChunkSize*3 + 1, bodyChunkSize*3 + 1, nil, 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if tt.intSize != 0 && tt.intSize != strconv.IntSize {
+				t.Skipf("Only applies to %d-bit platforms", tt.intSize)
+			}
+			serverConn, clientConn := net.Pipe()
+			client := NewClientConn(clientConn)
+
+			defer client.Close()
+
+			go func() {
+				serverConn.Write(bytes.Repeat([]byte("a"), tt.sent))
+				serverConn.Close()
+			}()
+
+			// The body is not allocated whole, so this neither panics nor runs
+			// out of memory.
+			body, err := client.ReadBody(Metadata{BodySize: tt.bodySize})
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && len(body) != tt.sent {
+				t.Errorf("body is %d bytes, want %d", len(body), tt.sent)
+			}
+		})
+	}
+}
+
+func TestClientReadBodyInvalidSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		bodySize int64
+		intSize  int // The size of int the case applies to, or zero for any.
+	}{
+		{"negative", -1, 0},
+		{"beyond int", math.MaxInt32 + 1, 32},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if tt.intSize != 0 && tt.intSize != strconv.IntSize {
+				t.Skipf("Only applies to %d-bit platforms", tt.intSize)
+			}
+			serverConn, clientConn := net.Pipe()
+			client := NewClientConn(clientConn)
+
+			defer serverConn.Close()
+			defer client.Close()
+
+			if _, err := client.ReadBody(Metadata{BodySize: tt.bodySize}); errors.Cause(err) != ErrInvalidBodySize {
+				t.Errorf("error = %v, want %v", err, ErrInvalidBodySize)
+			}
+		})
+	}
+}
+
+func TestClientMessagesAndRawBytes(t *testing.T) {
+	s := NewInMemoryServer()
+	blob := []byte(strings.Repeat("0123456789abcdef", 512))
+	result := make(chan error, 1)
+
+	s.AddStreamingEndpoint("transfer", func(ctx context.Context, meta Metadata, client *Client) error {
+		result <- func() error {
+			control, err := client.ReadMessage()
+
+			if err != nil {
+				return err
+			}
+			size, err := strconv.Atoi(string(control))
+
+			if err != nil {
+				return err
+			}
+			buf := make([]byte, size)
+
+			if _, err = io.ReadFull(client, buf); err != nil {
+				return err
+			}
+			if _, err = client.WriteMessage([]byte("ok")); err != nil {
+				return err
+			}
+			if _, err = client.Write(buf); err != nil {
+				return err
+			}
+			_, err = client.WriteMessage([]byte("done"))
+			return err
+		}()
+		return nil
+	})
+
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.WriteMeta(Metadata{EndpointType: EndpointStream, Endpoint: "transfer"}); err != nil {
+		t.Fatalf("Could not open stream: %v", err)
+	}
+	if _, err := client.WriteMessage([]byte(strconv.Itoa(len(blob)))); err != nil {
+		t.Fatalf("Could not write control message: %v", err)
+	}
+	if _, err := client.Write(blob); err != nil {
+		t.Fatalf("Could not write blob: %v", err)
+	}
+	if got, err := client.ReadMessage(); err != nil || string(got) != "ok" {
+		t.Fatalf("first message = %q, %v, want %q", got, err, "ok")
+	}
+	echoed := make([]byte, len(blob))
+
+	if _, err := io.ReadFull(client, echoed); err != nil {
+		t.Fatalf("Could not read blob: %v", err)
+	}
+	if !bytes.Equal(echoed, blob) {
+		t.Error("echoed blob does not match the one sent")
+	}
+	if got, err := client.ReadMessage(); err != nil || string(got) != "done" {
+		t.Fatalf("last message = %q, %v, want %q", got, err, "done")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Handler error: %v", err)
+	}
+}
+
+func TestClientReadMessageUnexpectedFrame(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := NewClientConn(serverConn)
+	client := NewClientConn(clientConn)
+
+	defer server.Close()
+	defer client.Close()
+
+	go client.WriteDataString("echo", "not a message")
+
+	if _, err := server.ReadMessage(); errors.Cause(err) != ErrUnexpectedFrame {
+		t.Errorf("error = %v, want %v", err, ErrUnexpectedFrame)
+	}
+}
+
+func TestClientReadMessageTooLarge(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int64
+		size      int64
+		close     bool
+		wantErr   error
+		wantClose bool
+	}{
+		{"within limit", 16, 16, false, nil, false},
+		{"no limit", 0, 16, false, nil, false},
+		// The body is never sent, so reading it would block, and allocating it
+		// would fail.
+		{"over limit", 16, 1 << 50, false, ErrMessageTooLarge, false},
+		{"over limit closing", 16, 17, true, ErrMessageTooLarge, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConn, clientConn := net.Pipe()
+			server := NewClientConn(serverConn)
+			client := NewClientConn(clientConn)
+			server.MaxMessageSize = tt.limit
+			server.CloseOnLargeMessage = tt.close
+
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				client.WriteMeta(Metadata{EndpointType: EndpointStream, BodySize: tt.size})
+
+				if tt.wantErr == nil {
+					client.Write(make([]byte, tt.size))
+				}
+			}()
+
+			body, err := server.ReadMessage()
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && int64(len(body)) != tt.size {
+				t.Errorf("body is %d bytes, want %d", len(body), tt.size)
+			}
+			if closed := server.isClosed(); closed != tt.wantClose {
+				t.Errorf("closed = %t, want %t", closed, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestClientReadMetaInto(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := NewClientConn(serverConn)
+	client := NewClientConn(clientConn)
+
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := server.ReadMetaInto(make([]byte, HeaderSize-1)); errors.Cause(err) != io.ErrShortBuffer {
+		t.Errorf("error = %v, want %v", err, io.ErrShortBuffer)
+	}
+	endpoints := []string{"first", "second"}
+
+	go func() {
+		for _, endpoint := range endpoints {
+			client.WriteMeta(Metadata{Endpoint: endpoint})
+		}
+	}()
+
+	buf := make([]byte, HeaderSize+10)
+	var got []Metadata
+
+	for range endpoints {
+		meta, err := server.ReadMetaInto(buf)
+
+		if err != nil {
+			t.Fatalf("Should not return an error, got %v", err)
+		}
+		got = append(got, meta)
+	}
+	for i, endpoint := range endpoints {
+		if got[i].Endpoint != endpoint {
+			t.Errorf("endpoint %d = %q, want %q", i, got[i].Endpoint, endpoint)
+		}
+	}
+}
+
+// oneByteConn is a net.Conn whose reads return at most one byte, the way a
+// header split across many packets arrives.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func TestClientReadMetaShortReads(t *testing.T) {
+	want := Metadata{EndpointType: EndpointStream, UserID: MaxInt, Timeout: 1972348976 * time.Millisecond, BodySize: 5, ContentType: "text/plain", Endpoint: "foo", Accept: "*/*"}
+	serverConn, clientConn := net.Pipe()
+	server := NewClientConn(oneByteConn{serverConn})
+	client := NewClientConn(clientConn)
+
+	defer server.Close()
+	defer client.Close()
+
+	go client.Write(append(want.Encode(), "hello"...))
+
+	meta, err := server.ReadMeta()
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	if single, _ := DecodeMetadata(want.Encode()); meta != single {
+		t.Errorf("metadata = %#v, want %#v", meta, single)
+	}
+	if body, err := server.ReadBody(meta); err != nil || string(body) != "hello" {
+		t.Errorf("body = %q, %v, want %q", body, err, "hello")
+	}
+}
+
+// closeCountConn is a net.Conn that counts how many times it is closed, and
+// fails every close after the first one.
+type closeCountConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closes int
+}
+
+func (c *closeCountConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closes++; c.closes > 1 {
+		return errors.New("already closed")
+	}
+	return c.Conn.Close()
+}
+
+func TestClientCloseTwice(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	conn := &closeCountConn{Conn: clientConn}
+	client := NewClientConn(conn)
+
+	defer serverConn.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+
+	for i := range errs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = client.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range append(errs, client.Close()) {
+		if err != nil {
+			t.Errorf("Close %d returned %v, want nil", i, err)
+		}
+	}
+	if conn.closes != 1 {
+		t.Errorf("connection closed %d times, want 1", conn.closes)
+	}
+	if _, err := client.Write([]byte("hello")); err != errConnectionClosed {
+		t.Errorf("Write after Close returned %v, want %v", err, errConnectionClosed)
+	}
+}
+
+// headerConn is a net.Conn whose reads endlessly return the same header.
+type headerConn struct {
+	net.Conn
+	header []byte
+	off    int
+}
+
+func (c *headerConn) Read(b []byte) (int, error) {
+	n := copy(b, c.header[c.off:])
+	c.off = (c.off + n) % len(c.header)
+	return n, nil
+}
+
+func BenchmarkClientReadMeta(b *testing.B) {
+	client := NewClientConn(&headerConn{header: Metadata{Endpoint: "echo"}.Encode()})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		client.ReadMeta()
+	}
+}
+
+func BenchmarkClientReadMetaInto(b *testing.B) {
+	client := NewClientConn(&headerConn{header: Metadata{Endpoint: "echo"}.Encode()})
+	buf := make([]byte, HeaderSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		client.ReadMetaInto(buf)
+	}
+}
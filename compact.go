@@ -0,0 +1,257 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// compactFlag is set in the first byte of compact headers, which also holds the
+// protocol version, like the first byte of fixed headers does. Fixed headers are
+// told apart by it not being set.
+const compactFlag = 0x80
+
+// ErrInvalidCompactHeader is returned when decoding a compact header that does
+// not follow the format, such as one with an over-long string field.
+var ErrInvalidCompactHeader = errors.New("invalid compact header")
+
+// EncodeCompact is like Encode, but it writes the compact form of the header,
+// which clients and servers switch to once they agree on it in the handshake
+// (see Client.CompactHeaders). The numeric fields are written as varints and
+// the string fields are prefixed with their length instead of padded, so that
+// a typical header takes a few dozen bytes rather than HeaderSize; a header
+// with every field at its maximum is slightly larger than HeaderSize, though.
+// String fields that are too long are truncated, like Encode does.
+//
+// The first byte holds the protocol version with its high bit set, which marks
+// the header as compact. It is followed by the endpoint type byte, the user ID,
+// the timeout in milliseconds, the body size and the endpoint version as
+// varints (the user ID and the body size signed, in zig-zag encoding), the
+// priority byte, the content type, the endpoint ID as a varint, the endpoint
+// name if the ID is zero, the accept list and the CRC-32 (IEEE) of everything
+// before it, as a little-endian uint32. Strings are a varint length followed by
+// the bytes.
+func (m Metadata) EncodeCompact() []byte {
+	b := make([]byte, 0, 64)
+	b = append(b, protocolVersion|compactFlag, m.EndpointType)
+	b = binary.AppendVarint(b, m.UserID)
+	b = binary.AppendUvarint(b, uint64(m.Timeout/time.Millisecond))
+	b = binary.AppendVarint(b, m.BodySize)
+	b = binary.AppendUvarint(b, uint64(m.EndpointVersion))
+	b = append(b, m.Priority)
+	b = appendCompactString(b, m.ContentType, HeaderContentTypeSize)
+	b = binary.AppendUvarint(b, uint64(m.EndpointID))
+
+	if m.EndpointID == 0 {
+		b = appendCompactString(b, m.Endpoint, HeaderEndpointSize)
+	}
+	b = appendCompactString(b, m.Accept, HeaderAcceptSize)
+
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// appendCompactString appends s to b with its length, truncated to max bytes.
+func appendCompactString(b []byte, s string, max int) []byte {
+	if len(s) > max {
+		s = s[:max]
+	}
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// DecodeMetadataCompact is used to fetch metadata from a header in either form,
+// telling them apart by the flag in the first byte. It also returns the size of
+// the header, so that whatever follows it in b can be found.
+func DecodeMetadataCompact(b []byte) (Metadata, int, error) {
+	if len(b) == 0 {
+		return Metadata{}, 0, io.EOF
+	}
+	if b[0]&compactFlag == 0 {
+		m, err := DecodeMetadata(b)
+		return m, HeaderSize, err
+	}
+	r := bytes.NewReader(b[1:])
+	m, err := decodeCompact(b[0], r, make([]byte, HeaderEndpointSize))
+
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF // Like DecodeMetadata, for a header cut short.
+	}
+	return m, len(b) - r.Len(), err
+}
+
+// decodeCompact is used to read the rest of a compact header from r, once its
+// first byte, which holds the protocol version, has been read. buf is used to
+// hold the string fields while they are read, and must be large enough for the
+// largest of them.
+func decodeCompact(first byte, r io.Reader, buf []byte) (m Metadata, err error) {
+	if err = checkVersion(first &^ compactFlag); err != nil {
+		return Metadata{}, err
+	}
+	hr := &headerReader{r: r, sum: crc32.NewIEEE()}
+	hr.sum.Write([]byte{first})
+
+	var timeout, version, id uint64
+
+	if m.EndpointType, err = hr.ReadByte(); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+
+	if m.UserID, err = binary.ReadVarint(hr); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	if timeout, err = binary.ReadUvarint(hr); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	m.Timeout = time.Millisecond * time.Duration(timeout)
+
+	if m.BodySize, err = binary.ReadVarint(hr); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	if version, err = binary.ReadUvarint(hr); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	m.EndpointVersion = uint32(version)
+
+	if m.Priority, err = hr.ReadByte(); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	if m.ContentType, err = hr.readString(buf, HeaderContentTypeSize); err != nil {
+		return Metadata{}, err
+	}
+	if id, err = binary.ReadUvarint(hr); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	if id > 1<<32-1 {
+		return Metadata{}, errors.Wrapf(ErrInvalidCompactHeader, "endpoint ID %d", id)
+	}
+	m.EndpointID = uint32(id)
+
+	if id == 0 {
+		if m.Endpoint, err = hr.readString(buf, HeaderEndpointSize); err != nil {
+			return Metadata{}, err
+		}
+	}
+	if m.Accept, err = hr.readString(buf, HeaderAcceptSize); err != nil {
+		return Metadata{}, err
+	}
+	sum := hr.sum.Sum32()
+
+	if _, err = io.ReadFull(r, buf[:4]); err != nil {
+		return Metadata{}, unexpectedEOF(err)
+	}
+	if err = checkSum(sum, buf[:4]); err != nil {
+		return Metadata{}, err
+	}
+	return m, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for headers that end
+// partway through.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// headerReader reads the fields of a compact header one by one, summing them up
+// for the checksum.
+type headerReader struct {
+	r   io.Reader
+	sum hash.Hash32
+	b   [1]byte
+}
+
+func (hr *headerReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(hr.r, hr.b[:]); err != nil {
+		return 0, err
+	}
+	hr.sum.Write(hr.b[:])
+	return hr.b[0], nil
+}
+
+// readString reads a string field of at most max bytes into buf.
+func (hr *headerReader) readString(buf []byte, max int) (string, error) {
+	n, err := binary.ReadUvarint(hr)
+
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if n > uint64(max) {
+		return "", errors.Wrapf(ErrInvalidCompactHeader, "%d byte string, limit is %d", n, max)
+	}
+	if _, err = io.ReadFull(hr.r, buf[:n]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	hr.sum.Write(buf[:n])
+	return string(buf[:n]), nil
+}
+
+// readCompactMeta is used to read a header on a connection that switched to
+// compact headers. Fixed headers are still understood, since the flag tells
+// them apart. Like ReadMetaInto, it returns the errors of the connection as
+// they are.
+func (c *Client) readCompactMeta(header []byte) (meta Metadata, err error) {
+	if _, err = io.ReadFull(c, header[:1]); err != nil {
+		return meta, err
+	}
+	if header[0]&compactFlag == 0 {
+		if _, err = io.ReadFull(c, header[1:]); err != nil {
+			return meta, unexpectedEOF(err)
+		}
+		meta, err = DecodeMetadata(header)
+	} else {
+		r := &errorReader{r: c}
+		meta, err = decodeCompact(header[0], r, header[1:])
+		c.headerSize = 1 + r.n
+	}
+	var re *readError
+
+	switch {
+	case err == nil:
+		return meta, nil
+	case errors.As(err, &re):
+		// The first byte was read, so the header was cut short.
+		return meta, unexpectedEOF(re.err)
+	default:
+		return meta, errors.Wrap(err, "could not decode metadata")
+	}
+}
+
+// errorReader marks the errors of the reader it wraps, so that they can be
+// told apart from decoding errors. It also counts the bytes read.
+type errorReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *errorReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+
+	if err != nil {
+		err = &readError{err}
+	}
+	return n, err
+}
+
+// readError is an error of the connection, returned by errorReader.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string { return e.err.Error() }
+
+// encodeMeta is used to encode a header in the form agreed on for the
+// connection.
+func (c *Client) encodeMeta(meta Metadata) []byte {
+	if c.compact {
+		return meta.EncodeCompact()
+	}
+	return meta.Encode()
+}
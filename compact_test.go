@@ -0,0 +1,198 @@
+package srv
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMetadataEncodeCompact(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata Metadata
+	}{
+		{"empty", Metadata{}},
+		{"small values", Metadata{UserID: 7, Timeout: 250 * time.Millisecond, BodySize: 42, Endpoint: "echo", ContentType: "text/plain"}},
+		{"negative values", Metadata{UserID: math.MinInt64, BodySize: -1, Endpoint: "echo"}},
+		{
+			"maximum values",
+			Metadata{
+				EndpointType:    EndpointOneWay,
+				UserID:          math.MaxInt64,
+				Timeout:         math.MaxInt64 / time.Millisecond * time.Millisecond,
+				BodySize:        math.MaxInt64,
+				EndpointVersion: math.MaxUint32,
+				Priority:        math.MaxUint8,
+				ContentType:     bigString(HeaderContentTypeSize),
+				Endpoint:        bigString(HeaderEndpointSize),
+				Accept:          bigString(HeaderAcceptSize),
+			},
+		},
+		{"endpoint ID", Metadata{EndpointID: math.MaxUint32, BodySize: 5}},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := tt.metadata.EncodeCompact()
+			// Anything following the header is left alone.
+			got, n, err := DecodeMetadataCompact(append(header, "body"...))
+
+			if err != nil {
+				t.Fatalf("Should not return an error, got %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.metadata) {
+				t.Errorf("metadata = %#v, want %#v", got, tt.metadata)
+			}
+			if n != len(header) {
+				t.Errorf("size = %d, want %d", n, len(header))
+			}
+		})
+	}
+}
+
+func TestDecodeMetadataCompact(t *testing.T) {
+	meta := Metadata{UserID: 7, BodySize: 42, Endpoint: "echo", Priority: 3}
+	compact := meta.EncodeCompact()
+
+	if len(compact) >= HeaderSize/4 {
+		t.Errorf("compact header is %d bytes, want it much smaller than %d", len(compact), HeaderSize)
+	}
+	corrupted := append([]byte(nil), compact...)
+	corrupted[1] ^= 1
+	unsupported := append([]byte(nil), compact...)
+	unsupported[0] = (protocolVersion + 1) | compactFlag
+	binary.LittleEndian.PutUint32(unsupported[len(unsupported)-4:], crc32.ChecksumIEEE(unsupported[:len(unsupported)-4]))
+	tooLong := Metadata{Endpoint: "echo"}.EncodeCompact()
+	tooLong[7] = HeaderContentTypeSize + 1 // The length of the content type.
+
+	tests := []struct {
+		name     string
+		header   []byte
+		want     Metadata
+		wantSize int
+		wantErr  error
+	}{
+		{"compact", compact, meta, len(compact), nil},
+		{"fixed", meta.Encode(), meta, HeaderSize, nil},
+		{"empty", nil, Metadata{}, 0, io.EOF},
+		{"truncated", compact[:len(compact)-1], Metadata{}, len(compact) - 1, io.EOF},
+		{"corrupted", corrupted, Metadata{}, len(compact), ErrHeaderChecksum},
+		{"unsupported version", unsupported, Metadata{}, len(compact), ErrUnsupportedVersion},
+		{"string too long", tooLong, Metadata{}, 8, ErrInvalidCompactHeader},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, n, err := DecodeMetadataCompact(tt.header)
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadata = %#v, want %#v", got, tt.want)
+			}
+			if tt.wantErr == nil && n != tt.wantSize {
+				t.Errorf("size = %d, want %d", n, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestClientCompactHeaders(t *testing.T) {
+	s := newEchoServer()
+	canceled := make(chan error, 1)
+	s.AddRequestEndpoint("block", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return ctx.Err()
+	})
+	client := s.NewInMemoryClient()
+	client.CompactHeaders = true
+
+	defer client.Close()
+
+	hello, err := client.Handshake()
+
+	if err != nil || !hello.CompactHeaders {
+		t.Fatalf("hello = %+v, %v, want compact headers", hello, err)
+	}
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+	if err != nil || string(resp.Body) != "hello" {
+		t.Fatalf("body = %q, %v, want %q", resp.Body, err, "hello")
+	}
+	var e *Error
+
+	if _, err = client.Send(Request{Meta: Metadata{Endpoint: "missing"}}); !errors.As(err, &e) || e.Code != CodeNotFound {
+		t.Errorf("error = %v, want code %d", err, CodeNotFound)
+	}
+
+	// Fixed headers are still understood.
+	if _, err = client.Write(append(Metadata{Endpoint: "echo", BodySize: 5}.Encode(), "fixed"...)); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if resp, err = client.ReadResponse(); err != nil || string(resp.Body) != "fixed" {
+		t.Errorf("body = %q, %v, want %q", resp.Body, err, "fixed")
+	}
+
+	// Cancel frames are recognized in their compact form as well.
+	if _, err = client.WriteDataString("block", ""); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, err = client.Cancel("block"); err != nil {
+		t.Fatalf("Could not cancel request: %v", err)
+	}
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Errorf("context error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request was not cancelled")
+	}
+	if _, err = client.ReadResponse(); !errors.As(err, &e) || e.Code != CodeCanceled {
+		t.Errorf("error = %v, want code %d", err, CodeCanceled)
+	}
+	if resp, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("again")}); err != nil || string(resp.Body) != "again" {
+		t.Errorf("body = %q, %v, want %q", resp.Body, err, "again")
+	}
+}
+
+// BenchmarkHeaderSize compares the size of a typical header in both forms.
+func BenchmarkHeaderSize(b *testing.B) {
+	meta := Metadata{UserID: 118792346, Timeout: 5 * time.Second, BodySize: 512, ContentType: "application/json", Endpoint: "users.get"}
+
+	for _, form := range []struct {
+		name   string
+		encode func(Metadata) []byte
+	}{
+		{"fixed", Metadata.Encode},
+		{"compact", Metadata.EncodeCompact},
+	} {
+		form := form
+
+		b.Run(form.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			size := 0
+
+			for n := 0; n < b.N; n++ {
+				size = len(form.encode(meta))
+			}
+			b.ReportMetric(float64(size), "bytes/header")
+		})
+	}
+}
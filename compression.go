@@ -0,0 +1,221 @@
+package srv
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CompressionEndpoint is the name of the built-in request endpoint used to
+// switch a connection over to compression. The body of the request names the
+// method; the server echoes it back if it agrees, and from the following frame
+// on, everything sent in either direction (headers and bodies) is compressed.
+const CompressionEndpoint = "__compress"
+
+// Compression methods that can be negotiated for a connection. CompressionZstd
+// is only available in builds using the zstd build tag, since it depends on a
+// third-party package, github.com/klauspost/compress.
+const (
+	CompressionFlate = "flate"
+	CompressionZstd  = "zstd"
+)
+
+// ErrCompressionUnsupported is returned when the server does not support the
+// requested compression method.
+var ErrCompressionUnsupported = errors.New("compression method not supported")
+
+// FlushWriter is a writer that buffers data until it is flushed, like the
+// writers of the compress packages.
+type FlushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// Compressor describes a compression method that can be negotiated for a
+// connection. NewWriter must return a writer that sends everything written so
+// far when it is flushed, since frames are flushed one by one; NewReader must
+// not read ahead of what it needs to return, as far as possible, since the
+// other end waits for responses.
+type Compressor struct {
+	NewWriter func(w io.Writer) (FlushWriter, error)
+	NewReader func(r io.Reader) (io.Reader, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+	compression   []string // Registered method names, in order of preference.
+)
+
+func init() {
+	RegisterCompression(CompressionFlate, Compressor{
+		NewWriter: func(w io.Writer) (FlushWriter, error) {
+			return flate.NewWriter(w, flate.BestSpeed)
+		},
+		NewReader: func(r io.Reader) (io.Reader, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+}
+
+// RegisterCompression is used to make a compression method available to clients
+// and servers, under the given name. Methods registered first are preferred.
+// Registering a name again replaces the method, but keeps its place.
+func RegisterCompression(name string, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	if _, ok := compressors[name]; !ok {
+		compression = append(compression, name)
+	}
+	compressors[name] = c
+}
+
+// supportedCompression lists the registered compression methods, in order of
+// preference.
+func supportedCompression() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	return append([]string(nil), compression...)
+}
+
+func compressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[name]
+	return c, ok
+}
+
+// EnableCompression is used to compress the rest of the connection with the
+// given method. This benefits connections exchanging many small frames, where
+// compressing each body on its own would not be worth it. It should be called
+// before any other frames are in flight, usually right after connecting.
+func (c *Client) EnableCompression(method string) error {
+	if _, ok := compressor(method); !ok {
+		return errors.Wrapf(ErrCompressionUnsupported, "%q is not available locally", method)
+	}
+	if _, err := c.WriteDataString(CompressionEndpoint, method); err != nil {
+		return err
+	}
+	_, accepted, err := c.ReadDataString()
+
+	if err != nil {
+		return err
+	}
+	if accepted != method {
+		return errors.Wrapf(ErrCompressionUnsupported, "%q", method)
+	}
+	return c.compress(method)
+}
+
+// NegotiateCompression is used to enable the first of the preferred compression
+// methods that both this client and the server support, according to the
+// server's capabilities. With no preferences, the order of the server's
+// capabilities is used. It returns the method chosen, or
+// ErrCompressionUnsupported if there is none, leaving the connection
+// uncompressed.
+func (c *Client) NegotiateCompression(preferred ...string) (string, error) {
+	caps, err := c.Capabilities()
+
+	if err != nil {
+		return "", err
+	}
+	if len(preferred) == 0 {
+		preferred = caps.Compression
+	}
+	for _, method := range preferred {
+		if _, ok := compressor(method); !ok {
+			continue
+		}
+		for _, offered := range caps.Compression {
+			if offered == method {
+				return method, c.EnableCompression(method)
+			}
+		}
+	}
+	return "", errors.Wrapf(ErrCompressionUnsupported, "no method in common with %v", caps.Compression)
+}
+
+// compress wraps the connection in the given compression method. The caller is
+// responsible for making sure both peers switch at the same frame boundary.
+func (c *Client) compress(method string) error {
+	comp, ok := compressor(method)
+
+	if !ok {
+		return errors.Wrapf(ErrCompressionUnsupported, "%q", method)
+	}
+	// The compressed streams are counted for RequestStats.
+	wireW := &countingWriter{w: c.connWriter()}
+	wireR := &countingReader{r: c.conn}
+	w, err := comp.NewWriter(wireW)
+
+	if err != nil {
+		return err
+	}
+	r, err := comp.NewReader(wireR)
+
+	if err != nil {
+		return err
+	}
+	c.r = r
+	c.w = w
+	c.wireR = wireR
+	c.wireW = wireW
+	c.compression = method
+	return nil
+}
+
+// compressionMethods lists the compression methods the server offers.
+func (s *Server) compressionMethods() []string {
+	if s.CompressionMethods == nil {
+		return supportedCompression()
+	}
+	var methods []string
+
+	for _, method := range s.CompressionMethods {
+		if _, ok := compressor(method); ok {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// maxCompressionRequestSize is the largest CompressionEndpoint request body the
+// server accepts, which only holds the name of a method.
+const maxCompressionRequestSize = 64
+
+// handleCompression answers a request for the CompressionEndpoint, switching
+// the connection to compression once the reply has been sent.
+func (s *Server) handleCompression(meta Metadata, client *Client) error {
+	if meta.BodySize > maxCompressionRequestSize {
+		return s.reject(meta, client, CodePayloadTooLarge, ErrBodyTooLarge)
+	}
+	body, err := client.ReadBody(meta)
+
+	if err != nil {
+		return s.logReadError(client, "body", err)
+	}
+	method := string(body)
+	supported := false
+
+	for _, m := range s.compressionMethods() {
+		if m == method {
+			supported = true
+		}
+	}
+	if !supported {
+		if _, err = client.WriteData(CompressionEndpoint, nil); err != nil {
+			return s.logWriteError(client, "response", err)
+		}
+		return nil
+	}
+	if _, err = client.WriteData(CompressionEndpoint, body); err != nil {
+		return s.logWriteError(client, "response", err)
+	}
+	s.maybeLogf("Enabled %s compression for %v", method, client.RemoteAddr())
+	return client.compress(method)
+}
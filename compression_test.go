@@ -0,0 +1,180 @@
+package srv
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClientEnableCompression(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if err := client.EnableCompression(CompressionFlate); err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	bodies := []string{
+		"hello",
+		"",
+		strings.Repeat("compressible ", 10000), // Decompressed over several reads.
+		"world",
+	}
+	for _, body := range bodies {
+		if _, err := client.WriteDataString("echo", body); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		meta, got, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		if meta.Endpoint != "echo" {
+			t.Errorf("endpoint = %v, want %v", meta.Endpoint, "echo")
+		}
+		if got != body {
+			t.Errorf("body of %d bytes did not round-trip, got %d bytes", len(body), len(got))
+		}
+	}
+}
+
+func TestClientEnableCompressionUnsupported(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if err := client.EnableCompression("lzw"); errors.Cause(err) != ErrCompressionUnsupported {
+		t.Fatalf("error = %v, want %v", err, ErrCompressionUnsupported)
+	}
+
+	// The connection should still work uncompressed.
+	if _, err := client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, got, err := client.ReadDataString(); err != nil || got != "hello" {
+		t.Errorf("body = %q, error = %v, want %q", got, err, "hello")
+	}
+}
+
+func TestServerCompressionRequestTooLarge(t *testing.T) {
+	tests := []struct {
+		name      string
+		bodySize  int64
+		body      []byte
+		wantReuse bool
+	}{
+		{"drained", maxCompressionRequestSize + 1, bytes.Repeat([]byte("a"), maxCompressionRequestSize+1), true},
+		// Only the header is sent; reading the body would need a terabyte.
+		{"huge", 1 << 40, nil, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reasons := make(chan error, 1)
+			s := newEchoServer()
+			s.OnConnClose = func(conn net.Conn, reason error) { reasons <- reason }
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			meta := Metadata{Endpoint: CompressionEndpoint, BodySize: tt.bodySize}
+
+			if _, err := client.Write(append(meta.Encode(), tt.body...)); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			_, err := client.ReadResponse()
+
+			if !tt.wantReuse {
+				if reason := <-reasons; reason != ErrBodyTooLarge {
+					t.Errorf("reason = %v, want %v", reason, ErrBodyTooLarge)
+				}
+				return
+			}
+			if code, _ := ErrorCodeOf(err); code != CodePayloadTooLarge {
+				t.Fatalf("error = %v, want code %d", err, CodePayloadTooLarge)
+			}
+			if resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil || string(resp.Body) != "hello" {
+				t.Errorf("body = %q, %v, want %q", resp.Body, err, "hello")
+			}
+		})
+	}
+}
+
+func TestClientNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		name      string
+		methods   []string
+		preferred []string
+		want      string
+		wantErr   error
+	}{
+		{"server preference", nil, nil, CompressionFlate, nil},
+		{"client preference", nil, []string{"lzw", CompressionFlate}, CompressionFlate, nil},
+		{"nothing in common", []string{}, []string{CompressionFlate}, "", ErrCompressionUnsupported},
+		{"unknown to the client", nil, []string{"lzw"}, "", ErrCompressionUnsupported},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.CompressionMethods = tt.methods
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			got, err := client.NegotiateCompression(tt.preferred...)
+
+			if got != tt.want || errors.Cause(err) != tt.wantErr {
+				t.Fatalf("method = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if client.ConnState().Compression != tt.want {
+				t.Errorf("compression = %q, want %q", client.ConnState().Compression, tt.want)
+			}
+			if _, err = client.WriteDataString("echo", "hello"); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+				t.Errorf("body = %q, %v, want %q", body, err, "hello")
+			}
+		})
+	}
+}
+
+func benchmarkSmallFrames(b *testing.B, method string) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+	body := bytes.Repeat([]byte("a"), 32)
+
+	defer client.Close()
+
+	if method != "" {
+		if err := client.EnableCompression(method); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		client.WriteData("echo", body)
+		client.ReadData()
+	}
+}
+
+func BenchmarkSmallFramesUncompressed(b *testing.B) {
+	benchmarkSmallFrames(b, "")
+}
+
+func BenchmarkSmallFramesFlate(b *testing.B) {
+	benchmarkSmallFrames(b, CompressionFlate)
+}
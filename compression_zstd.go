@@ -0,0 +1,23 @@
+//go:build zstd
+
+package srv
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The zstd compression method is kept behind a build tag, so that builds that
+// do not need it do not depend on a third-party package.
+func init() {
+	RegisterCompression(CompressionZstd, Compressor{
+		NewWriter: func(w io.Writer) (FlushWriter, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		},
+		NewReader: func(r io.Reader) (io.Reader, error) {
+			// A single goroutine decodes synchronously, without reading ahead.
+			return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		},
+	})
+}
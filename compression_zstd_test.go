@@ -0,0 +1,62 @@
+//go:build zstd
+
+package srv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientEnableCompressionZstd(t *testing.T) {
+	client := newEchoServer().NewInMemoryClient()
+
+	defer client.Close()
+
+	if err := client.EnableCompression(CompressionZstd); err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	for _, body := range []string{"hello", "", strings.Repeat("compressible ", 10000)} {
+		if _, err := client.WriteDataString("echo", body); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		if _, got, err := client.ReadDataString(); err != nil || got != body {
+			t.Errorf("body of %d bytes did not round-trip: %d bytes, error %v", len(body), len(got), err)
+		}
+	}
+}
+
+func TestClientNegotiateCompressionZstd(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		want    string
+	}{
+		{"zstd-capable server", nil, CompressionZstd},
+		{"server without zstd", []string{CompressionFlate}, CompressionFlate},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.CompressionMethods = tt.methods
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			got, err := client.NegotiateCompression(CompressionZstd, CompressionFlate)
+
+			if err != nil || got != tt.want {
+				t.Fatalf("method = %q, %v, want %q", got, err, tt.want)
+			}
+			if _, err = client.WriteDataString("echo", "hello"); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+				t.Errorf("body = %q, %v, want %q", body, err, "hello")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package srv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// conformanceMetadata is the representation of Metadata in the conformance
+// vectors.
+type conformanceMetadata struct {
+	EndpointType    byte   `json:"endpoint_type"`
+	UserID          int64  `json:"user_id"`
+	TimeoutMS       int64  `json:"timeout_ms"`
+	BodySize        int64  `json:"body_size"`
+	ContentType     string `json:"content_type"`
+	Endpoint        string `json:"endpoint"`
+	Accept          string `json:"accept"`
+	EndpointID      uint32 `json:"endpoint_id,omitempty"`
+	EndpointVersion uint32 `json:"endpoint_version,omitempty"`
+	Priority        byte   `json:"priority,omitempty"`
+}
+
+func (m conformanceMetadata) metadata() Metadata {
+	return Metadata{
+		EndpointType:    m.EndpointType,
+		UserID:          m.UserID,
+		Timeout:         time.Duration(m.TimeoutMS) * time.Millisecond,
+		BodySize:        m.BodySize,
+		ContentType:     m.ContentType,
+		Endpoint:        m.Endpoint,
+		Accept:          m.Accept,
+		EndpointID:      m.EndpointID,
+		EndpointVersion: m.EndpointVersion,
+		Priority:        m.Priority,
+	}
+}
+
+type conformanceVector struct {
+	Name     string              `json:"name"`
+	Header   string              `json:"header"`
+	Metadata conformanceMetadata `json:"metadata"`
+}
+
+// TestConformance runs this implementation through the wire format vectors in
+// testdata/conformance.json, which other implementations can use as well.
+func TestConformance(t *testing.T) {
+	data, err := os.ReadFile("testdata/conformance.json")
+
+	if err != nil {
+		t.Fatalf("Could not read vectors: %v", err)
+	}
+	var vectors struct {
+		HeaderSize int                 `json:"header_size"`
+		Decode     []conformanceVector `json:"decode"`
+		Encode     []conformanceVector `json:"encode"`
+		Truncated  []conformanceVector `json:"truncated"`
+		Versions   []conformanceVector `json:"unsupported_version"`
+		Corrupted  []conformanceVector `json:"corrupted"`
+	}
+	if err = json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Could not decode vectors: %v", err)
+	}
+	if vectors.HeaderSize != HeaderSize {
+		t.Fatalf("header size = %d, want %d", HeaderSize, vectors.HeaderSize)
+	}
+	decodeHex := func(t *testing.T, s string) []byte {
+		b, err := hex.DecodeString(s)
+
+		if err != nil {
+			t.Fatalf("Invalid header in vector: %v", err)
+		}
+		return b
+	}
+
+	for _, v := range vectors.Decode {
+		v := v
+
+		t.Run("decode/"+v.Name, func(t *testing.T) {
+			header := decodeHex(t, v.Header)
+			got, err := DecodeMetadata(header)
+
+			if err != nil {
+				t.Fatalf("Should not return an error, got %v", err)
+			}
+			if want := v.Metadata.metadata(); !reflect.DeepEqual(got, want) {
+				t.Errorf("metadata = %#v, want %#v", got, want)
+			}
+			if !reflect.DeepEqual(got.Encode(), header) {
+				t.Error("Re-encoding the metadata does not give back the header")
+			}
+		})
+	}
+	for _, v := range vectors.Encode {
+		v := v
+
+		t.Run("encode/"+v.Name, func(t *testing.T) {
+			if got, want := v.Metadata.metadata().Encode(), decodeHex(t, v.Header); !reflect.DeepEqual(got, want) {
+				t.Errorf("header = %x, want %x", got, want)
+			}
+		})
+	}
+	for _, v := range vectors.Truncated {
+		v := v
+
+		t.Run("truncated/"+v.Name, func(t *testing.T) {
+			if _, err := DecodeMetadata(decodeHex(t, v.Header)); err == nil {
+				t.Error("Decoded a truncated header")
+			}
+		})
+	}
+	for _, v := range vectors.Versions {
+		v := v
+
+		t.Run("unsupported_version/"+v.Name, func(t *testing.T) {
+			if _, err := DecodeMetadata(decodeHex(t, v.Header)); errors.Cause(err) != ErrUnsupportedVersion {
+				t.Errorf("error = %v, want %v", err, ErrUnsupportedVersion)
+			}
+		})
+	}
+	for _, v := range vectors.Corrupted {
+		v := v
+
+		t.Run("corrupted/"+v.Name, func(t *testing.T) {
+			if _, err := DecodeMetadata(decodeHex(t, v.Header)); err != ErrHeaderChecksum {
+				t.Errorf("error = %v, want %v", err, ErrHeaderChecksum)
+			}
+		})
+	}
+}
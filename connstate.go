@@ -0,0 +1,37 @@
+package srv
+
+import "crypto/tls"
+
+// ConnState describes what has been negotiated on a client's connection. It is
+// mostly useful for diagnostics, or to adapt behavior to what the server
+// supports.
+type ConnState struct {
+	// TLS holds the state of the TLS session, including the peer certificates.
+	// It is nil if the connection is not encrypted.
+	TLS *tls.ConnectionState
+
+	// Compression is the compression method enabled with EnableCompression, or
+	// an empty string if the connection is not compressed.
+	Compression string
+
+	// Capabilities holds the capabilities the server advertised the last time
+	// they were fetched with Capabilities or VerifyLayout. It is nil if they
+	// were never fetched.
+	Capabilities *Capabilities
+}
+
+// ConnState is used to report what has been negotiated on the connection. It
+// does not communicate with the server.
+func (c *Client) ConnState() ConnState {
+	state := ConnState{Compression: c.compression}
+
+	if conn, ok := c.conn.(*tls.Conn); ok {
+		tlsState := conn.ConnectionState()
+		state.TLS = &tlsState
+	}
+	if c.caps != nil {
+		caps := *c.caps
+		state.Capabilities = &caps
+	}
+	return state
+}
@@ -0,0 +1,114 @@
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// selfSignedCert generates a certificate for 127.0.0.1 and localhost, returning
+// it along with a pool that trusts it.
+func selfSignedCert(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "srv test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestClientConnState(t *testing.T) {
+	s := NewInMemoryServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if got := client.ConnState(); !reflect.DeepEqual(got, ConnState{}) {
+		t.Errorf("state before negotiation = %#v, want zero value", got)
+	}
+	if _, err := client.Capabilities(); err != nil {
+		t.Fatalf("Could not fetch capabilities: %v", err)
+	}
+	if err := client.EnableCompression(CompressionFlate); err != nil {
+		t.Fatalf("Could not enable compression: %v", err)
+	}
+	state := client.ConnState()
+
+	if state.TLS != nil {
+		t.Errorf("TLS = %#v, want nil", state.TLS)
+	}
+	if state.Compression != CompressionFlate {
+		t.Errorf("compression = %q, want %q", state.Compression, CompressionFlate)
+	}
+	want := LocalCapabilities()
+	want.Endpoints = map[string]uint32{CapabilitiesEndpoint: 1}
+
+	if state.Capabilities == nil || !reflect.DeepEqual(*state.Capabilities, want) {
+		t.Errorf("capabilities = %#v, want %#v", state.Capabilities, want)
+	}
+}
+
+func TestClientConnStateTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newEchoServer()
+	serverConn, clientConn := net.Pipe()
+
+	go s.ServeConn(tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	client := NewClientConn(tls.Client(clientConn, &tls.Config{RootCAs: pool, ServerName: "localhost"}))
+
+	defer client.Close()
+
+	if _, err := client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, _, err := client.ReadDataString(); err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	state := client.ConnState()
+
+	if state.TLS == nil {
+		t.Fatal("TLS = nil, want the session state")
+	}
+	if !state.TLS.HandshakeComplete {
+		t.Error("Expected the handshake to be complete")
+	}
+	if len(state.TLS.PeerCertificates) != 1 || !state.TLS.PeerCertificates[0].Equal(cert.Leaf) {
+		t.Errorf("peer certificates = %v, want the server certificate", state.TLS.PeerCertificates)
+	}
+}
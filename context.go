@@ -0,0 +1,89 @@
+package srv
+
+import (
+	"context"
+	"time"
+)
+
+// WriteDataContext is like WriteData, but the write is bounded by ctx: it fails
+// with the context's error once ctx is done. If the write was interrupted, part
+// of the frame may have been sent already, so the connection is in an
+// undefined state and should be closed.
+func (c *Client) WriteDataContext(ctx context.Context, endpoint string, body []byte) (n int, err error) {
+	err = c.withContext(ctx, func() error {
+		n, err = c.WriteData(endpoint, body)
+		return err
+	})
+	return n, err
+}
+
+// ReadDataContext is like ReadData, but the read is bounded by ctx: it fails
+// with the context's error once ctx is done. If the read was interrupted, the
+// rest of the frame is still on its way, so the connection is in an undefined
+// state and should be closed.
+func (c *Client) ReadDataContext(ctx context.Context) (meta Metadata, body []byte, err error) {
+	err = c.withContext(ctx, func() error {
+		meta, body, err = c.ReadData()
+		return err
+	})
+	return meta, body, err
+}
+
+// withContext is used to bound the IO done by fn with ctx. While fn runs, the
+// deadlines of the connection are the earlier of the context's and the ones set
+// with SetDeadline and friends, which are restored afterwards, and cancelling
+// ctx interrupts any pending read or write. If fn fails once ctx is done, the
+// context's error is returned instead.
+func (c *Client) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rDeadline, wDeadline := c.rDeadline, c.wDeadline
+
+	defer func() {
+		c.conn.SetReadDeadline(rDeadline)
+		c.conn.SetWriteDeadline(wDeadline)
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.conn.SetReadDeadline(earliest(rDeadline, deadline)); err != nil {
+			return err
+		}
+		if err := c.conn.SetWriteDeadline(earliest(wDeadline, deadline)); err != nil {
+			return err
+		}
+	}
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Now()) // Unblocks any pending read or write.
+		close(fired)
+	})
+	defer func() {
+		if !stop() {
+			<-fired // Make sure the deadline is not set after it is restored.
+		}
+	}()
+
+	err := fn()
+
+	if err != nil {
+		// The connection shares the context's deadline, and may time out just
+		// before the context does.
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			<-ctx.Done()
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+	}
+	return err
+}
+
+// earliest returns the earlier of two deadlines, where the zero time means no
+// deadline.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
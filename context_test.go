@@ -0,0 +1,116 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientReadDataContext(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+		want  error
+	}{
+		{"in time", 0, nil},
+		{"delayed", time.Second, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := NewInMemoryServer()
+			s.AddRequestEndpoint("slow", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				time.Sleep(tt.delay)
+				_, err := w.Write([]byte("hello"))
+				return err
+			})
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			if _, err := client.WriteDataContext(ctx, "slow", nil); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			start := time.Now()
+			_, body, err := client.ReadDataContext(ctx)
+
+			if err != tt.want {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+			if err == nil && string(body) != "hello" {
+				t.Errorf("body = %q, want %q", body, "hello")
+			}
+			if elapsed := time.Since(start); elapsed > tt.delay/2+200*time.Millisecond {
+				t.Errorf("ReadDataContext took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestClientContextCancel(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(clientConn)
+
+	defer serverConn.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// Nobody reads from the other end, so the write blocks until cancelled.
+	if _, err := client.WriteDataContext(ctx, "echo", []byte("hello")); err != context.Canceled {
+		t.Errorf("WriteDataContext returned %v, want %v", err, context.Canceled)
+	}
+	if _, _, err := client.ReadDataContext(ctx); err != context.Canceled {
+		t.Errorf("ReadDataContext returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClientContextDeadlines(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(clientConn)
+
+	defer serverConn.Close()
+	defer client.Close()
+
+	// A deadline set on the client that is earlier than the context's applies.
+	if err := client.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := client.ReadDataContext(ctx)
+
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Errorf("ReadDataContext returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadDataContext took %v", elapsed)
+	}
+
+	// The client's deadlines are restored afterwards.
+	if err = client.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, _, err = client.ReadDataContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ReadDataContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	go serverConn.Write(append(Metadata{Endpoint: "echo", BodySize: 5}.Encode(), "hello"...))
+
+	if _, body, err := client.ReadData(); err != nil || string(body) != "hello" {
+		t.Errorf("ReadData = %q, %v, want %q", body, err, "hello")
+	}
+}
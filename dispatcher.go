@@ -0,0 +1,41 @@
+package srv
+
+// Dispatcher is used to choose the endpoint that serves a frame, based on its
+// metadata. The second return value reports whether an endpoint was found; if
+// not, the client is told that the endpoint does not exist. Frames without an
+// endpoint name or ID never reach the dispatcher.
+//
+// Request frames sent with an EndpointID carry the name registered for that ID
+// on the server, if any, in their Endpoint.
+type Dispatcher interface {
+	RequestHandler(meta Metadata) (RequestEndpoint, bool)
+	StreamingHandler(meta Metadata) (StreamingEndpoint, bool)
+}
+
+// registry is the default Dispatcher, which looks up the endpoints registered
+// on the server by name, alias or ID, and by version.
+type registry struct {
+	s *Server
+}
+
+func (r registry) RequestHandler(meta Metadata) (RequestEndpoint, bool) {
+	if endpoint, ok := r.s.versionedEndpoint(meta.Endpoint, meta.EndpointVersion); ok {
+		return endpoint, true
+	}
+	if meta.EndpointID != 0 {
+		return r.s.requestEndpointByID(meta.EndpointID)
+	}
+	return r.s.requestEndpoint(meta.Endpoint)
+}
+
+func (r registry) StreamingHandler(meta Metadata) (StreamingEndpoint, bool) {
+	return r.s.streamingEndpoint(meta.Endpoint)
+}
+
+// dispatcher returns the Dispatcher of the server, or the default one.
+func (s *Server) dispatcher() Dispatcher {
+	if s.Dispatcher != nil {
+		return s.Dispatcher
+	}
+	return registry{s}
+}
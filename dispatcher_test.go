@@ -0,0 +1,125 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// prefixDispatcher routes frames to the endpoint registered for the longest
+// prefix of their endpoint name.
+type prefixDispatcher struct {
+	requests map[string]RequestEndpoint
+	streams  map[string]StreamingEndpoint
+}
+
+func (d prefixDispatcher) RequestHandler(meta Metadata) (RequestEndpoint, bool) {
+	var (
+		best     string
+		endpoint RequestEndpoint
+	)
+	for prefix, e := range d.requests {
+		if strings.HasPrefix(meta.Endpoint, prefix) && len(prefix) >= len(best) {
+			best, endpoint = prefix, e
+		}
+	}
+	return endpoint, endpoint != nil
+}
+
+func (d prefixDispatcher) StreamingHandler(meta Metadata) (StreamingEndpoint, bool) {
+	for prefix, e := range d.streams {
+		if strings.HasPrefix(meta.Endpoint, prefix) {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+func TestServerDispatcher(t *testing.T) {
+	respond := func(body string) RequestEndpoint {
+		return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			_, err := io.WriteString(w, body+" "+meta.Endpoint)
+			return err
+		}
+	}
+	s := newEchoServer()
+	s.Dispatcher = prefixDispatcher{
+		requests: map[string]RequestEndpoint{
+			"users/":       respond("user"),
+			"users/admin/": respond("admin"),
+		},
+		streams: map[string]StreamingEndpoint{
+			"chat/": func(ctx context.Context, meta Metadata, client *Client) error {
+				_, err := client.WriteMessage([]byte("joined " + meta.Endpoint))
+				return err
+			},
+		},
+	}
+	s.Use(func(next RequestEndpoint) RequestEndpoint {
+		return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			io.WriteString(w, "> ")
+			return next(ctx, meta, w, r)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{"prefix", "users/42", "> user users/42", false},
+		{"longest prefix", "users/admin/7", "> admin users/admin/7", false},
+		{"not found", "orders/1", "", true},
+		{"registered endpoints are not consulted", "echo", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			resp, err := client.Send(Request{Meta: Metadata{Endpoint: tt.endpoint}})
+
+			if tt.wantErr {
+				if e, ok := errors.Cause(err).(*Error); !ok || e.Code != CodeNotFound {
+					t.Fatalf("error = %v, want code %d", err, CodeNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not send request: %v", err)
+			}
+			if string(resp.Body) != tt.want {
+				t.Errorf("body = %q, want %q", resp.Body, tt.want)
+			}
+		})
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		t.Parallel()
+
+		client := s.NewInMemoryClient()
+
+		defer client.Close()
+
+		meta, err := NewStreamMetadata("chat/general")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = client.WriteMeta(meta); err != nil {
+			t.Fatalf("Could not open stream: %v", err)
+		}
+		if body, err := client.ReadMessage(); err != nil || string(body) != "joined chat/general" {
+			t.Errorf("message = %q, %v, want %q", body, err, "joined chat/general")
+		}
+	})
+}
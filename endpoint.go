@@ -1,15 +1,118 @@
 package srv
 
 import (
+	"context"
 	"io"
+	"sync"
+	"time"
 )
 
 // RequestEndpoint is the type describing a traditional request / response
-// endpoint for the server.
-type RequestEndpoint func(meta Metadata, w io.Writer, r io.Reader) error
+// endpoint for the server. The reader holding the request body, and anything
+// read from it without copying, is only valid until the endpoint returns, since
+// small bodies are read into buffers that are reused for later requests.
+//
+// The context is cancelled once the client no longer wants the response (see
+// Client.Cancel), when the request's Timeout elapses, or when the server shuts
+// down, so that long operations can be aborted.
+type RequestEndpoint func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error
 
 // StreamingEndpoint is the type describing a streaming endpoint for the server.
 // These endpoints have access to the net.Conn object, and should be responsible
 // for the full lifetime of the connection, including closing it when they are
-// done. This allows maximum flexibility.
-type StreamingEndpoint func(meta Metadata, client *Client) error
+// done. This allows maximum flexibility. The context is cancelled when the
+// server shuts down.
+type StreamingEndpoint func(ctx context.Context, meta Metadata, client *Client) error
+
+// EventEndpoint is the type describing an event-driven streaming endpoint for
+// the server. Rather than owning the connection for its whole lifetime, it is
+// called every time the connection has something to read, such as a message or
+// the client hanging up, and should handle it and return instead of waiting for
+// more. Returning an error ends the connection, which is then closed; io.EOF
+// ends it cleanly, as does closing the client. The context is the same for
+// every call, and is cancelled when the server shuts down.
+//
+// Between calls, the connection is parked: on Linux, no goroutine is kept for
+// it, which lets a server hold very many mostly-idle streams. Parked connections
+// are closed when the server shuts down, without calling the endpoint again.
+// Where connections cannot be parked (on other platforms, and for TLS or
+// compressed connections), the endpoint is called in a loop on the
+// connection's goroutine instead, and its reads block until something arrives.
+type EventEndpoint func(ctx context.Context, meta Metadata, client *Client) error
+
+// MaxStreamDuration wraps a streaming endpoint so that its stream lasts for at
+// most d, regardless of activity. This is useful for recycling long-lived
+// connections or for billing by session. An absolute deadline is set on the
+// connection and the client is closed once d elapses, so the handler observes
+// the closure through failed IO and through the client's Done channel. A stream
+// that ends before then leaves the connection open, for the requests that
+// follow.
+func MaxStreamDuration(d time.Duration, endpoint StreamingEndpoint) StreamingEndpoint {
+	return func(ctx context.Context, meta Metadata, client *Client) error {
+		deadline := newDeadline(d)
+
+		if err := client.SetDeadline(deadline); err != nil {
+			return err
+		}
+		timer := time.AfterFunc(d, func() { client.Close() })
+		err := endpoint(ctx, meta, client)
+
+		// The handler may have ended through the deadline before the timer
+		// closed the connection, in which case it is closed now.
+		if timer.Stop() && !time.Now().Before(deadline) {
+			client.Close()
+		}
+		return err
+	}
+}
+
+// Serialize wraps a request endpoint so that only one invocation of it runs at
+// a time, across all connections. This is useful for handlers wrapping
+// resources that are not safe for concurrent use, such as a single database
+// handle or a stateful encoder. Waiting invocations run in the order in which
+// they arrived, so a busy endpoint cannot starve any particular caller.
+func Serialize(endpoint RequestEndpoint) RequestEndpoint {
+	lock := &fifoLock{}
+
+	return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return endpoint(ctx, meta, w, r)
+	}
+}
+
+// fifoLock is a mutual exclusion lock that is handed to waiters in the order
+// they called Lock.
+type fifoLock struct {
+	mu      sync.Mutex
+	locked  bool
+	waiters []chan struct{}
+}
+
+func (l *fifoLock) Lock() {
+	l.mu.Lock()
+
+	if !l.locked {
+		l.locked = true
+		l.mu.Unlock()
+		return
+	}
+	wait := make(chan struct{})
+	l.waiters = append(l.waiters, wait)
+	l.mu.Unlock()
+
+	<-wait // Ownership is passed to us directly by Unlock.
+}
+
+func (l *fifoLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.waiters) == 0 {
+		l.locked = false
+		return
+	}
+	close(l.waiters[0])
+	l.waiters = l.waiters[1:]
+}
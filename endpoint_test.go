@@ -0,0 +1,165 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxStreamDuration(t *testing.T) {
+	max := 100 * time.Millisecond
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(serverConn)
+	done := make(chan error)
+
+	defer clientConn.Close()
+
+	endpoint := MaxStreamDuration(max, func(ctx context.Context, meta Metadata, client *Client) error {
+		input := bufio.NewScanner(client)
+
+		for input.Scan() {
+			if _, err := fmt.Fprintln(client, input.Text()); err != nil {
+				return err
+			}
+		}
+		return input.Err()
+	})
+
+	start := time.Now()
+
+	go func() {
+		done <- endpoint(context.Background(), Metadata{EndpointType: EndpointStream}, client)
+	}()
+
+	// Keep the stream busy; the connection should still be cut off at the
+	// deadline.
+	output := bufio.NewScanner(clientConn)
+
+	for i := 0; ; i++ {
+		if _, err := fmt.Fprintln(clientConn, i); err != nil {
+			break
+		}
+		if !output.Scan() {
+			break
+		}
+		if time.Since(start) > 10*max {
+			t.Fatal("Stream was not closed at its maximum duration")
+		}
+	}
+	<-done
+
+	if elapsed := time.Since(start); elapsed < max {
+		t.Errorf("Stream closed after %v, want at least %v", elapsed, max)
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Error("Expected Done channel to be closed")
+	}
+}
+
+func TestMaxStreamDurationEndedStream(t *testing.T) {
+	max := 50 * time.Millisecond
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(serverConn)
+
+	defer clientConn.Close()
+	defer client.Close()
+
+	endpoint := MaxStreamDuration(max, func(ctx context.Context, meta Metadata, client *Client) error {
+		return nil
+	})
+	if err := endpoint(context.Background(), Metadata{EndpointType: EndpointStream}, client); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The stream ended, so the connection is left for the requests that follow.
+	select {
+	case <-client.Done():
+		t.Error("Connection was closed after the stream ended")
+	case <-time.After(3 * max):
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	var active, overlaps, calls int32
+
+	s := NewInMemoryServer()
+	s.AddSerializedRequestEndpoint("serial", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			client := s.NewInMemoryClient()
+			defer client.Close()
+
+			for j := 0; j < 5; j++ {
+				client.WriteDataString("serial", "")
+				client.ReadData()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 50 {
+		t.Errorf("calls = %v, want %v", calls, 50)
+	}
+	if overlaps > 0 {
+		t.Errorf("Serialized endpoint overlapped %v times", overlaps)
+	}
+}
+
+func TestFIFOLockOrder(t *testing.T) {
+	lock := &fifoLock{}
+	order := make(chan int, 5)
+
+	lock.Lock()
+
+	for i := 0; i < 5; i++ {
+		i := i
+
+		go func() {
+			lock.Lock()
+			order <- i
+			lock.Unlock()
+		}()
+
+		// Wait for the goroutine to queue up before starting the next one.
+		for {
+			lock.mu.Lock()
+			n := len(lock.waiters)
+			lock.mu.Unlock()
+
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	lock.Unlock()
+
+	for want := 0; want < 5; want++ {
+		if got := <-order; got != want {
+			t.Errorf("lock acquired by %v, want %v", got, want)
+		}
+	}
+}
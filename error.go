@@ -0,0 +1,189 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ErrorCode classifies the errors a server reports in error frames. The codes
+// borrow their meaning from the HTTP status codes of the same value.
+type ErrorCode int
+
+// Error codes used by the server for the errors it reports itself. Zero means
+// the error frame did not carry a code.
+const (
+	CodeUnknown              ErrorCode = 0
+	CodeBadRequest           ErrorCode = 400
+	CodeUnauthorized         ErrorCode = 401 // The server's Authenticator turned the request down.
+	CodeForbidden            ErrorCode = 403 // The caller lacks a scope the endpoint requires.
+	CodeNotFound             ErrorCode = 404
+	CodePayloadTooLarge      ErrorCode = 413 // The request body exceeds the server's limit.
+	CodeUnsupportedMediaType ErrorCode = 415
+	CodeUnprocessableEntity  ErrorCode = 422 // The request failed validation.
+	CodeTooManyRequests      ErrorCode = 429 // The server's RateLimiter turned the request down.
+	CodeCanceled             ErrorCode = 499 // The client cancelled the request.
+	CodeInternal             ErrorCode = 500 // The endpoint failed with an error that is not an *Error.
+	CodeTimeout              ErrorCode = 504 // The request's Timeout elapsed before the endpoint was done.
+)
+
+// ErrRequestTimeout matches, with errors.Is, the *Error of a request that the
+// server gave up on once its Timeout elapsed.
+var ErrRequestTimeout = errors.New("request timed out")
+
+// Error is returned by the client when the server rejects a request with an
+// error frame instead of a response. Unless the server closes the connection
+// after a rejection, the connection remains usable afterwards.
+//
+// Request endpoints (and middleware) can also return an *Error themselves, to
+// have the server send it to the client as an error frame with the code of
+// their choosing. Its Endpoint is ignored. Other errors are sent as well, with
+// CodeInternal and the text of the error as the message.
+//
+// On the wire, the body of an error frame is the JSON encoding of the code and
+// the message, such as {"code":404,"message":"invalid endpoint specified"}, and
+// of the fields for validation errors.
+type Error struct {
+	Endpoint string            `json:"-"`                // The endpoint of the rejected request.
+	Code     ErrorCode         `json:"code"`             // What kind of error occurred.
+	Message  string            `json:"message"`          // The reason given by the server.
+	Fields   map[string]string `json:"fields,omitempty"` // The problem with each invalid field, if any.
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("srv: %s: %s (code %d)", e.Endpoint, e.Message, e.Code)
+}
+
+// Is reports whether the error is the one described by target, so that
+// errors.Is(err, ErrRequestTimeout) holds for timed out requests.
+func (e *Error) Is(target error) bool {
+	return target == ErrRequestTimeout && e.Code == CodeTimeout
+}
+
+// Unwrap returns a *ValidationError holding the fields, if there are any, so
+// that clients can get at them with errors.As.
+func (e *Error) Unwrap() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: e.Fields}
+}
+
+// ErrorCodeOf is used to branch on the outcome of a request. It returns the code
+// of the error frame err comes from, and false if err did not come from an
+// error frame, such as nil or a network failure.
+func ErrorCodeOf(err error) (code ErrorCode, ok bool) {
+	var e *Error
+
+	if !errors.As(err, &e) {
+		return CodeUnknown, false
+	}
+	return e.Code, true
+}
+
+// ValidationError describes a request that was rejected because some of its
+// fields are invalid. Fields maps the name of each invalid field to what is
+// wrong with it.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return "invalid fields: " + strings.Join(names, ", ")
+}
+
+// NewValidationError is used by request endpoints to reject a request whose
+// fields are invalid, with what is wrong with each of them. The client receives
+// it as an *Error with CodeUnprocessableEntity, from which the fields can be
+// recovered as a *ValidationError with errors.As.
+func NewValidationError(fields map[string]string) error {
+	v := &ValidationError{Fields: fields}
+	return &Error{Code: CodeUnprocessableEntity, Message: v.Error(), Fields: fields}
+}
+
+// parseError is used to turn an error frame into an *Error. It returns nil for
+// any other kind of frame. A body that is not in the expected format is kept
+// whole as the message, so that the reason is not lost.
+func parseError(meta Metadata, body []byte) error {
+	if meta.EndpointType != EndpointError {
+		return nil
+	}
+	e := &Error{}
+
+	if err := json.Unmarshal(body, e); err != nil {
+		e = &Error{Message: string(body)}
+	}
+	e.Endpoint = meta.Endpoint
+	return e
+}
+
+// recoverableError wraps an error after which the connection is still usable,
+// because the client has been told about it and the request was consumed.
+type recoverableError struct {
+	error
+}
+
+func (e recoverableError) Unwrap() error {
+	return e.error
+}
+
+// writeError is used to answer a request with an error frame.
+func (c *Client) writeError(endpoint string, code ErrorCode, message string) (n int, err error) {
+	return c.writeErrorFrame(endpoint, &Error{Code: code, Message: message})
+}
+
+// writeErrorFrame is like writeError, but it sends e whole.
+func (c *Client) writeErrorFrame(endpoint string, e *Error) (n int, err error) {
+	if c.isClosed() {
+		return 0, errConnectionClosed
+	}
+	body, err := json.Marshal(e)
+
+	if err != nil {
+		return 0, err
+	}
+	meta := Metadata{EndpointType: EndpointError, BodySize: int64(len(body)), Endpoint: endpoint}
+
+	return c.Write(append(c.encodeMeta(meta), body...))
+}
+
+// reject is used to turn down a request whose body has not been read. If the
+// body is small enough to drain, it is discarded and the client is sent an error
+// frame (unless the request is one-way), so the connection can carry on;
+// otherwise reason is returned as is and the connection gets closed.
+func (s *Server) reject(meta Metadata, client *Client, code ErrorCode, reason error) error {
+	if meta.BodySize > s.MaxDrainBytes {
+		s.maybeLogf("Closing connection rather than draining %d bytes", meta.BodySize)
+		return reason
+	}
+	if _, err := io.CopyN(io.Discard, client, meta.BodySize); err != nil {
+		return s.logReadError(client, "rejected body", err)
+	}
+	if meta.EndpointType == EndpointOneWay {
+		return recoverableError{reason}
+	}
+	if _, err := client.writeError(meta.Endpoint, code, reason.Error()); err != nil {
+		return s.logWriteError(client, "error frame", err)
+	}
+	return recoverableError{reason}
+}
+
+// endStream is used to make the rejection of a stream close the connection:
+// the rest of the connection belongs to the stream, so it cannot be
+// resynchronized, but the client has been told why by then.
+func endStream(meta Metadata, err error) error {
+	if re, ok := err.(recoverableError); ok && meta.EndpointType == EndpointStream {
+		return re.error
+	}
+	return err
+}
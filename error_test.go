@@ -0,0 +1,187 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		meta Metadata
+		body string
+		want error
+	}{
+		{"not an error frame", Metadata{Endpoint: "echo"}, `{"code":404}`, nil},
+		{
+			"code and message",
+			Metadata{EndpointType: EndpointError, Endpoint: "echo"},
+			`{"code":404,"message":"invalid endpoint specified"}`,
+			&Error{Endpoint: "echo", Code: CodeNotFound, Message: "invalid endpoint specified"},
+		},
+		{
+			"unknown format",
+			Metadata{EndpointType: EndpointError, Endpoint: "echo"},
+			"something went wrong",
+			&Error{Endpoint: "echo", Code: CodeUnknown, Message: "something went wrong"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := parseError(tt.meta, []byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("error = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerErrorFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		meta       Metadata
+		want       *Error
+		wantClosed bool
+	}{
+		{
+			"request endpoint not found",
+			Metadata{Endpoint: "missing"},
+			&Error{Endpoint: "missing", Code: CodeNotFound, Message: errInvalidEndpoint.Error()},
+			false,
+		},
+		{
+			"empty request endpoint",
+			Metadata{},
+			&Error{Code: CodeBadRequest, Message: ErrEmptyEndpoint.Error()},
+			false,
+		},
+		{
+			"empty streaming endpoint",
+			Metadata{EndpointType: EndpointStream},
+			&Error{Code: CodeBadRequest, Message: ErrEmptyEndpoint.Error()},
+			true,
+		},
+		{
+			"streaming endpoint not found",
+			Metadata{EndpointType: EndpointStream, Endpoint: "missing"},
+			&Error{Endpoint: "missing", Code: CodeNotFound, Message: errInvalidEndpoint.Error()},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := newEchoServer().NewInMemoryClient()
+
+			defer client.Close()
+
+			go client.WriteMeta(tt.meta)
+
+			_, _, err := client.ReadData()
+
+			if got, ok := errors.Cause(err).(*Error); !ok || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("error = %#v, want %#v", err, tt.want)
+			}
+			if _, err = client.WriteDataString("echo", "hello"); err == nil {
+				_, _, err = client.ReadData()
+			}
+			if tt.wantClosed && err == nil {
+				t.Error("Expected the connection to be closed")
+			}
+			if !tt.wantClosed && err != nil {
+				t.Errorf("Expected the connection to be usable, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServerEndpointErrors(t *testing.T) {
+	s := newEchoServer()
+	s.AddRequestEndpoint("fail", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		return errors.New("disk full")
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		wantCode ErrorCode
+		wantOK   bool
+		wantBody string
+	}{
+		{"success", "echo", CodeUnknown, false, "hello"},
+		{"plain error", "fail", CodeInternal, true, ""},
+		{"after an error", "echo", CodeUnknown, false, "hello"},
+	}
+	for _, tt := range tests {
+		// The requests share the connection, so they run one after the other.
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Send(Request{Meta: Metadata{Endpoint: tt.endpoint}, Body: []byte("hello")})
+
+			if code, ok := ErrorCodeOf(err); code != tt.wantCode || ok != tt.wantOK {
+				t.Fatalf("ErrorCodeOf(%v) = %d, %v, want %d, %v", err, code, ok, tt.wantCode, tt.wantOK)
+			}
+			if string(resp.Body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", resp.Body, tt.wantBody)
+			}
+			var e *Error
+
+			if tt.wantOK && (!errors.As(err, &e) || e.Message != "disk full") {
+				t.Errorf("error = %v, want the message of the endpoint's error", err)
+			}
+		})
+	}
+	if code, ok := ErrorCodeOf(io.EOF); code != CodeUnknown || ok {
+		t.Errorf("ErrorCodeOf(io.EOF) = %d, %v, want %d, false", code, ok, CodeUnknown)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	fields := map[string]string{
+		"email": "must contain an @",
+		"name":  "must not be empty",
+	}
+	s := newEchoServer()
+	s.AddRequestEndpoint("signup", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		return NewValidationError(fields)
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	_, err := client.Send(Request{Meta: Metadata{Endpoint: "signup"}})
+
+	var e *Error
+
+	if !errors.As(err, &e) || e.Code != CodeUnprocessableEntity {
+		t.Fatalf("error = %v, want code %d", err, CodeUnprocessableEntity)
+	}
+	var v *ValidationError
+
+	if !errors.As(err, &v) {
+		t.Fatalf("error = %v, want a *ValidationError", err)
+	}
+	if !reflect.DeepEqual(v.Fields, fields) {
+		t.Errorf("fields = %v, want %v", v.Fields, fields)
+	}
+	if want := "invalid fields: email, name"; e.Message != want {
+		t.Errorf("message = %q, want %q", e.Message, want)
+	}
+
+	// Other errors carry no fields.
+	if _, err = client.Send(Request{Meta: Metadata{Endpoint: "missing"}}); errors.As(err, &v) {
+		t.Errorf("error = %v, want no *ValidationError", err)
+	}
+}
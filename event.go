@@ -0,0 +1,101 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// errParked is returned by serveClient once the connection has been handed over
+// to the reactor, which closes it when it is done.
+var errParked = errors.New("connection parked")
+
+// errNoReactor is returned by the reactor on platforms where it cannot park
+// connections.
+var errNoReactor = errors.New("connections cannot be parked on this platform")
+
+// parkedConn is a stream served by an event endpoint through the reactor.
+type parkedConn struct {
+	s        *Server
+	ctx      context.Context // Passed to the endpoint, and cancelled once the stream ends.
+	cancel   context.CancelFunc
+	meta     Metadata
+	client   *Client
+	endpoint EventEndpoint
+	start    time.Time
+	fd       int  // The file descriptor watched by the reactor.
+	awake    bool // Whether the endpoint is running; guarded by the reactor.
+	removed  bool // Whether the reactor stopped watching it; guarded by the reactor.
+}
+
+// serveEvents is used to serve a stream with an event endpoint. The connection
+// is parked between events if possible; otherwise, the endpoint is called in a
+// loop on the current goroutine until the stream ends.
+func (s *Server) serveEvents(ctx context.Context, meta Metadata, client *Client, endpoint EventEndpoint) error {
+	if canPark(client) {
+		p := &parkedConn{s: s, meta: meta, client: client, endpoint: endpoint, start: time.Now()}
+
+		// The stream outlives the goroutine of the connection, and so does its
+		// context, which is only tied to the server.
+		p.ctx, p.cancel = context.WithCancel(s.ctx)
+
+		// Nobody else holds the client yet, so the hook can be set safely.
+		client.onClose = func() { s.events.closed(p) }
+
+		err := s.events.park(p)
+
+		if err == nil {
+			return errParked
+		}
+		client.onClose = nil
+		p.cancel()
+
+		if err != errNoReactor {
+			s.maybeLogf("Could not park connection from %v: %v", client.RemoteAddr(), err)
+		}
+	}
+	for {
+		err := endpoint(ctx, meta, client)
+
+		if err != nil || client.isClosed() {
+			return s.eventsDone(meta, err)
+		}
+	}
+}
+
+// canPark reports whether the reactor can watch the client's connection: it
+// needs the file descriptor of the connection, and nothing may be buffered on
+// this side of it.
+func canPark(client *Client) bool {
+	_, ok := client.conn.(syscall.Conn)
+	return ok && client.r == nil && len(client.unread) == 0
+}
+
+// eventsDone is used to report how the stream of an event endpoint ended. It
+// returns nil if it ended cleanly.
+func (s *Server) eventsDone(meta Metadata, err error) error {
+	if err == io.EOF || err == errConnectionClosed {
+		return nil
+	}
+	if err != nil {
+		s.maybeLogf("Error serving %s endpoint %v: %v", EndpointTypeName(meta.EndpointType), meta.Endpoint, err)
+	}
+	return err
+}
+
+// end is used to close the connection of a stream that the reactor gave up.
+func (p *parkedConn) end(err error) {
+	p.cancel()
+	err = p.s.eventsDone(p.meta, err)
+
+	if p.s.Metrics != nil {
+		p.s.Metrics.Observe(p.meta, time.Since(p.start), err)
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	p.client.flushWrites()
+	p.s.closeConn(p.client.conn, err)
+}
@@ -0,0 +1,268 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoEvents answers every message with the same message.
+func echoEvents(ctx context.Context, meta Metadata, client *Client) error {
+	body, err := client.ReadMessage()
+
+	if err != nil {
+		return err
+	}
+	_, err = client.WriteMessage(body)
+	return err
+}
+
+// openStream opens a stream to the endpoint on the server at addr.
+func openStream(t testing.TB, addr, endpoint string) *Client {
+	t.Helper()
+
+	client, err := NewClient(ProtocolTCP, addr)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	meta, err := NewStreamMetadata(endpoint)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.WriteMeta(meta); err != nil {
+		t.Fatalf("Could not open stream: %v", err)
+	}
+	return client
+}
+
+// waitUntil polls cond until it holds, failing the test after a while.
+func waitUntil(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServerEventEndpoint(t *testing.T) {
+	const streams = 50
+
+	var (
+		mu      sync.Mutex
+		reasons []error
+	)
+	s := NewInMemoryServer()
+	s.AddEventEndpoint("echo", echoEvents)
+	s.OnConnClose = func(conn net.Conn, reason error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		reasons = append(reasons, reason)
+	}
+	addr := listenOn(t, s)
+	clients := make([]*Client, streams)
+
+	for i := range clients {
+		clients[i] = openStream(t, addr, "echo")
+	}
+	for round, msg := range []string{"hello", "world"} {
+		for i, client := range clients {
+			if _, err := client.WriteMessage([]byte(msg)); err != nil {
+				t.Fatalf("Could not write message %d to stream %d: %v", round, i, err)
+			}
+			if body, err := client.ReadMessage(); err != nil || string(body) != msg {
+				t.Fatalf("message = %q, %v, want %q", body, err, msg)
+			}
+		}
+		if runtime.GOOS == "linux" {
+			waitUntil(t, "idle streams to be parked", func() bool {
+				return s.ParkedConns() == streams && s.ConnGoroutines() == 0
+			})
+		}
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+	waitUntil(t, "streams to end", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(reasons) == streams
+	})
+	for _, reason := range reasons {
+		if reason != io.EOF {
+			t.Errorf("reason = %v, want %v", reason, io.EOF)
+		}
+	}
+	if n := s.ParkedConns(); n != 0 {
+		t.Errorf("parked connections = %d, want 0", n)
+	}
+}
+
+func TestServerEventEndpointInMemory(t *testing.T) {
+	s := NewInMemoryServer()
+	s.AddEventEndpoint("echo", echoEvents)
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	meta, err := NewStreamMetadata("echo")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.WriteMeta(meta); err != nil {
+		t.Fatalf("Could not open stream: %v", err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := client.WriteMessage([]byte(msg)); err != nil {
+			t.Fatalf("Could not write message: %v", err)
+		}
+		if body, err := client.ReadMessage(); err != nil || string(body) != msg {
+			t.Fatalf("message = %q, %v, want %q", body, err, msg)
+		}
+	}
+}
+
+func TestServerEventEndpointClosedWhileParked(t *testing.T) {
+	clients := make(chan *Client, 1)
+	closed := make(chan error, 1)
+
+	s := NewInMemoryServer()
+	s.AddEventEndpoint("subscribe", func(ctx context.Context, meta Metadata, client *Client) error {
+		if _, err := client.ReadMessage(); err != nil {
+			return err
+		}
+		clients <- client
+		return nil
+	})
+	s.OnConnClose = func(conn net.Conn, reason error) {
+		closed <- reason
+	}
+	client := openStream(t, listenOn(t, s), "subscribe")
+
+	defer client.Close()
+
+	if _, err := client.WriteMessage([]byte("hello")); err != nil {
+		t.Fatalf("Could not write message: %v", err)
+	}
+	// The server gives up on the subscriber from elsewhere, such as a
+	// broadcaster noticing that it fell behind.
+	(<-clients).Close()
+
+	select {
+	case reason := <-closed:
+		if reason != io.EOF {
+			t.Errorf("reason = %v, want %v", reason, io.EOF)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The connection was not closed")
+	}
+	if _, err := client.ReadMessage(); err == nil {
+		t.Error("The stream is still open")
+	}
+}
+
+func TestServerEventEndpointShutdown(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Connections are only parked on Linux")
+	}
+	closed := make(chan error, 1)
+
+	s := NewInMemoryServer()
+	s.AddEventEndpoint("echo", echoEvents)
+	s.OnConnClose = func(conn net.Conn, reason error) {
+		closed <- reason
+	}
+	client := openStream(t, listenOn(t, s), "echo")
+
+	defer client.Close()
+
+	waitUntil(t, "the stream to be parked", func() bool { return s.ParkedConns() == 1 })
+
+	done := make(chan struct{})
+
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return with an idle stream parked")
+	}
+	if reason := <-closed; reason != io.EOF {
+		t.Errorf("reason = %v, want %v", reason, io.EOF)
+	}
+	if _, err := client.ReadMessage(); err == nil {
+		t.Error("The stream is still open")
+	}
+	if n := s.ParkedConns(); n != 0 {
+		t.Errorf("parked connections = %d, want 0", n)
+	}
+}
+
+// BenchmarkIdleStreams reports the goroutines and the stack memory the server
+// spends on each idle stream.
+func BenchmarkIdleStreams(b *testing.B) {
+	const streams = 1000
+
+	blocking := func(ctx context.Context, meta Metadata, client *Client) error {
+		for {
+			if err := echoEvents(ctx, meta, client); err != nil {
+				return err
+			}
+		}
+	}
+	for _, bb := range []struct {
+		name  string
+		setup func(s *Server)
+	}{
+		{"streaming", func(s *Server) { s.AddStreamingEndpoint("idle", blocking) }},
+		{"event", func(s *Server) { s.AddEventEndpoint("idle", echoEvents) }},
+	} {
+		bb := bb
+
+		b.Run(bb.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+
+			for n := 0; n < b.N; n++ {
+				s := NewInMemoryServer()
+				bb.setup(s)
+				addr := listenOn(b, s)
+
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				goroutines := runtime.NumGoroutine()
+				clients := make([]*Client, streams)
+
+				for i := range clients {
+					clients[i] = openStream(b, addr, "idle")
+				}
+				// A round trip on the last stream makes sure that the server
+				// has picked up every stream before measuring.
+				clients[streams-1].WriteMessage([]byte("ping"))
+				clients[streams-1].ReadMessage()
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/streams, "goroutines/stream")
+				b.ReportMetric(float64(after.StackInuse-before.StackInuse)/streams, "stack-B/stream")
+
+				for _, client := range clients {
+					client.Close()
+				}
+				s.Shutdown()
+			}
+		})
+	}
+}
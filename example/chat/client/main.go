@@ -7,21 +7,25 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/mylanconnolly/srv"
 )
 
 func main() {
-	client, err := srv.NewClient(srv.ProtocolTCP, "127.0.0.1:1337")
+	client, err := srv.NewClientRetry(srv.ProtocolTCP, "127.0.0.1:1337", 5, 100*time.Millisecond)
 
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	if _, err = client.WriteMeta(srv.Metadata{
-		Endpoint:     "message",
-		EndpointType: srv.EndpointStream,
-	}); err != nil {
+	meta, err := srv.NewStreamMetadata("message")
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if _, err = client.WriteMeta(meta); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
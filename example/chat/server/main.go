@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -29,7 +30,7 @@ func main() {
 	}
 	s.Log = true
 
-	s.AddStreamingEndpoint("message", func(meta srv.Metadata, client *srv.Client) error {
+	s.AddStreamingEndpoint("message", func(ctx context.Context, meta srv.Metadata, client *srv.Client) error {
 		ch := make(chan string)
 
 		go func() {
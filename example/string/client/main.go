@@ -5,12 +5,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mylanconnolly/srv"
 )
 
 func main() {
-	client, err := srv.NewClient(srv.ProtocolTCP, "localhost:1337")
+	client, err := srv.NewClientRetry(srv.ProtocolTCP, "localhost:1337", 5, 100*time.Millisecond)
 
 	if err != nil {
 		fmt.Println(err)
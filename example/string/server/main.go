@@ -1,16 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 
 	"github.com/mylanconnolly/srv"
+	"github.com/mylanconnolly/srv/handlers"
 )
 
 func main() {
@@ -22,29 +20,9 @@ func main() {
 	}
 	s.Log = true
 
-	// Simple endpoint that echos back input
-	s.AddRequestEndpoint("echo", func(meta srv.Metadata, w io.Writer, r io.Reader) error {
-		io.Copy(w, r)
-		return nil
-	})
-
-	// Simple endpoint that returns the uppercase of input
-	s.AddRequestEndpoint("upper", func(meta srv.Metadata, w io.Writer, r io.Reader) error {
-		buf := &bytes.Buffer{}
-		io.Copy(buf, r)
-		str := strings.ToUpper(buf.String())
-		w.Write([]byte(str))
-		return nil
-	})
-
-	// Simple endpoint that returns the lowercase of input
-	s.AddRequestEndpoint("lower", func(meta srv.Metadata, w io.Writer, r io.Reader) error {
-		buf := &bytes.Buffer{}
-		io.Copy(buf, r)
-		str := strings.ToLower(buf.String())
-		w.Write([]byte(str))
-		return nil
-	})
+	s.AddRequestEndpoint("echo", handlers.Echo)
+	s.AddRequestEndpoint("upper", handlers.Upper)
+	s.AddRequestEndpoint("lower", handlers.Lower)
 
 	go func() {
 		if err := s.Listen(); err != nil {
@@ -0,0 +1,83 @@
+//go:build unix
+
+package srv
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotUnixConn is returned when a file descriptor is sent or received over a
+// client that is not connected through a plain Unix domain socket.
+var ErrNotUnixConn = errors.New("not a unix domain socket connection")
+
+// SendFD is used to pass an open file to the peer, which receives it with
+// RecvFD. This lets a privileged process hand out files or sockets that the
+// peer could not open itself. It only works on Unix domain socket connections
+// that are not compressed, and is typically used within a streaming endpoint.
+// The file stays open on this side; closing it is up to the caller.
+func (c *Client) SendFD(f *os.File) error {
+	conn, err := c.unixConn()
+
+	if err != nil {
+		return err
+	}
+	// A byte of regular data is sent along, since some systems do not deliver
+	// control messages on their own.
+	rights := syscall.UnixRights(int(f.Fd()))
+
+	if _, _, err = conn.WriteMsgUnix([]byte{0}, rights, nil); err != nil {
+		return errors.Wrap(err, "could not send file descriptor")
+	}
+	return nil
+}
+
+// RecvFD is used to receive a file sent by the peer with SendFD.
+func (c *Client) RecvFD() (*os.File, error) {
+	conn, err := c.unixConn()
+
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not receive file descriptor")
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse control message")
+	}
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+
+		if err != nil || len(fds) == 0 {
+			continue
+		}
+		for _, extra := range fds[1:] {
+			syscall.Close(extra)
+		}
+		return os.NewFile(uintptr(fds[0]), "fd"), nil
+	}
+	return nil, errors.New("no file descriptor received")
+}
+
+// unixConn returns the underlying Unix domain socket, if the client can pass
+// file descriptors over it.
+func (c *Client) unixConn() (*net.UnixConn, error) {
+	if c.isClosed() {
+		return nil, errConnectionClosed
+	}
+	conn, ok := c.conn.(*net.UnixConn)
+
+	if !ok || c.compression != "" {
+		return nil, ErrNotUnixConn
+	}
+	return conn, nil
+}
@@ -0,0 +1,93 @@
+//go:build unix
+
+package srv
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// unixPair returns two clients connected by a Unix domain socket pair.
+func unixPair(t *testing.T) (*Client, *Client) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+
+	if err != nil {
+		t.Fatalf("Could not create socket pair: %v", err)
+	}
+	var clients []*Client
+
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+
+		if err != nil {
+			t.Fatalf("Could not create conn: %v", err)
+		}
+		clients = append(clients, NewClientConn(conn))
+	}
+	return clients[0], clients[1]
+}
+
+func TestClientSendFD(t *testing.T) {
+	sender, receiver := unixPair(t)
+
+	defer sender.Close()
+	defer receiver.Close()
+
+	path := filepath.Join(t.TempDir(), "shared")
+
+	if err := os.WriteFile(path, []byte("shared contents"), 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	}
+	defer f.Close()
+
+	errs := make(chan error, 1)
+	go func() { errs <- sender.SendFD(f) }()
+
+	received, err := receiver.RecvFD()
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	defer received.Close()
+
+	if err = <-errs; err != nil {
+		t.Fatalf("Could not send: %v", err)
+	}
+	contents, err := io.ReadAll(received)
+
+	if err != nil {
+		t.Fatalf("Could not read received file: %v", err)
+	}
+	if string(contents) != "shared contents" {
+		t.Errorf("contents = %q, want %q", contents, "shared contents")
+	}
+}
+
+func TestClientSendFDNotUnix(t *testing.T) {
+	conn, _ := net.Pipe()
+	client := NewClientConn(conn)
+
+	defer client.Close()
+
+	if err := client.SendFD(os.Stdin); errors.Cause(err) != ErrNotUnixConn {
+		t.Errorf("error = %v, want %v", err, ErrNotUnixConn)
+	}
+	if _, err := client.RecvFD(); errors.Cause(err) != ErrNotUnixConn {
+		t.Errorf("error = %v, want %v", err, ErrNotUnixConn)
+	}
+}
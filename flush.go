@@ -0,0 +1,126 @@
+package srv
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// FlushPolicy decides when the frames a server writes to a connection are sent.
+type FlushPolicy int
+
+// Constants describing the policies for sending frames.
+const (
+	FlushEach     FlushPolicy = iota // Send every frame as soon as it is written.
+	FlushCoalesce                    // Buffer frames and send them together; see Server.FlushPolicy.
+)
+
+// Defaults used with FlushCoalesce.
+const (
+	DefaultFlushInterval  = 2 * time.Millisecond // The longest a frame waits in the buffer.
+	DefaultFlushThreshold = 32 << 10             // The buffered bytes that are sent right away.
+)
+
+// coalescer is used to buffer the writes to a connection, sending them once
+// threshold bytes are waiting or interval has passed since the first of them was
+// buffered. Writes may come from the goroutine of the connection and from the
+// timer at once. An error writing to the connection is kept, and returned by the
+// writes that follow.
+type coalescer struct {
+	mu        sync.Mutex
+	w         io.Writer
+	buf       []byte
+	interval  time.Duration
+	threshold int
+	timer     *time.Timer
+	armed     bool // Whether the timer is set to flush buf.
+	err       error
+}
+
+// newCoalescer is used to create a coalescer writing to w, with the defaults
+// for an interval or threshold that is not set.
+func newCoalescer(w io.Writer, interval time.Duration, threshold int) *coalescer {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	if threshold <= 0 {
+		threshold = DefaultFlushThreshold
+	}
+	return &coalescer{w: w, interval: interval, threshold: threshold}
+}
+
+func (c *coalescer) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.buf = append(c.buf, b...)
+
+	if len(c.buf) >= c.threshold {
+		return len(b), c.flushLocked()
+	}
+	if !c.armed {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.interval, c.flushTimer)
+		} else {
+			c.timer.Reset(c.interval)
+		}
+		c.armed = true
+	}
+	return len(b), nil
+}
+
+// Flush is used to send the buffered writes right away.
+func (c *coalescer) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.flushLocked()
+}
+
+// flushTimer is run by the timer once the interval has passed.
+func (c *coalescer) flushTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.armed { // Otherwise, the buffer was flushed in the meantime.
+		c.flushLocked()
+	}
+}
+
+func (c *coalescer) flushLocked() error {
+	if c.armed {
+		c.timer.Stop()
+		c.armed = false
+	}
+	if c.err != nil || len(c.buf) == 0 {
+		return c.err
+	}
+	_, c.err = c.w.Write(c.buf)
+
+	if cap(c.buf) > c.threshold*2 { // Only keep a buffer of about the threshold.
+		c.buf = nil
+	} else {
+		c.buf = c.buf[:0]
+	}
+	return c.err
+}
+
+// connWriter returns the writer that leads to the connection of the client,
+// through its coalescer if it has one.
+func (c *Client) connWriter() io.Writer {
+	if c.coalesce != nil {
+		return c.coalesce
+	}
+	return c.conn
+}
+
+// flushWrites is used to send the writes the client buffered with a coalescer,
+// before its connection is closed.
+func (c *Client) flushWrites() {
+	if c.coalesce != nil {
+		c.coalesce.Flush()
+	}
+}
@@ -0,0 +1,167 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCountingConn is a connection that counts the writes made to it.
+type writeCountingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// pipelineEcho sends n echo requests before reading any response, and checks
+// the responses.
+func pipelineEcho(t testing.TB, client *Client, n int) {
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := client.WriteDataString("echo", fmt.Sprint(i)); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		_, body, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response %d: %v", i, err)
+		}
+		if body != fmt.Sprint(i) {
+			t.Fatalf("response %d: body = %q, want %q", i, body, fmt.Sprint(i))
+		}
+	}
+}
+
+func TestServerFlushPolicy(t *testing.T) {
+	const requests = 50
+
+	tests := []struct {
+		name      string
+		policy    FlushPolicy
+		interval  time.Duration
+		threshold int
+		maxWrites int32
+	}{
+		{"each", FlushEach, 0, 0, requests},
+		{"coalesce", FlushCoalesce, 100 * time.Millisecond, 0, requests / 2},
+		{"coalesce past threshold", FlushCoalesce, time.Hour, 1, requests},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.FlushPolicy = tt.policy
+			s.FlushInterval = tt.interval
+			s.FlushThreshold = tt.threshold
+			serverConn, clientConn := net.Pipe()
+			conn := &writeCountingConn{Conn: serverConn}
+			client := NewClientConn(clientConn)
+
+			go s.ServeConn(conn)
+
+			defer client.Close()
+
+			pipelineEcho(t, client, requests)
+
+			if writes := conn.writes.Load(); writes > tt.maxWrites {
+				t.Errorf("writes = %d, want at most %d", writes, tt.maxWrites)
+			}
+		})
+	}
+}
+
+func TestServerFlushCoalesceSync(t *testing.T) {
+	s := newEchoServer()
+	s.FlushPolicy = FlushCoalesce
+	s.FlushInterval = 20 * time.Millisecond
+	s.AddRequestEndpoint("logout", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		CloseAfterResponse(w)
+		_, err := io.WriteString(w, "bye")
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	// A client waiting on its response gets it once the interval passes.
+	for i := 0; i < 3; i++ {
+		resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+		if err != nil || string(resp.Body) != "hello" {
+			t.Fatalf("body = %q, %v, want %q", resp.Body, err, "hello")
+		}
+	}
+
+	// Buffered frames are sent before the connection is closed.
+	s.FlushInterval = time.Hour
+	client = s.NewInMemoryClient()
+
+	defer client.Close()
+
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "logout"}})
+
+	if err != nil || string(resp.Body) != "bye" {
+		t.Fatalf("body = %q, %v, want %q", resp.Body, err, "bye")
+	}
+	if _, err = client.ReadResponse(); err != io.EOF {
+		t.Errorf("error = %v, want %v", err, io.EOF)
+	}
+}
+
+// BenchmarkFlushPolicy compares the latency of single requests with the
+// throughput of pipelined ones under each policy.
+func BenchmarkFlushPolicy(b *testing.B) {
+	for _, policy := range []struct {
+		name   string
+		policy FlushPolicy
+	}{
+		{"each", FlushEach},
+		{"coalesce", FlushCoalesce},
+	} {
+		for _, pipelined := range []bool{false, true} {
+			policy, pipelined := policy, pipelined
+			name := policy.name + "/sync"
+
+			if pipelined {
+				name = policy.name + "/pipelined"
+			}
+			b.Run(name, func(b *testing.B) {
+				s := newEchoServer()
+				s.FlushPolicy = policy.policy
+				client, err := NewClient(ProtocolTCP, listenOn(b, s))
+
+				if err != nil {
+					b.Fatalf("Could not connect: %v", err)
+				}
+				defer client.Close()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				if pipelined {
+					pipelineEcho(b, client, b.N)
+					return
+				}
+				for n := 0; n < b.N; n++ {
+					if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil {
+						b.Fatalf("Could not send request: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package handlers provides request endpoints for common behaviors, which can
+// be registered as they are or wrapped in middleware (see srv.Middleware).
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/mylanconnolly/srv"
+)
+
+var (
+	// Upper is a request endpoint that responds with the body in upper case.
+	Upper = Transform(bytes.ToUpper)
+
+	// Lower is a request endpoint that responds with the body in lower case.
+	Lower = Transform(bytes.ToLower)
+)
+
+// Echo is a request endpoint that responds with the body of the request.
+func Echo(ctx context.Context, meta srv.Metadata, w io.Writer, r io.Reader) error {
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// Transform is used to create a request endpoint that responds with the body of
+// the request as changed by fn. The body is read in full before fn is called,
+// and fn may modify it in place.
+func Transform(fn func([]byte) []byte) srv.RequestEndpoint {
+	return func(ctx context.Context, meta srv.Metadata, w io.Writer, r io.Reader) error {
+		body, err := io.ReadAll(r)
+
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(fn(body))
+		return err
+	}
+}
+
+// JSON is a request endpoint that responds with the body of the request as it
+// is, once it is checked to be valid JSON. Other bodies are rejected with an
+// error frame with srv.CodeBadRequest, so that it can stand in for an endpoint
+// that decodes its requests, or check what reaches one.
+func JSON(ctx context.Context, meta srv.Metadata, w io.Writer, r io.Reader) error {
+	body, err := io.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+	if !json.Valid(body) {
+		return &srv.Error{Code: srv.CodeBadRequest, Message: "invalid JSON body"}
+	}
+	_, err = w.Write(body)
+	return err
+}
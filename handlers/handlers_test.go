@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mylanconnolly/srv"
+)
+
+func TestHandlers(t *testing.T) {
+	big := strings.Repeat("a", 1<<20)
+
+	tests := []struct {
+		name     string
+		endpoint srv.RequestEndpoint
+		body     string
+		want     string
+		wantCode srv.ErrorCode
+	}{
+		{"echo", Echo, "Hello", "Hello", 0},
+		{"echo empty", Echo, "", "", 0},
+		{"echo large", Echo, big, big, 0},
+		{"upper", Upper, "Hello, World", "HELLO, WORLD", 0},
+		{"lower", Lower, "Hello, World", "hello, world", 0},
+		{"transform", Transform(func(b []byte) []byte { return bytes.Repeat(b, 2) }), "ab", "abab", 0},
+		{"json", JSON, `{"name": "srv", "tags": [1, 2]}`, `{"name": "srv", "tags": [1, 2]}`, 0},
+		{"json scalar", JSON, `42`, `42`, 0},
+		{"invalid json", JSON, `{"name":`, "", srv.CodeBadRequest},
+		{"empty json", JSON, "", "", srv.CodeBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := srv.NewInMemoryServer()
+			s.AddRequestEndpoint("test", tt.endpoint)
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			for i := 0; i < 2; i++ { // The connection stays usable afterwards.
+				resp, err := client.Send(srv.Request{Meta: srv.Metadata{Endpoint: "test"}, Body: []byte(tt.body)})
+
+				if code, _ := srv.ErrorCodeOf(err); code != tt.wantCode || (code == 0 && err != nil) {
+					t.Fatalf("error = %v, want code %d", err, tt.wantCode)
+				}
+				if string(resp.Body) != tt.want {
+					t.Errorf("body = %.20q, want %.20q", resp.Body, tt.want)
+				}
+			}
+		})
+	}
+}
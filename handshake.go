@@ -0,0 +1,149 @@
+package srv
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLateHandshake is returned when a client sends a hello frame after other
+// frames, since options can only be negotiated at the start of a connection.
+var ErrLateHandshake = errors.New("handshake must be the first frame")
+
+// maxHelloSize is the largest hello frame body the server accepts.
+const maxHelloSize = 64 << 10
+
+// Hello is the body of the hello frames exchanged by Client.Handshake, as JSON.
+// The client advertises its capabilities, listing the compression methods it
+// would like to use in order of preference, and the server answers with its own
+// capabilities and the options it chose.
+type Hello struct {
+	ProtocolVersion int          `json:"protocol_version"`
+	Capabilities    Capabilities `json:"capabilities"`
+
+	// Compression is the method the server chose from the client's list, if
+	// any. It applies to both directions from the frame following the server's
+	// hello on. It is empty in the client's hello.
+	Compression string `json:"compression,omitempty"`
+
+	// CompactHeaders asks for compact headers in the client's hello, and
+	// tells that the server agreed in its own. They are used in both
+	// directions from the frame following the server's hello on; see
+	// Metadata.EncodeCompact.
+	CompactHeaders bool `json:"compact_headers,omitempty"`
+}
+
+// Handshake is used to negotiate the options of the connection with the server
+// before any other frames are sent. The client advertises its capabilities, and
+// the first of the preferred compression methods that the server supports is
+// enabled; without preferences, the connection is left uncompressed. It returns
+// the server's hello, and ErrLayoutMismatch if the server uses a different
+// header layout.
+//
+// If CompactHeaders is set on the client, it also asks for compact headers,
+// which the server agrees to unless the layouts differ.
+//
+// The handshake is optional: servers serve clients that skip it as usual. It
+// must be the first frame on the connection, otherwise the server answers with
+// an error frame carrying ErrLateHandshake.
+func (c *Client) Handshake(preferred ...string) (hello Hello, err error) {
+	local := LocalCapabilities()
+	local.Compression = nil
+
+	for _, method := range preferred {
+		if _, ok := compressor(method); ok {
+			local.Compression = append(local.Compression, method)
+		}
+	}
+	body, err := json.Marshal(Hello{ProtocolVersion: protocolVersion, Capabilities: local, CompactHeaders: c.CompactHeaders})
+
+	if err != nil {
+		return hello, err
+	}
+	if _, err = c.WriteRequest(Request{Meta: Metadata{EndpointType: EndpointHello}, Body: body}); err != nil {
+		return hello, err
+	}
+	resp, err := c.ReadResponse()
+
+	if err != nil {
+		return hello, err
+	}
+	if resp.Meta.EndpointType != EndpointHello {
+		return hello, errors.Wrapf(ErrUnexpectedFrame, "%s frame", EndpointTypeName(resp.Meta.EndpointType))
+	}
+	if err = json.Unmarshal(resp.Body, &hello); err != nil {
+		return hello, errors.Wrap(err, "could not decode hello")
+	}
+	c.caps = &hello.Capabilities
+
+	if err = hello.Capabilities.CheckLayout(LocalCapabilities()); err != nil {
+		return hello, err
+	}
+	c.compact = hello.CompactHeaders
+
+	if hello.Compression != "" {
+		return hello, c.compress(hello.Compression)
+	}
+	return hello, nil
+}
+
+// handleHello answers a hello frame, which is only allowed as the first frame
+// of the connection. Compression is switched on once the answer has been sent.
+func (s *Server) handleHello(meta Metadata, client *Client, first bool) error {
+	if !first {
+		s.maybeLogf("Received a late %s frame from %v", EndpointTypeName(meta.EndpointType), client.RemoteAddr())
+		return s.reject(meta, client, CodeBadRequest, ErrLateHandshake)
+	}
+	if meta.BodySize > maxHelloSize {
+		return s.reject(meta, client, CodePayloadTooLarge, ErrBodyTooLarge)
+	}
+	body, err := client.ReadBody(meta)
+
+	if err != nil {
+		return s.logReadError(client, "hello", err)
+	}
+	var theirs Hello
+
+	if err = json.Unmarshal(body, &theirs); err != nil {
+		s.maybeLogf("Could not decode hello from %v: %v", client.RemoteAddr(), err)
+
+		if _, werr := client.writeError(meta.Endpoint, CodeBadRequest, "could not decode hello"); werr != nil {
+			return s.logWriteError(client, "error frame", werr)
+		}
+		return recoverableError{err}
+	}
+	ours := Hello{ProtocolVersion: protocolVersion, Capabilities: LocalCapabilities()}
+	ours.Capabilities.Compression = s.compressionMethods()
+	ours.Capabilities.Endpoints = s.EndpointIDs()
+
+	if theirs.Capabilities.CheckLayout(ours.Capabilities) == nil {
+		ours.Compression = chooseCompression(theirs.Capabilities.Compression, ours.Capabilities.Compression)
+		ours.CompactHeaders = theirs.CompactHeaders
+	}
+	if body, err = json.Marshal(ours); err != nil {
+		return err
+	}
+	if _, err = client.WriteRequest(Request{Meta: Metadata{EndpointType: EndpointHello}, Body: body}); err != nil {
+		return s.logWriteError(client, "hello", err)
+	}
+	client.compact = ours.CompactHeaders
+
+	if ours.Compression == "" {
+		return nil
+	}
+	s.maybeLogf("Enabled %s compression for %v", ours.Compression, client.RemoteAddr())
+	return client.compress(ours.Compression)
+}
+
+// chooseCompression returns the first of the preferred methods that is offered,
+// or an empty string if there is none.
+func chooseCompression(preferred, offered []string) string {
+	for _, method := range preferred {
+		for _, m := range offered {
+			if m == method {
+				return method
+			}
+		}
+	}
+	return ""
+}
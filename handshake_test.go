@@ -0,0 +1,79 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClientHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred []string
+		want      string
+	}{
+		{"compression", []string{"unknown", CompressionFlate}, CompressionFlate},
+		{"no compression", nil, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			hello, err := client.Handshake(tt.preferred...)
+
+			if err != nil {
+				t.Fatalf("Should not return an error, got %v", err)
+			}
+			if hello.ProtocolVersion != protocolVersion {
+				t.Errorf("protocol version = %d, want %d", hello.ProtocolVersion, protocolVersion)
+			}
+			if hello.Compression != tt.want || client.ConnState().Compression != tt.want {
+				t.Errorf("compression = %q, %q, want %q", hello.Compression, client.ConnState().Compression, tt.want)
+			}
+			if _, ok := hello.Capabilities.Endpoints["echo"]; !ok {
+				t.Errorf("endpoints = %v, want them to include echo", hello.Capabilities.Endpoints)
+			}
+			if _, err = client.WriteDataString("echo", "hello"); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+				t.Errorf("body = %q, %v, want %q", body, err, "hello")
+			}
+		})
+	}
+}
+
+func TestClientHandshakeLegacy(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	// A client that predates the handshake sends requests right away.
+	if _, err := client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+		t.Errorf("body = %q, %v, want %q", body, err, "hello")
+	}
+
+	// It is then too late to negotiate, but the connection carries on.
+	var e *Error
+
+	if _, err := client.Handshake(CompressionFlate); !errors.As(err, &e) || e.Code != CodeBadRequest {
+		t.Errorf("error = %v, want a %v error", err, CodeBadRequest)
+	}
+	if _, err := client.WriteDataString("echo", "world"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "world" {
+		t.Errorf("body = %q, %v, want %q", body, err, "world")
+	}
+}
@@ -0,0 +1,31 @@
+package srv
+
+import (
+	"net"
+)
+
+// NewInMemoryServer is used to return a Server that is not bound to any
+// address. It cannot Listen; instead, clients are connected to it with
+// NewInMemoryClient. This exercises the full protocol without going through the
+// OS network stack, which makes for fast and deterministic tests.
+func NewInMemoryServer() *Server {
+	return newServer("", "")
+}
+
+// NewInMemoryClient is used to return a Client connected to the server through
+// an in-memory `net.Pipe`. The server side of the pipe is served as if it had
+// been accepted by a listener. This works on any Server, not only those created
+// with NewInMemoryServer.
+func (s *Server) NewInMemoryClient() *Client {
+	serverConn, clientConn := net.Pipe()
+
+	s.wg.Add(1)
+
+	go func() {
+		if s.admit(serverConn) {
+			s.handleConn(serverConn)
+		}
+	}()
+
+	return NewClientConn(clientConn)
+}
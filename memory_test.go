@@ -0,0 +1,152 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newEchoServer() *Server {
+	s := NewInMemoryServer()
+
+	s.AddRequestEndpoint("echo", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	return s
+}
+
+func TestInMemoryRoundTrip(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	for _, body := range []string{"hello", "", "world"} {
+		if _, err := client.WriteDataString("echo", body); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		_, got, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		if got != body {
+			t.Errorf("body = %q, want %q", got, body)
+		}
+	}
+}
+
+func TestInMemoryServerListen(t *testing.T) {
+	if err := NewInMemoryServer().Listen(); err != errInvalidProtocol {
+		t.Errorf("Listen() error = %v, want %v", err, errInvalidProtocol)
+	}
+}
+
+func TestServerGoroutinesBounded(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		if _, err := client.WriteDataString("echo", "hello"); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		if _, _, err := client.ReadData(); err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+	}
+	if got := s.ConnGoroutines(); got != 1 {
+		t.Errorf("goroutines serving connections = %d, want 1", got)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines grew from %d to %d over the requests", before, after)
+	}
+	client.Close()
+
+	for deadline := time.Now().Add(time.Second); s.ConnGoroutines() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines serving connections = %d after closing, want 0", s.ConnGoroutines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkEchoServerInMemory(b *testing.B) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+	body := []byte("hello world")
+
+	defer client.Close()
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		client.WriteData("echo", body)
+		client.ReadData()
+	}
+}
+
+func BenchmarkEchoServerSmallBody(b *testing.B) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+	body := bytes.Repeat([]byte("a"), 16)
+
+	defer client.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		client.WriteData("echo", body)
+		client.ReadData()
+	}
+}
+
+func TestServerBodyBufferSize(t *testing.T) {
+	s := newEchoServer()
+	s.BodyBufferSize = 64
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	// Bodies smaller, as large and larger than the buffer alternate on the
+	// connection, so that every response must be independent of the last.
+	for _, size := range []int{32, 64, 65, 16, 1000, 64} {
+		body := bytes.Repeat([]byte{byte(size)}, size)
+
+		if _, err := client.WriteData("echo", body); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		if _, got, err := client.ReadData(); err != nil || !bytes.Equal(got, body) {
+			t.Errorf("body = %d bytes, %v, want %d bytes of %d", len(got), err, size, size)
+		}
+	}
+}
+
+func BenchmarkEchoServerBodyBuffer(b *testing.B) {
+	for _, size := range []int{0, 4096} {
+		size := size
+
+		b.Run(fmt.Sprintf("BodyBufferSize=%d", size), func(b *testing.B) {
+			s := newEchoServer()
+			s.BodyBufferSize = size
+			client := s.NewInMemoryClient()
+			body := bytes.Repeat([]byte("a"), 4000)
+
+			defer client.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				client.WriteData("echo", body)
+				client.ReadData()
+			}
+		})
+	}
+}
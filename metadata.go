@@ -1,23 +1,107 @@
 package srv
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by Validate and SafeEncode when a string field does not fit
+// into its slot in the header.
+var (
+	ErrEndpointTooLong    = errors.New("endpoint name too long")
+	ErrContentTypeTooLong = errors.New("content type too long")
+	ErrAcceptTooLong      = errors.New("accept list too long")
+)
+
+// ErrInvalidEndpointName is returned by NewStreamMetadata when the endpoint name
+// is empty or contains control characters, which cannot be told apart from the
+// padding of the header or usually mean the caller made a mistake. Validate and
+// SafeEncode return it for names starting with the endpoint ID marker, which
+// would be read as an endpoint ID.
+var ErrInvalidEndpointName = errors.New("invalid endpoint name")
+
+// ErrUnsupportedVersion is returned when decoding a header written for a version
+// of the protocol that this build does not understand.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// ErrHeaderChecksum is returned when decoding a header whose checksum does not
+// match its contents, meaning that it was corrupted or that the stream is out of
+// step with the frames.
+var ErrHeaderChecksum = errors.New("header checksum mismatch")
+
+// protocolVersion is the version of the wire format written into every header.
+// It changes whenever the layout of the header does.
+const protocolVersion = 5
+
+// Constants describing the shape of the header. Peers built with a different
+// layout cannot understand each other; see Capabilities for how to detect this.
+const (
+	HeaderSize            = 335
+	HeaderEndpointSize    = 100
+	HeaderContentTypeSize = 100
+	HeaderAcceptSize      = 100
 )
 
-// Constants describing the shape of the header.
+// Offsets of the fields within the header. The protocol version comes first, so
+// that it stays in place whatever the layout of the version, and is checked
+// before anything else, the checksum included. The checksum is the CRC-32
+// (IEEE) of everything before it, as a little-endian uint32.
 const (
-	headerSize            = 225
-	headerEndpointSize    = 100
-	headerContentTypeSize = 100
+	headerVersionOffset         = 0
+	headerTypeOffset            = 1
+	headerUserIDOffset          = 2
+	headerTimeoutOffset         = 10
+	headerBodySizeOffset        = 18
+	headerContentTypeOffset     = 26
+	headerEndpointOffset        = headerContentTypeOffset + HeaderContentTypeSize
+	headerAcceptOffset          = headerEndpointOffset + HeaderEndpointSize
+	headerEndpointVersionOffset = headerAcceptOffset + HeaderAcceptSize
+	headerPriorityOffset        = headerEndpointVersionOffset + 4
+	headerChecksumOffset        = headerPriorityOffset + 1
 )
 
+// endpointIDMarker is the first byte of an endpoint field holding an endpoint ID
+// rather than a name; the ID follows it as a little-endian uint32. Names cannot
+// start with it: Validate rejects them and the server refuses to register them.
+const endpointIDMarker = 0x01
+
+// checkEndpointIDMarker is used to reject endpoint names that would be read as
+// an endpoint ID on the wire.
+func checkEndpointIDMarker(name string) error {
+	if len(name) > 0 && name[0] == endpointIDMarker {
+		return errors.Wrapf(ErrInvalidEndpointName, "%q starts with the endpoint ID marker", name)
+	}
+	return nil
+}
+
 // Constants describing endpoint types for the purposes of request routing.
+// EndpointStreamEnd is only ever sent by a server; it marks the final frame of a
+// multi-frame response, and its body carries the response's trailer.
+// EndpointError is also only sent by a server, in place of a response to a
+// request it rejected; its body carries the reason. EndpointOneWay is a request
+// that the server answers with nothing at all, not even an error.
+// EndpointCancel is only sent by a client, while it waits for the response to a
+// request; it asks the server to cancel that request (see Client.Cancel).
+// EndpointRedirect is only sent by a server, in place of a response; its body
+// tells the client where to send the request instead (see Redirect).
+// EndpointHello is exchanged at the start of a connection, to negotiate its
+// options (see Client.Handshake).
 const (
-	EndpointRequest = 0
-	EndpointStream  = 1
+	EndpointRequest   = 0
+	EndpointStream    = 1
+	EndpointStreamEnd = 2
+	EndpointError     = 3
+	EndpointOneWay    = 4
+	EndpointCancel    = 5
+	EndpointRedirect  = 6
+	EndpointHello     = 7
 )
 
 // Metadata is used to represent the header metadata extracted from a request.
@@ -37,55 +121,172 @@ type Metadata struct {
 	BodySize int64
 
 	// Timeout, which allows the client to instruct the server to cancel an
-	// operation if it takes over this amount of time.
+	// operation if it takes over this amount of time. Client.Send also gives up
+	// waiting for the response after it.
 	Timeout time.Duration
 
-	// Endpoint, the name of the handler that should process this request.
+	// Endpoint, the name of the handler that should process this request. It
+	// may be at most `HeaderEndpointSize` bytes long.
 	Endpoint string
 
+	// EndpointID, the ID the server assigned to the endpoint (see
+	// Server.EndpointIDs), which can be sent instead of its name. When it is
+	// not zero, it takes the place of the name in the header and Endpoint is
+	// not sent; the server fills Endpoint in with the name before dispatching.
+	// Only request endpoints have IDs. The header keeps its size either way.
+	EndpointID uint32
+
+	// EndpointVersion, the version of the endpoint's contract the request is
+	// written for, such as the schema of its body, which lets a server serve
+	// several versions of an endpoint side by side (see
+	// Server.AddRequestEndpointVersioned). Zero means no version in particular.
+	EndpointVersion uint32
+
+	// Priority, how urgent the request is compared to others, higher values
+	// being more urgent. Zero is the default priority. The server does not
+	// schedule requests by it, since every connection is served in order, but
+	// it is available to endpoints and middleware, such as to shed low-priority
+	// work under load.
+	Priority byte
+
 	// ContentType, the name of the content type described in the request. This
-	// is mostly informational for the endpoints' use, and is optional.
+	// is mostly informational for the endpoints' use, and is optional. It may be
+	// at most `HeaderContentTypeSize` bytes long, including any parameters.
 	ContentType string
+
+	// Accept, a comma-separated list of the content types the client is willing
+	// to receive in the response, in the style of HTTP's Accept header. This is
+	// used for content negotiation (see Negotiate), and is optional. It may be
+	// at most `HeaderAcceptSize` bytes long.
+	Accept string
+}
+
+// MetadataOption is used to set optional fields when building metadata with
+// NewStreamMetadata.
+type MetadataOption func(m *Metadata)
+
+// WithUserID sets the user ID of the metadata.
+func WithUserID(id int64) MetadataOption {
+	return func(m *Metadata) { m.UserID = id }
+}
+
+// WithTimeout sets the timeout of the metadata.
+func WithTimeout(d time.Duration) MetadataOption {
+	return func(m *Metadata) { m.Timeout = d }
+}
+
+// WithPriority sets the priority of the metadata.
+func WithPriority(priority byte) MetadataOption {
+	return func(m *Metadata) { m.Priority = priority }
+}
+
+// WithContentType sets the content type of the metadata.
+func WithContentType(contentType string) MetadataOption {
+	return func(m *Metadata) { m.ContentType = contentType }
+}
+
+// WithAccept sets the accepted content types of the metadata.
+func WithAccept(accept string) MetadataOption {
+	return func(m *Metadata) { m.Accept = accept }
+}
+
+// NewStreamMetadata is used to build the header that opens a streaming
+// endpoint. It returns an error instead of metadata that would be sent
+// malformed, such as an endpoint name that is empty or too long.
+func NewStreamMetadata(endpoint string, opts ...MetadataOption) (Metadata, error) {
+	m := Metadata{EndpointType: EndpointStream, Endpoint: endpoint}
+
+	for _, opt := range opts {
+		opt(&m)
+	}
+	if endpoint == "" {
+		return Metadata{}, errors.Wrap(ErrInvalidEndpointName, "empty name")
+	}
+	for _, r := range endpoint {
+		if r < ' ' || r == 0x7f {
+			return Metadata{}, errors.Wrapf(ErrInvalidEndpointName, "%q contains control characters", endpoint)
+		}
+	}
+	if err := m.Validate(); err != nil {
+		return Metadata{}, err
+	}
+	return m, nil
+}
+
+// Validate is used to make sure the metadata can be encoded without losing
+// information. Encode silently truncates string fields that are too long for
+// their slot in the header, which could then be misinterpreted by the peer, and
+// drops endpoint names starting with the endpoint ID marker.
+func (m Metadata) Validate() error {
+	if m.EndpointID == 0 {
+		if err := checkEndpointIDMarker(m.Endpoint); err != nil {
+			return err
+		}
+	}
+	if len(m.Endpoint) > HeaderEndpointSize {
+		return errors.Wrapf(ErrEndpointTooLong, "%d bytes, limit is %d", len(m.Endpoint), HeaderEndpointSize)
+	}
+	if len(m.ContentType) > HeaderContentTypeSize {
+		return errors.Wrapf(ErrContentTypeTooLong, "%d bytes, limit is %d", len(m.ContentType), HeaderContentTypeSize)
+	}
+	if len(m.Accept) > HeaderAcceptSize {
+		return errors.Wrapf(ErrAcceptTooLong, "%d bytes, limit is %d", len(m.Accept), HeaderAcceptSize)
+	}
+	return nil
+}
+
+// SafeEncode is like Encode, but it returns an error instead of truncating
+// fields that are too long.
+func (m Metadata) SafeEncode() ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m.Encode(), nil
 }
 
 // Encode is used to encode the metadata into a byte slice that can be used on
-// the wire.
+// the wire. An endpoint name starting with the endpoint ID marker is left out,
+// so that the peer does not mistake it for an endpoint ID; use SafeEncode to
+// have it rejected with ErrInvalidEndpointName instead.
 func (m Metadata) Encode() []byte {
-	b := make([]byte, headerSize)
+	b := make([]byte, HeaderSize)
 	ib := make([]byte, 8)
 
-	b[0] = m.EndpointType
+	b[headerVersionOffset] = protocolVersion
+	b[headerTypeOffset] = m.EndpointType
 
 	binary.LittleEndian.PutUint64(ib, uint64(m.UserID))
 
 	for i, bb := range ib {
-		b[i+1] = bb
+		b[i+headerUserIDOffset] = bb
 		ib[i] = '\x00'
 	}
 	binary.LittleEndian.PutUint64(ib, uint64(m.Timeout/time.Millisecond))
 
 	for i, bb := range ib {
-		b[i+9] = bb
+		b[i+headerTimeoutOffset] = bb
 		ib[i] = '\x00'
 	}
 	binary.LittleEndian.PutUint64(ib, uint64(m.BodySize))
 
 	for i, bb := range ib {
-		b[i+17] = bb
+		b[i+headerBodySizeOffset] = bb
 		ib[i] = '\x00'
 	}
-	for i, c := range m.ContentType {
-		if i >= headerContentTypeSize {
-			break
-		}
-		b[i+25] = byte(c)
-	}
-	for i, c := range m.Endpoint {
-		if i >= headerEndpointSize {
-			break
-		}
-		b[i+125] = byte(c)
+	// The strings are copied byte for byte, so that multi-byte characters
+	// survive; copy stops at the end of each field, truncating what is left.
+	copy(b[headerContentTypeOffset:headerEndpointOffset], m.ContentType)
+	if m.EndpointID != 0 {
+		b[headerEndpointOffset] = endpointIDMarker
+		binary.LittleEndian.PutUint32(b[headerEndpointOffset+1:], m.EndpointID)
+	} else if checkEndpointIDMarker(m.Endpoint) == nil {
+		copy(b[headerEndpointOffset:headerAcceptOffset], m.Endpoint)
 	}
+	copy(b[headerAcceptOffset:headerEndpointVersionOffset], m.Accept)
+	binary.LittleEndian.PutUint32(b[headerEndpointVersionOffset:], m.EndpointVersion)
+	b[headerPriorityOffset] = m.Priority
+	binary.LittleEndian.PutUint32(b[headerChecksumOffset:], crc32.ChecksumIEEE(b[:headerChecksumOffset]))
+
 	return b
 }
 
@@ -93,60 +294,205 @@ func (m Metadata) Encode() []byte {
 func DecodeMetadata(bytes []byte) (Metadata, error) {
 	m := Metadata{}
 
-	if len(bytes) < headerSize {
+	if len(bytes) < HeaderSize {
 		return m, io.EOF
 	}
-	m.EndpointType = bytes[0]
-	m.UserID = int64(binary.LittleEndian.Uint64(bytes[1:9]))
-	m.Timeout = time.Millisecond * time.Duration(binary.LittleEndian.Uint64(bytes[9:17]))
-	m.BodySize = int64(binary.LittleEndian.Uint64(bytes[17:25]))
-	m.ContentType = strings.Trim(string(bytes[25:25+headerContentTypeSize]), "\x00")
-	m.Endpoint = strings.Trim(string(bytes[125:headerSize]), "\x00")
+	if err := checkVersion(bytes[headerVersionOffset]); err != nil {
+		return m, err
+	}
+	if err := checkSum(crc32.ChecksumIEEE(bytes[:headerChecksumOffset]), bytes[headerChecksumOffset:HeaderSize]); err != nil {
+		return m, err
+	}
+	m.EndpointType = bytes[headerTypeOffset]
+	m.UserID = int64(binary.LittleEndian.Uint64(bytes[headerUserIDOffset:headerTimeoutOffset]))
+	m.Timeout = time.Millisecond * time.Duration(binary.LittleEndian.Uint64(bytes[headerTimeoutOffset:headerBodySizeOffset]))
+	m.BodySize = int64(binary.LittleEndian.Uint64(bytes[headerBodySizeOffset:headerContentTypeOffset]))
+	m.ContentType = decodeString(bytes[headerContentTypeOffset:headerEndpointOffset])
+	m.Endpoint, m.EndpointID = decodeEndpoint(bytes[headerEndpointOffset:headerAcceptOffset])
+	m.Accept = decodeString(bytes[headerAcceptOffset:headerEndpointVersionOffset])
+	m.EndpointVersion = binary.LittleEndian.Uint32(bytes[headerEndpointVersionOffset:headerPriorityOffset])
+	m.Priority = bytes[headerPriorityOffset]
 
 	return m, nil
 }
 
+// checkSum returns ErrHeaderChecksum unless sum matches the checksum field.
+func checkSum(sum uint32, field []byte) error {
+	if sum != binary.LittleEndian.Uint32(field) {
+		return ErrHeaderChecksum
+	}
+	return nil
+}
+
+// checkVersion returns ErrUnsupportedVersion unless version is protocolVersion.
+func checkVersion(version byte) error {
+	if version != protocolVersion {
+		return errors.Wrapf(ErrUnsupportedVersion, "version %d, want %d", version, protocolVersion)
+	}
+	return nil
+}
+
+// decodeString returns the string held in a header field, which ends at the
+// first null byte, if any: whatever follows it is padding. Only the string
+// itself is copied.
+func decodeString(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+// decodeEndpoint returns the endpoint name or ID held in the endpoint field.
+func decodeEndpoint(field []byte) (string, uint32) {
+	if field[0] == endpointIDMarker {
+		return "", binary.LittleEndian.Uint32(field[1:5])
+	}
+	return decodeString(field), 0
+}
+
+// DecodeMetadataBufio is used to fetch metadata from a buffered reader. It is
+// the recommended way to decode headers from a stream: the header is read
+// whole, however the underlying reader splits it up, and it is decoded straight
+// from the reader's buffer when it fits.
+func DecodeMetadataBufio(r *bufio.Reader) (Metadata, error) {
+	header, err := r.Peek(HeaderSize)
+
+	if err == bufio.ErrBufferFull { // The buffer is smaller than a header.
+		header = make([]byte, HeaderSize)
+
+		if _, err = io.ReadFull(r, header); err != nil {
+			return Metadata{}, err
+		}
+		return DecodeMetadata(header)
+	}
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return Metadata{}, err
+	}
+	m, err := DecodeMetadata(header)
+
+	if _, derr := r.Discard(HeaderSize); err == nil {
+		err = derr
+	}
+	return m, err
+}
+
 // DecodeMetadataReader is used to fetch metadata from a given io.Reader.
+//
+// Deprecated: DecodeMetadataBufio decodes the header in one go, and should be
+// used instead.
 func DecodeMetadataReader(r io.Reader) (Metadata, error) {
 	var (
 		err  error
 		m    Metadata
 		bbuf = make([]byte, 1)
 		nbuf = make([]byte, 8)
-		sbuf = make([]byte, headerEndpointSize)
+		sbuf = make([]byte, HeaderEndpointSize)
+		sum  = crc32.NewIEEE()
 	)
-	if _, err = r.Read(bbuf); err != nil {
+	fields := io.TeeReader(r, sum) // Everything but the checksum itself.
+
+	if _, err = io.ReadFull(fields, bbuf); err != nil {
+		return m, err
+	}
+	if err = checkVersion(bbuf[0]); err != nil {
+		return m, err
+	}
+	if _, err = io.ReadFull(fields, bbuf); err != nil {
 		return m, err
 	}
 	m.EndpointType = bbuf[0]
 
-	if _, err = r.Read(nbuf); err != nil {
+	if _, err = io.ReadFull(fields, nbuf); err != nil {
 		return m, err
 	}
 	m.UserID = int64(binary.LittleEndian.Uint64(nbuf))
 
-	if _, err = r.Read(nbuf); err != nil {
+	if _, err = io.ReadFull(fields, nbuf); err != nil {
 		return m, err
 	}
 	m.Timeout = time.Millisecond * time.Duration(binary.LittleEndian.Uint64(nbuf))
 
-	if _, err = r.Read(nbuf); err != nil {
+	if _, err = io.ReadFull(fields, nbuf); err != nil {
 		return m, err
 	}
 	m.BodySize = int64(binary.LittleEndian.Uint64(nbuf))
 
-	if _, err = r.Read(sbuf); err != nil {
+	if _, err = io.ReadFull(fields, sbuf); err != nil {
 		return m, err
 	}
-	m.ContentType = strings.Trim(string(sbuf), "\x00")
+	m.ContentType = decodeString(sbuf)
 
-	for i := range sbuf { // Reset the string buffer for added safety.
-		sbuf[i] = 0
+	if _, err = io.ReadFull(fields, sbuf); err != nil {
+		return m, err
 	}
-	if _, err = r.Read(sbuf); err != nil {
+	m.Endpoint, m.EndpointID = decodeEndpoint(sbuf)
+
+	if _, err = io.ReadFull(fields, sbuf); err != nil {
 		return m, err
 	}
-	m.Endpoint = strings.Trim(string(sbuf), "\x00")
+	m.Accept = decodeString(sbuf)
 
+	if _, err = io.ReadFull(fields, nbuf[:4]); err != nil {
+		return m, err
+	}
+	m.EndpointVersion = binary.LittleEndian.Uint32(nbuf[:4])
+
+	if _, err = io.ReadFull(fields, bbuf); err != nil {
+		return m, err
+	}
+	m.Priority = bbuf[0]
+
+	if _, err = io.ReadFull(r, nbuf[:4]); err != nil {
+		return m, err
+	}
+	if err = checkSum(sum.Sum32(), nbuf[:4]); err != nil {
+		return Metadata{}, err
+	}
 	return m, nil
 }
+
+// Accepts reports whether the client is willing to receive the given content
+// type. Entries in Accept may use wildcards such as "*/*" or "text/*", and any
+// parameters (such as ";q=0.5") are ignored. When Accept is empty, only the
+// request's own ContentType is considered acceptable.
+func (m Metadata) Accepts(contentType string) bool {
+	if m.Accept == "" {
+		return contentType == m.ContentType
+	}
+	for _, accepted := range strings.Split(m.Accept, ",") {
+		if i := strings.IndexByte(accepted, ';'); i >= 0 {
+			accepted = accepted[:i]
+		}
+		accepted = strings.TrimSpace(accepted)
+
+		switch {
+		case accepted == "*/*", accepted == contentType:
+			return true
+		case strings.HasSuffix(accepted, "/*"):
+			if strings.HasPrefix(contentType, strings.TrimSuffix(accepted, "*")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Negotiate is used to choose the content type of a response. The offers are
+// the content types the server can produce, in order of preference; the first
+// one the client accepts is returned. If Accept is empty, the request's
+// ContentType is returned so the response mirrors the request. If none of the
+// offers are acceptable, an empty string is returned.
+func (m Metadata) Negotiate(offers ...string) string {
+	if m.Accept == "" {
+		return m.ContentType
+	}
+	for _, offer := range offers {
+		if m.Accepts(offer) {
+			return offer
+		}
+	}
+	return ""
+}
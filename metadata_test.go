@@ -1,12 +1,17 @@
 package srv
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"reflect"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const MaxUint = ^uint(0)
@@ -33,7 +38,7 @@ func bigString(size int) string {
 // Warning; this doesn't sanitize the endpoint to make sure that it is not too
 // large.
 func makeHeader(endpointType byte, userID, timeout, size int64, contentType, endpoint string) []byte {
-	b := make([]byte, headerSize)
+	b := make([]byte, HeaderSize)
 	ub := make([]byte, 8)
 	tb := make([]byte, 8)
 	sb := make([]byte, 8)
@@ -42,23 +47,32 @@ func makeHeader(endpointType byte, userID, timeout, size int64, contentType, end
 	binary.LittleEndian.PutUint64(tb, uint64(timeout))
 	binary.LittleEndian.PutUint64(sb, uint64(size))
 
-	b[0] = endpointType
+	b[1] = endpointType
 
 	for i, bb := range ub {
-		b[i+1] = bb
+		b[i+2] = bb
 	}
 	for i, bb := range tb {
-		b[i+9] = bb
+		b[i+10] = bb
 	}
 	for i, bb := range sb {
-		b[i+17] = bb
+		b[i+18] = bb
 	}
 	for i, bb := range []byte(contentType) {
-		b[i+25] = bb
+		b[i+26] = bb
 	}
 	for i, bb := range []byte(endpoint) {
-		b[i+125] = bb
+		b[i+126] = bb
 	}
+	return sealHeader(b)
+}
+
+// sealHeader sets the version and checksum of a header, such as one modified by
+// a test.
+func sealHeader(b []byte) []byte {
+	b[headerVersionOffset] = protocolVersion
+	binary.LittleEndian.PutUint32(b[headerChecksumOffset:], crc32.ChecksumIEEE(b[:headerChecksumOffset]))
+
 	return b
 }
 
@@ -71,7 +85,7 @@ func TestDecodeMetadataReader(t *testing.T) {
 	}{
 		{
 			"Empty header",
-			bytes.NewBuffer(emptySlice(headerSize)),
+			bytes.NewBuffer(makeHeader(0, 0, 0, 0, "", "")),
 			Metadata{},
 			false,
 		},
@@ -87,6 +101,36 @@ func TestDecodeMetadataReader(t *testing.T) {
 			Metadata{EndpointType: 1, UserID: MaxInt, Timeout: 1972348976 * time.Millisecond, BodySize: 9817263487916234, ContentType: "text/plain", Endpoint: "foo"},
 			false,
 		},
+		{
+			"Populated accept",
+			bytes.NewBuffer(withAccept(makeHeader(0, 123, 456, 789, "application/x-gob", "foo"), "application/json")),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "application/x-gob", Endpoint: "foo", Accept: "application/json"},
+			false,
+		},
+		{
+			"Endpoint version",
+			bytes.NewBuffer(withEndpointVersion(makeHeader(0, 123, 456, 789, "text/plain", "foo"), 70000)),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", EndpointVersion: 70000},
+			false,
+		},
+		{
+			"Priority",
+			bytes.NewBuffer(withPriority(makeHeader(0, 123, 456, 789, "text/plain", "foo"), 255)),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", Priority: 255},
+			false,
+		},
+		{
+			"Short reads",
+			iotest.OneByteReader(bytes.NewBuffer(makeHeader(0, 123, 456, 789, "text/plain", "foo"))),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo"},
+			false,
+		},
+		{
+			"Truncated header",
+			bytes.NewBuffer(makeHeader(0, 123, 456, 789, "text/plain", "foo")[:HeaderSize-1]),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo"},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -112,6 +156,70 @@ func TestDecodeMetadataReader(t *testing.T) {
 	}
 }
 
+func TestDecodeMetadataBufio(t *testing.T) {
+	first := withAccept(makeHeader(0, 123, 456, 789, "text/plain", "foo"), "application/json")
+	second := makeHeader(1, 1, 2, 3, "application/x-gob", "bar")
+	both := append(append([]byte{}, first...), second...)
+	want := []Metadata{
+		{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", Accept: "application/json"},
+		{EndpointType: 1, UserID: 1, Timeout: 2 * time.Millisecond, BodySize: 3, ContentType: "application/x-gob", Endpoint: "bar"},
+	}
+
+	tests := []struct {
+		name    string
+		reader  *bufio.Reader
+		want    []Metadata
+		wantErr error
+	}{
+		{"Whole headers", bufio.NewReader(bytes.NewReader(both)), want, io.EOF},
+		{"Short reads", bufio.NewReader(iotest.OneByteReader(bytes.NewReader(both))), want, io.EOF},
+		{"Buffer smaller than a header", bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(both)), 16), want, io.EOF},
+		{"Truncated header", bufio.NewReader(bytes.NewReader(both[:HeaderSize+10])), want[:1], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got []Metadata
+
+			for {
+				metadata, err := DecodeMetadataBufio(tt.reader)
+
+				if err != nil {
+					if err != tt.wantErr {
+						t.Errorf("error = %v, want %v", err, tt.wantErr)
+					}
+					break
+				}
+				got = append(got, metadata)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadata = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// withAccept sets the accept field of a header built by makeHeader.
+func withAccept(header []byte, accept string) []byte {
+	copy(header[headerAcceptOffset:headerEndpointVersionOffset], accept)
+	return sealHeader(header)
+}
+
+// withEndpointVersion sets the endpoint version of a header built by makeHeader.
+func withEndpointVersion(header []byte, version uint32) []byte {
+	binary.LittleEndian.PutUint32(header[headerEndpointVersionOffset:], version)
+	return sealHeader(header)
+}
+
+// withPriority sets the priority of a header built by makeHeader.
+func withPriority(header []byte, priority byte) []byte {
+	header[headerPriorityOffset] = priority
+	return sealHeader(header)
+}
+
 func TestDecodeMetadata(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -121,10 +229,16 @@ func TestDecodeMetadata(t *testing.T) {
 	}{
 		{
 			"Empty header",
-			emptySlice(headerSize),
+			makeHeader(0, 0, 0, 0, "", ""),
 			Metadata{},
 			false,
 		},
+		{
+			"Missing checksum",
+			emptySlice(HeaderSize),
+			Metadata{},
+			true,
+		},
 		{
 			"Populated header 1",
 			makeHeader(0, 123, 456, 789, "text/plain", "foo"),
@@ -137,6 +251,30 @@ func TestDecodeMetadata(t *testing.T) {
 			Metadata{EndpointType: 1, UserID: MaxInt, Timeout: 1972348976 * time.Millisecond, BodySize: 9817263487916234, ContentType: "text/plain", Endpoint: "foo"},
 			false,
 		},
+		{
+			"Populated accept",
+			withAccept(makeHeader(0, 123, 456, 789, "application/x-gob", "foo"), "application/json"),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "application/x-gob", Endpoint: "foo", Accept: "application/json"},
+			false,
+		},
+		{
+			"Endpoint ID",
+			makeHeader(0, 123, 456, 789, "text/plain", "\x01\x00\x01"),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", EndpointID: 256},
+			false,
+		},
+		{
+			"Endpoint version",
+			withEndpointVersion(makeHeader(0, 123, 456, 789, "text/plain", "foo"), 2),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", EndpointVersion: 2},
+			false,
+		},
+		{
+			"Priority",
+			withPriority(makeHeader(0, 123, 456, 789, "text/plain", "foo"), 3),
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", Priority: 3},
+			false,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -162,6 +300,118 @@ func TestDecodeMetadata(t *testing.T) {
 	}
 }
 
+// metadataDecoders are the ways to decode a header, which must all agree.
+var metadataDecoders = []struct {
+	name   string
+	decode func([]byte) (Metadata, error)
+}{
+	{"DecodeMetadata", DecodeMetadata},
+	{"DecodeMetadataReader", func(b []byte) (Metadata, error) {
+		return DecodeMetadataReader(bytes.NewReader(b))
+	}},
+	{"DecodeMetadataBufio", func(b []byte) (Metadata, error) {
+		return DecodeMetadataBufio(bufio.NewReader(bytes.NewReader(b)))
+	}},
+}
+
+func TestDecodeMetadataUnsupportedVersion(t *testing.T) {
+	header := makeHeader(0, 123, 456, 789, "text/plain", "foo")
+	header[headerVersionOffset] = protocolVersion + 1
+	binary.LittleEndian.PutUint32(header[headerChecksumOffset:], crc32.ChecksumIEEE(header[:headerChecksumOffset]))
+
+	for _, tt := range metadataDecoders {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			metadata, err := tt.decode(header)
+
+			if errors.Cause(err) != ErrUnsupportedVersion {
+				t.Errorf("error = %v, want %v", err, ErrUnsupportedVersion)
+			}
+			if metadata != (Metadata{}) {
+				t.Errorf("metadata = %#v, want none", metadata)
+			}
+		})
+	}
+}
+
+func TestDecodeMetadataEmbeddedNulls(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   Metadata
+	}{
+		{
+			"trailing content",
+			makeHeader(0, 0, 0, 0, "text/plain\x00junk", "foo\x00bar"),
+			Metadata{ContentType: "text/plain", Endpoint: "foo"},
+		},
+		{
+			"leading null",
+			makeHeader(0, 0, 0, 0, "\x00text/plain", "\x00foo"),
+			Metadata{},
+		},
+		{
+			"accept",
+			withAccept(makeHeader(0, 0, 0, 0, "", "foo"), "application/json\x00text/plain"),
+			Metadata{Endpoint: "foo", Accept: "application/json"},
+		},
+	}
+	for _, tt := range tests {
+		for _, decoder := range metadataDecoders {
+			tt, decoder := tt, decoder
+
+			t.Run(tt.name+"/"+decoder.name, func(t *testing.T) {
+				t.Parallel()
+
+				metadata, err := decoder.decode(tt.header)
+
+				if err != nil {
+					t.Fatalf("Should not return an error, got %v", err)
+				}
+				if metadata != tt.want {
+					t.Errorf("metadata = %#v, want %#v", metadata, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeMetadataChecksum(t *testing.T) {
+	header := withAccept(makeHeader(1, 123, 456, 789, "text/plain", "foo"), "application/json")
+
+	for _, tt := range metadataDecoders {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Every bit of the header is covered, including the checksum. The
+			// version is checked first, so a flipped bit in it is reported as
+			// an unsupported version instead.
+			for bit := 0; bit < HeaderSize*8; bit++ {
+				corrupted := append([]byte{}, header...)
+				corrupted[bit/8] ^= 1 << (bit % 8)
+
+				metadata, err := tt.decode(corrupted)
+				want := ErrHeaderChecksum
+
+				if bit/8 == headerVersionOffset {
+					want = ErrUnsupportedVersion
+				}
+				if errors.Cause(err) != want {
+					t.Fatalf("bit %d: error = %v, want %v", bit, err, want)
+				}
+				if metadata != (Metadata{}) {
+					t.Fatalf("bit %d: metadata = %#v, want none", bit, metadata)
+				}
+			}
+		})
+	}
+}
+
 func TestMetadataEncode(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -171,7 +421,7 @@ func TestMetadataEncode(t *testing.T) {
 		{
 			"Empty metadata",
 			Metadata{},
-			emptySlice(headerSize),
+			makeHeader(0, 0, 0, 0, "", ""),
 		},
 		{
 			"Populated metadata 1",
@@ -186,7 +436,22 @@ func TestMetadataEncode(t *testing.T) {
 		{
 			"Truncated string",
 			Metadata{EndpointType: 1, UserID: MaxInt, Timeout: 1098374 * time.Millisecond, BodySize: 7613947812643, ContentType: "text/plain", Endpoint: bigString(500)},
-			makeHeader(1, MaxInt, 1098374, 7613947812643, "text/plain", bigString(headerEndpointSize)),
+			makeHeader(1, MaxInt, 1098374, 7613947812643, "text/plain", bigString(HeaderEndpointSize)),
+		},
+		{
+			"Populated accept",
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "application/x-gob", Endpoint: "foo", Accept: "application/json"},
+			withAccept(makeHeader(0, 123, 456, 789, "application/x-gob", "foo"), "application/json"),
+		},
+		{
+			"Endpoint version",
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", EndpointVersion: 2},
+			withEndpointVersion(makeHeader(0, 123, 456, 789, "text/plain", "foo"), 2),
+		},
+		{
+			"Priority",
+			Metadata{UserID: 123, Timeout: 456 * time.Millisecond, BodySize: 789, ContentType: "text/plain", Endpoint: "foo", Priority: 3},
+			withPriority(makeHeader(0, 123, 456, 789, "text/plain", "foo"), 3),
 		},
 	}
 	for _, tt := range tests {
@@ -204,6 +469,117 @@ func TestMetadataEncode(t *testing.T) {
 	}
 }
 
+func TestMetadataSafeEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata Metadata
+		wantErr  error
+	}{
+		{"empty metadata", Metadata{}, nil},
+		{"content type at limit", Metadata{ContentType: bigString(HeaderContentTypeSize)}, nil},
+		{"content type over limit", Metadata{ContentType: bigString(HeaderContentTypeSize + 1)}, ErrContentTypeTooLong},
+		{"endpoint at limit", Metadata{Endpoint: bigString(HeaderEndpointSize)}, nil},
+		{"endpoint over limit", Metadata{Endpoint: bigString(HeaderEndpointSize + 1)}, ErrEndpointTooLong},
+		{"accept over limit", Metadata{Accept: bigString(HeaderAcceptSize + 1)}, ErrAcceptTooLong},
+		{"endpoint ID marker", Metadata{Endpoint: "\x01\x02\x00\x00\x00"}, ErrInvalidEndpointName},
+		{"endpoint ID with marker name", Metadata{Endpoint: "\x01echo", EndpointID: 2}, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			header, err := tt.metadata.SafeEncode()
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(header, tt.metadata.Encode()) {
+				t.Errorf("header = %#v, want %#v", header, tt.metadata.Encode())
+			}
+			decoded, _ := DecodeMetadata(header)
+
+			if decoded.ContentType != tt.metadata.ContentType {
+				t.Errorf("content type = %v, want %v", decoded.ContentType, tt.metadata.ContentType)
+			}
+		})
+	}
+}
+
+func TestNewStreamMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		opts     []MetadataOption
+		want     Metadata
+		wantErr  error
+	}{
+		{"plain", "message", nil, Metadata{EndpointType: EndpointStream, Endpoint: "message"}, nil},
+		{
+			"with options",
+			"message",
+			[]MetadataOption{WithUserID(7), WithTimeout(time.Second), WithContentType("text/plain"), WithAccept("text/plain"), WithPriority(9)},
+			Metadata{EndpointType: EndpointStream, Endpoint: "message", UserID: 7, Timeout: time.Second, ContentType: "text/plain", Accept: "text/plain", Priority: 9},
+			nil,
+		},
+		{"endpoint at limit", bigString(HeaderEndpointSize), nil, Metadata{EndpointType: EndpointStream, Endpoint: bigString(HeaderEndpointSize)}, nil},
+		{"endpoint over limit", bigString(HeaderEndpointSize + 1), nil, Metadata{}, ErrEndpointTooLong},
+		{"empty endpoint", "", nil, Metadata{}, ErrInvalidEndpointName},
+		{"control characters", "mess\x00age", nil, Metadata{}, ErrInvalidEndpointName},
+		{"content type over limit", "message", []MetadataOption{WithContentType(bigString(HeaderContentTypeSize + 1))}, Metadata{}, ErrContentTypeTooLong},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := NewStreamMetadata(tt.endpoint, tt.opts...)
+
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadata = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataNegotiate(t *testing.T) {
+	serverPrefers := []string{"application/x-gob", "application/json"}
+
+	tests := []struct {
+		name     string
+		metadata Metadata
+		offers   []string
+		want     string
+	}{
+		{"accept unset", Metadata{ContentType: "application/x-gob"}, serverPrefers, "application/x-gob"},
+		{"accepts only json", Metadata{ContentType: "application/x-gob", Accept: "application/json"}, serverPrefers, "application/json"},
+		{"accepts both", Metadata{Accept: "application/json, application/x-gob"}, serverPrefers, "application/x-gob"},
+		{"parameters ignored", Metadata{Accept: "application/json;q=0.9"}, serverPrefers, "application/json"},
+		{"type wildcard", Metadata{Accept: "text/*"}, []string{"application/json", "text/plain"}, "text/plain"},
+		{"full wildcard", Metadata{Accept: "*/*"}, serverPrefers, "application/x-gob"},
+		{"nothing acceptable", Metadata{Accept: "text/csv"}, serverPrefers, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := tt.metadata.Negotiate(tt.offers...); got != tt.want {
+				t.Errorf("Negotiate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func BenchmarkMetadataEncode(b *testing.B) {
 	metadata := Metadata{
 		UserID:   118792346,
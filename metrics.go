@@ -0,0 +1,40 @@
+package srv
+
+import (
+	"time"
+)
+
+// Metrics receives an event for every endpoint invocation a server makes. The
+// metadata's EndpointType tells the two kinds of traffic apart, since their
+// lifetimes differ wildly: for request endpoints the duration covers reading
+// the body, running the handler and writing the response, while for streaming
+// endpoints it is the lifetime of the stream, reported at teardown. The error
+// is the one the invocation ended with, if any.
+type Metrics interface {
+	Observe(meta Metadata, duration time.Duration, err error)
+}
+
+// EndpointTypeName returns a human-readable label for an endpoint type, such
+// as "request" or "stream", suitable for logs and metric labels.
+func EndpointTypeName(endpointType byte) string {
+	switch endpointType {
+	case EndpointRequest:
+		return "request"
+	case EndpointStream:
+		return "stream"
+	case EndpointStreamEnd:
+		return "stream end"
+	case EndpointError:
+		return "error"
+	case EndpointOneWay:
+		return "one-way"
+	case EndpointCancel:
+		return "cancel"
+	case EndpointRedirect:
+		return "redirect"
+	case EndpointHello:
+		return "hello"
+	default:
+		return "unknown"
+	}
+}
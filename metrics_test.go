@@ -0,0 +1,91 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type metricsEvent struct {
+	meta     Metadata
+	duration time.Duration
+	err      error
+}
+
+// recordingMetrics is a Metrics implementation that records every event.
+type recordingMetrics struct {
+	mu     sync.Mutex
+	events []metricsEvent
+}
+
+func (m *recordingMetrics) Observe(meta Metadata, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, metricsEvent{meta, duration, err})
+}
+
+func (m *recordingMetrics) snapshot() []metricsEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]metricsEvent(nil), m.events...)
+}
+
+func TestServerMetrics(t *testing.T) {
+	metrics := &recordingMetrics{}
+	lifetime := 20 * time.Millisecond
+	closed := make(chan struct{})
+
+	s := newEchoServer()
+	s.Metrics = metrics
+	s.OnConnClose = func(conn net.Conn, reason error) { closed <- struct{}{} }
+	s.AddStreamingEndpoint("stream", func(ctx context.Context, meta Metadata, client *Client) error {
+		time.Sleep(lifetime)
+		return client.Close()
+	})
+
+	client := s.NewInMemoryClient()
+	client.WriteDataString("echo", "hello")
+	client.ReadData()
+	client.WriteMeta(Metadata{EndpointType: EndpointStream, Endpoint: "stream"})
+	io.Copy(io.Discard, client)
+	client.Close()
+	<-closed
+
+	events := metrics.snapshot()
+
+	if len(events) != 2 {
+		t.Fatalf("events = %v, want 2", len(events))
+	}
+	if got := events[0].meta.EndpointType; got != EndpointRequest {
+		t.Errorf("first event type = %v, want %v", EndpointTypeName(got), "request")
+	}
+	if got := events[1].meta.EndpointType; got != EndpointStream {
+		t.Errorf("second event type = %v, want %v", EndpointTypeName(got), "stream")
+	}
+	if events[1].duration < lifetime {
+		t.Errorf("stream duration = %v, want at least %v", events[1].duration, lifetime)
+	}
+}
+
+func TestEndpointTypeName(t *testing.T) {
+	tests := []struct {
+		endpointType byte
+		want         string
+	}{
+		{EndpointRequest, "request"},
+		{EndpointStream, "stream"},
+		{EndpointStreamEnd, "stream end"},
+		{EndpointHello, "hello"},
+		{42, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := EndpointTypeName(tt.endpointType); got != tt.want {
+			t.Errorf("EndpointTypeName(%v) = %v, want %v", tt.endpointType, got, tt.want)
+		}
+	}
+}
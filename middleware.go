@@ -0,0 +1,93 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a request endpoint to add behavior around it, such as
+// logging or authentication. See Server.Use.
+type Middleware func(endpoint RequestEndpoint) RequestEndpoint
+
+// Logger is used by the middleware in this package to write log lines. It is
+// satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LoggingMiddleware is used to write an access log line for every request,
+// with the endpoint, the user ID, the size of the request and response bodies,
+// how long the endpoint took, and whether it succeeded.
+func LoggingMiddleware(logger Logger) Middleware {
+	return func(endpoint RequestEndpoint) RequestEndpoint {
+		return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			start := time.Now()
+			cw := &countingWriter{w: w}
+			err := endpoint(ctx, meta, cw, r)
+			status := "ok"
+
+			if err != nil {
+				status = "error: " + err.Error()
+			}
+			logger.Printf("endpoint=%s user=%d in=%d out=%d duration=%v status=%q",
+				meta.Endpoint, meta.UserID, meta.BodySize, cw.n, time.Since(start), status)
+			return err
+		}
+	}
+}
+
+// countingWriter is a writer that keeps track of how many bytes went through
+// it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() io.Writer {
+	return w.w
+}
+
+// countingReader is the counterpart of countingWriter for readers.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// AcceptOnly is used to reject requests whose ContentType is not one of the
+// given types, before the endpoint runs. The client gets an error frame with
+// CodeUnsupportedMediaType. Parameters of the content type (such as
+// "; charset=utf-8") are ignored, and types may use wildcards such as "text/*".
+func AcceptOnly(types ...string) Middleware {
+	return func(endpoint RequestEndpoint) RequestEndpoint {
+		return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			contentType := meta.ContentType
+
+			if i := strings.IndexByte(contentType, ';'); i >= 0 {
+				contentType = contentType[:i]
+			}
+			contentType = strings.TrimSpace(contentType)
+
+			for _, t := range types {
+				if t == contentType || t == "*/*" ||
+					(strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*"))) {
+					return endpoint(ctx, meta, w, r)
+				}
+			}
+			return &Error{Code: CodeUnsupportedMediaType, Message: "unsupported content type " + meta.ContentType}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// capturingLogger is a Logger sending every line to a channel.
+type capturingLogger chan string
+
+func (l capturingLogger) Printf(format string, v ...interface{}) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		want     []string
+	}{
+		{"success", "echo", []string{"endpoint=echo", "user=7", "in=5", "out=5", "duration=", `status="ok"`}},
+		{"failure", "fail", []string{"endpoint=fail", "user=7", "in=5", "out=0", "duration=", `status="error: broken"`}},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := make(capturingLogger, 1)
+			s := newEchoServer()
+			s.AddRequestEndpoint("fail", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				return errors.New("broken")
+			})
+			s.Use(LoggingMiddleware(logger))
+
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			go client.Send(Request{Meta: Metadata{UserID: 7, Endpoint: tt.endpoint}, Body: []byte("hello")})
+
+			line := <-logger
+
+			for _, field := range tt.want {
+				if !strings.Contains(line, field) {
+					t.Errorf("log line %q does not contain %q", line, field)
+				}
+			}
+		})
+	}
+}
+
+func TestServerUse(t *testing.T) {
+	var calls []string
+
+	trace := func(name string) Middleware {
+		return func(endpoint RequestEndpoint) RequestEndpoint {
+			return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				calls = append(calls, name+" before")
+				err := endpoint(ctx, meta, w, r)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	s := NewInMemoryServer()
+	s.Use(trace("outer"), trace("inner"))
+	s.AddRequestEndpoint("echo", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		calls = append(calls, "endpoint")
+		_, err := io.Copy(w, r)
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	want := []string{"outer before", "inner before", "endpoint", "inner after", "outer after"}
+
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestAcceptOnly(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		wantOK      bool
+	}{
+		{"allowed", "application/json", true},
+		{"allowed with parameters", "application/json; charset=utf-8", true},
+		{"allowed by wildcard", "text/csv", true},
+		{"disallowed", "application/x-gob", false},
+		{"missing", "", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			called := false
+			s := NewInMemoryServer()
+			s.AddRequestEndpoint("upload", AcceptOnly("application/json", "text/*")(
+				func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+					called = true
+					_, err := io.Copy(w, r)
+					return err
+				},
+			))
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			req := Request{Meta: Metadata{Endpoint: "upload", ContentType: tt.contentType}, Body: []byte("{}")}
+			_, err := client.Send(req)
+
+			if tt.wantOK {
+				if err != nil || !called {
+					t.Errorf("error = %v, called = %v, want the endpoint to run", err, called)
+				}
+				return
+			}
+			var e *Error
+
+			if !errors.As(err, &e) || e.Code != CodeUnsupportedMediaType {
+				t.Fatalf("error = %v, want code %d", err, CodeUnsupportedMediaType)
+			}
+			if called {
+				t.Error("The endpoint ran for a rejected request")
+			}
+			// The rejection leaves the connection usable.
+			req.Meta.ContentType = "application/json"
+
+			if _, err = client.Send(req); err != nil {
+				t.Errorf("Follow-up request error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package srv
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// ProtocolPipe is used to listen and dial over Windows named pipes, the local
+// transport on Windows, where ProtocolUnix is not available. The URI is the path
+// of the pipe, such as `\\.\pipe\srv`.
+const ProtocolPipe = "pipe"
+
+func init() {
+	platformTransports[ProtocolPipe] = transport{
+		listen: func(uri string) (net.Listener, error) { return winio.ListenPipe(uri, nil) },
+		dial:   func(uri string) (net.Conn, error) { return winio.DialPipe(uri, nil) },
+	}
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package srv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServerNamedPipe(t *testing.T) {
+	path := fmt.Sprintf(`\\.\pipe\srv-test-%d`, os.Getpid())
+	s, err := NewServer(ProtocolPipe, path)
+
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	s.AddRequestEndpoint("echo", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+
+	listenErr := make(chan error, 1)
+
+	go func() { listenErr <- s.Listen() }()
+
+	client, err := NewClientRetry(ProtocolPipe, path, 10, 10*time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	if _, err = client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+		t.Errorf("body = %q, %v, want %q", body, err, "hello")
+	}
+	client.Close()
+	s.Shutdown()
+
+	if err := <-listenErr; err != nil {
+		t.Errorf("Listen error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,152 @@
+package srv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPoolClosed is returned by Pool.Get once the pool has been closed.
+var ErrPoolClosed = errors.New("pool closed")
+
+// DefaultPoolIdleTimeout is the IdleTimeout of pools created with NewPool. It is
+// shorter than DefaultMaxTimeout, after which servers close idle connections.
+const DefaultPoolIdleTimeout = DefaultMaxTimeout / 2
+
+// Pool is used to share connections to a server between goroutines, sparing
+// them from dialing for every request. Get hands out an idle connection if there
+// is one, and dials a new one otherwise, up to the maximum; Put returns it once
+// the caller is done with it. A connection must only be used by the goroutine
+// that got it, until it is put back.
+//
+// Connections on which a read or write failed, such as when the server went
+// away, are closed by Put instead of being kept, and so are closed ones. Idle
+// connections the server has closed in the meantime, such as once its
+// MaxTimeout elapsed, are noticed and closed by Get rather than handed out. A
+// connection left in the middle of a frame, or with a response left unread,
+// is not usable either; the caller should close it before putting it back.
+type Pool struct {
+	// MaxIdle, if greater than zero, is the largest number of idle connections
+	// kept for reuse. Connections put back past it are closed. Otherwise, every
+	// connection is kept.
+	MaxIdle int
+
+	// IdleTimeout, if greater than zero, is how long a connection may stay idle
+	// before it is closed instead of reused, such as to avoid connections the
+	// server or a proxy might have dropped in the meantime. It defaults to
+	// DefaultPoolIdleTimeout; setting it to 0 keeps idle connections for as
+	// long as they are open.
+	IdleTimeout time.Duration
+
+	protocol string
+	uri      string
+	max      int
+	mu       sync.Mutex
+	cond     *sync.Cond   // Signalled when a connection is put back or closed.
+	idle     []idleClient // The idle connections, the most recently used last.
+	open     int          // The connections dialed and not closed, idle or not.
+	closed   bool
+}
+
+// idleClient is a connection waiting in a Pool.
+type idleClient struct {
+	client *Client
+	since  time.Time
+}
+
+// NewPool is used to create a pool of connections to the server at the given
+// protocol and URI, with at most max connections open at once; Get waits for a
+// connection to be put back past that. A max of zero or less means there is no
+// limit.
+func NewPool(protocol, uri string, max int) *Pool {
+	p := &Pool{IdleTimeout: DefaultPoolIdleTimeout, protocol: protocol, uri: uri, max: max}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Get is used to take a connection from the pool, dialing a new one if none is
+// idle. If the pool already has its maximum number of connections open, it
+// waits for one to be put back.
+func (p *Pool) Get() (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil, ErrPoolClosed
+		}
+		if client := p.popIdle(); client != nil {
+			return client, nil
+		}
+		if p.max <= 0 || p.open < p.max {
+			break
+		}
+		p.cond.Wait()
+	}
+	p.open++
+	p.mu.Unlock()
+	client, err := NewClient(p.protocol, p.uri)
+	p.mu.Lock()
+
+	if err != nil {
+		p.open--
+		p.cond.Signal()
+		return nil, err
+	}
+	return client, nil
+}
+
+// popIdle is used to take the most recently used idle connection, closing the
+// ones that have been idle for too long or are no longer usable. The caller must
+// hold mu.
+func (p *Pool) popIdle() *Client {
+	for len(p.idle) > 0 {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if (p.IdleTimeout <= 0 || time.Since(last.since) < p.IdleTimeout) && last.client.idle() {
+			return last.client
+		}
+		p.open--
+		last.client.Close()
+	}
+	return nil
+}
+
+// Put is used to give a connection taken with Get back to the pool, once the
+// caller is done with it. It is kept for reuse unless it failed, was closed, or
+// there are already MaxIdle idle connections, in which case it is closed.
+func (p *Pool) Put(client *Client) {
+	if client == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	defer p.cond.Signal()
+
+	if p.closed || client.failed.Load() || client.isClosed() || (p.MaxIdle > 0 && len(p.idle) >= p.MaxIdle) {
+		p.open--
+		client.Close()
+		return
+	}
+	p.idle = append(p.idle, idleClient{client: client, since: time.Now()})
+}
+
+// Close is used to close the idle connections of the pool, and to make Get fail
+// from then on. Connections that are in use are closed when they are put back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	for _, idle := range p.idle {
+		p.open--
+		idle.client.Close()
+	}
+	p.idle = nil
+	p.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,226 @@
+package srv
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolReuse(t *testing.T) {
+	s := newEchoServer()
+	pool := NewPool(ProtocolTCP, listenOn(t, s), 3)
+
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				client, err := pool.Get()
+
+				if err != nil {
+					t.Errorf("Could not get a connection: %v", err)
+					return
+				}
+				resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+				if err != nil || string(resp.Body) != "hello" {
+					t.Errorf("body = %q, %v, want %q", resp.Body, err, "hello")
+				}
+				pool.Put(client)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := s.Stats().TotalConnections; got > 3 {
+		t.Errorf("connections = %d, want at most 3", got)
+	}
+}
+
+func TestPoolPut(t *testing.T) {
+	tests := []struct {
+		name      string
+		pool      func(p *Pool)
+		use       func(t *testing.T, client *Client)
+		wantReuse bool
+	}{
+		{"healthy", func(p *Pool) {}, func(t *testing.T, client *Client) {}, true},
+		{
+			"failed",
+			func(p *Pool) {},
+			func(t *testing.T, client *Client) {
+				client.conn.Close() // The connection dies under the client.
+
+				if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}}); err == nil {
+					t.Error("Should return an error")
+				}
+			},
+			false,
+		},
+		{"closed", func(p *Pool) {}, func(t *testing.T, client *Client) { client.Close() }, false},
+		{"idle timeout", func(p *Pool) { p.IdleTimeout = time.Millisecond }, func(t *testing.T, client *Client) {}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			pool := NewPool(ProtocolTCP, listenOn(t, s), 1)
+			tt.pool(pool)
+
+			defer pool.Close()
+
+			first, err := pool.Get()
+
+			if err != nil {
+				t.Fatalf("Could not get a connection: %v", err)
+			}
+			tt.use(t, first)
+			pool.Put(first)
+			time.Sleep(5 * time.Millisecond)
+
+			second, err := pool.Get()
+
+			if err != nil {
+				t.Fatalf("Could not get a connection: %v", err)
+			}
+			defer pool.Put(second)
+
+			if reused := second == first; reused != tt.wantReuse {
+				t.Errorf("reused = %t, want %t", reused, tt.wantReuse)
+			}
+			if resp, err := second.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hi")}); err != nil || string(resp.Body) != "hi" {
+				t.Errorf("body = %q, %v, want %q", resp.Body, err, "hi")
+			}
+		})
+	}
+}
+
+func TestPoolServerMaxTimeout(t *testing.T) {
+	s := newEchoServer()
+	s.MaxTimeout = 20 * time.Millisecond
+	pool := NewPool(ProtocolTCP, listenOn(t, s), 1)
+
+	defer pool.Close()
+
+	first, err := pool.Get()
+
+	if err != nil {
+		t.Fatalf("Could not get a connection: %v", err)
+	}
+	pool.Put(first)
+
+	// The server closes the idle connection once its MaxTimeout elapses.
+	time.Sleep(100 * time.Millisecond)
+
+	second, err := pool.Get()
+
+	if err != nil {
+		t.Fatalf("Could not get a connection: %v", err)
+	}
+	defer pool.Put(second)
+
+	if second == first {
+		t.Error("The connection closed by the server was handed out")
+	}
+	if resp, err := second.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hi")}); err != nil || string(resp.Body) != "hi" {
+		t.Errorf("body = %q, %v, want %q", resp.Body, err, "hi")
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	s := newEchoServer()
+	pool := NewPool(ProtocolTCP, listenOn(t, s), 0)
+	pool.MaxIdle = 1
+
+	defer pool.Close()
+
+	first, err := pool.Get()
+
+	if err != nil {
+		t.Fatalf("Could not get a connection: %v", err)
+	}
+	second, err := pool.Get()
+
+	if err != nil {
+		t.Fatalf("Could not get a connection: %v", err)
+	}
+	pool.Put(first)
+	pool.Put(second)
+
+	if !second.isClosed() {
+		t.Error("The connection past MaxIdle should be closed")
+	}
+	client, err := pool.Get()
+
+	if err != nil || client != first {
+		t.Errorf("client = %p, %v, want the idle connection", client, err)
+	}
+	pool.Put(client)
+}
+
+func TestPoolGetWaits(t *testing.T) {
+	s := newEchoServer()
+	pool := NewPool(ProtocolTCP, listenOn(t, s), 1)
+	first, err := pool.Get()
+
+	if err != nil {
+		t.Fatalf("Could not get a connection: %v", err)
+	}
+	got := make(chan *Client)
+
+	go func() {
+		client, _ := pool.Get()
+		got <- client
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("Get should wait while the pool is at its maximum")
+	case <-time.After(20 * time.Millisecond):
+	}
+	pool.Put(first)
+
+	select {
+	case client := <-got:
+		if client != first {
+			t.Error("The connection put back should be handed out")
+		}
+		pool.Put(client)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not return once a connection was put back")
+	}
+
+	// Closing the pool wakes up the callers waiting in Get.
+	first, _ = pool.Get()
+	errs := make(chan error)
+
+	go func() {
+		_, err := pool.Get()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pool.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrPoolClosed {
+			t.Errorf("error = %v, want %v", err, ErrPoolClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not return once the pool was closed")
+	}
+	pool.Put(first)
+
+	if !first.isClosed() {
+		t.Error("Connections put back in a closed pool should be closed")
+	}
+}
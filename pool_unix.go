@@ -0,0 +1,37 @@
+//go:build unix
+
+package srv
+
+import "syscall"
+
+// idle reports whether nothing arrived on the connection since it was last
+// used, not even the end of the connection, which means that the server is
+// still waiting for a request on it. The socket is peeked at without blocking;
+// connections that are not plain sockets, such as TLS ones, cannot be checked,
+// and are assumed to be idle.
+func (c *Client) idle() bool {
+	sc, ok := c.conn.(syscall.Conn)
+
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+
+	if err != nil {
+		return true
+	}
+	var (
+		b    [1]byte
+		perr error
+	)
+	if err = raw.Read(func(fd uintptr) bool {
+		_, _, perr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true
+	}); err != nil {
+		return false
+	}
+	// Having nothing to read is what an idle connection looks like: a byte is
+	// one the server should not have sent, and no error without one is the end
+	// of the connection.
+	return perr == syscall.EAGAIN || perr == syscall.EWOULDBLOCK
+}
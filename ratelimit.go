@@ -0,0 +1,141 @@
+package srv
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is the reason given to clients whose requests are turned down
+// by the server's RateLimiter.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimiter decides whether the client at addr may make another request. It
+// is consulted by the server for every request and stream before they are
+// dispatched, possibly from several goroutines at once. See Server.RateLimiter.
+type RateLimiter interface {
+	Allow(addr net.Addr) bool
+}
+
+// TokenBucket is a RateLimiter that gives every client a bucket of Burst
+// tokens, refilled at Rate tokens per second; each request takes a token, and
+// requests are turned down while the bucket is empty. Clients are told apart
+// by their IP address, so that the connections of a client share a bucket, or
+// by the whole address for other kinds of addresses, such as Unix sockets. The
+// clients of a Unix socket are usually unnamed, in which case they all share a
+// single bucket.
+type TokenBucket struct {
+	Rate  float64 // The number of requests allowed per second, on average.
+	Burst int     // The number of requests allowed at once.
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time // Replaced in tests.
+}
+
+// bucket is the state of a client of a TokenBucket.
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last updated.
+}
+
+// tokenBucketSweep is how often a TokenBucket drops the buckets of the clients
+// that have been idle long enough for them to be full again.
+const tokenBucketSweep = time.Minute
+
+// NewTokenBucket is used to create a TokenBucket allowing rate requests per
+// second with bursts of up to burst requests, for each client.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Burst: burst}
+}
+
+// Allow takes a token from the bucket of the client at addr, if there is one.
+func (tb *TokenBucket) Allow(addr net.Addr) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+
+	if tb.now != nil {
+		now = tb.now()
+	}
+	if tb.buckets == nil {
+		tb.buckets = make(map[string]*bucket)
+		tb.lastSweep = now
+	}
+	if now.Sub(tb.lastSweep) >= tokenBucketSweep {
+		tb.sweep(now)
+	}
+	key := clientKey(addr)
+	b, ok := tb.buckets[key]
+
+	if !ok {
+		b = &bucket{tokens: float64(tb.Burst), last: now}
+		tb.buckets[key] = b
+	}
+	b.tokens = tb.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens in b at the given time.
+func (tb *TokenBucket) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*tb.Rate
+
+	if tokens > float64(tb.Burst) {
+		tokens = float64(tb.Burst)
+	}
+	return tokens
+}
+
+// sweep drops the buckets that are full, since they are the same as new ones.
+func (tb *TokenBucket) sweep(now time.Time) {
+	for key, b := range tb.buckets {
+		if tb.refill(b, now) >= float64(tb.Burst) {
+			delete(tb.buckets, key)
+		}
+	}
+	tb.lastSweep = now
+}
+
+// clientKey returns what tells clients apart in a TokenBucket. Unnamed Unix
+// socket clients all get the same key.
+func clientKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	default:
+		return addr.Network() + ":" + addr.String()
+	}
+}
+
+// limitRate is used to check a request or stream with the RateLimiter before it
+// is dispatched. It returns nil if the frame may be served, and otherwise the
+// result of rejecting it with CodeTooManyRequests; rejected streams close the
+// connection.
+func (s *Server) limitRate(meta Metadata, client *Client) error {
+	if s.RateLimiter == nil {
+		return nil
+	}
+	switch meta.EndpointType {
+	case EndpointRequest, EndpointOneWay, EndpointStream:
+	default:
+		return nil
+	}
+	if s.RateLimiter.Allow(client.RemoteAddr()) {
+		return nil
+	}
+	s.maybeLogf("Rate limiting %s frame for endpoint %v from %v", EndpointTypeName(meta.EndpointType), meta.Endpoint, client.RemoteAddr())
+	return endStream(meta, s.reject(meta, client, CodeTooManyRequests, ErrRateLimited))
+}
@@ -0,0 +1,124 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// limitAfter is a RateLimiter that allows the first n requests, and no more.
+type limitAfter struct {
+	n     int32
+	calls int32
+}
+
+func (l *limitAfter) Allow(addr net.Addr) bool {
+	return atomic.AddInt32(&l.calls, 1) <= l.n
+}
+
+func TestServerRateLimiter(t *testing.T) {
+	s := newEchoServer()
+	limiter := &limitAfter{n: 2}
+	s.RateLimiter = limiter
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	// The hello frame is not counted.
+	if _, err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake error = %v, want nil", err)
+	}
+	wantCodes := []ErrorCode{0, 0, CodeTooManyRequests, CodeTooManyRequests}
+
+	for i, want := range wantCodes {
+		resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+		if want == 0 {
+			if err != nil || string(resp.Body) != "hello" {
+				t.Errorf("request %d: body = %q, %v, want %q", i, resp.Body, err, "hello")
+			}
+			continue
+		}
+		if code, _ := ErrorCodeOf(err); code != want {
+			t.Errorf("request %d: error = %v, want code %d", i, err, want)
+		}
+	}
+	if calls := atomic.LoadInt32(&limiter.calls); calls != int32(len(wantCodes)) {
+		t.Errorf("calls = %d, want %d", calls, len(wantCodes))
+	}
+}
+
+func TestServerRateLimiterStream(t *testing.T) {
+	s := newEchoServer()
+	s.AddStreamingEndpoint("stream", func(ctx context.Context, meta Metadata, client *Client) error {
+		return nil
+	})
+	s.RateLimiter = &limitAfter{}
+	reasons := make(chan error, 1)
+	s.OnConnClose = func(conn net.Conn, reason error) { reasons <- reason }
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.Write(Metadata{EndpointType: EndpointStream, Endpoint: "stream"}.Encode()); err != nil {
+		t.Fatalf("Could not write stream header: %v", err)
+	}
+	// The data of the stream must not be read as frames.
+	go client.WriteMessage(Metadata{Endpoint: "echo"}.Encode())
+
+	_, err := client.ReadResponse()
+
+	if code, _ := ErrorCodeOf(err); code != CodeTooManyRequests {
+		t.Errorf("error = %v, want code %d", err, CodeTooManyRequests)
+	}
+	if reason := <-reasons; reason != ErrRateLimited {
+		t.Errorf("reason = %v, want %v", reason, ErrRateLimited)
+	}
+	if _, err = client.ReadResponse(); err != io.EOF {
+		t.Errorf("error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	tb := NewTokenBucket(2, 3)
+	tb.now = func() time.Time { return now }
+	alice := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	aliceAgain := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	bob := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration // Time passed since the previous step.
+		addr    net.Addr
+		want    bool
+	}{
+		{"burst 1", 0, alice, true},
+		{"burst 2", 0, alice, true},
+		{"burst 3 from another port", 0, aliceAgain, true},
+		{"burst exhausted", 0, alice, false},
+		{"other client", 0, bob, true},
+		{"half a token", 250 * time.Millisecond, alice, false},
+		{"refilled token", 250 * time.Millisecond, alice, true},
+		{"token used", 0, alice, false},
+		{"refilled to burst", time.Hour, alice, true},
+		{"burst again 2", 0, alice, true},
+		{"burst again 3", 0, alice, true},
+		{"burst again exhausted", 0, alice, false},
+	}
+	// The steps depend on each other, so they run in order.
+	for _, tt := range tests {
+		now = now.Add(tt.elapsed)
+
+		if got := tb.Allow(tt.addr); got != tt.want {
+			t.Errorf("%s: Allow = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// Bob's bucket was full again at the last sweep.
+	if _, ok := tb.buckets[clientKey(bob)]; ok {
+		t.Error("The bucket of an idle client was kept")
+	}
+}
@@ -0,0 +1,183 @@
+//go:build linux
+
+package srv
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// reactorWait is how long the reactor waits for events, in milliseconds, before
+// checking whether it still has connections to watch and whether the server is
+// shutting down.
+const reactorWait = 100
+
+// reactorEvents are the events the reactor waits for on parked connections. The
+// connections are disarmed after every event, so that only one goroutine serves
+// each of them at a time.
+const reactorEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// reactor is used to watch parked connections with epoll, giving each of them a
+// goroutine only while it has something to read. It runs on a single goroutine,
+// which is started with the first parked connection and stops once there are
+// none left, or once the server shuts down, ending the parked connections.
+type reactor struct {
+	mu      sync.Mutex
+	running bool
+	epfd    int
+	done    <-chan struct{}     // Closed once the server shuts down.
+	conns   map[int]*parkedConn // The parked and awake connections, by file descriptor.
+}
+
+// park is used to hand a connection over to the reactor.
+func (r *reactor) park(p *parkedConn) error {
+	raw, err := p.client.conn.(syscall.Conn).SyscallConn()
+
+	if err != nil {
+		return err
+	}
+	if err = raw.Control(func(fd uintptr) { p.fd = int(fd) }); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.running {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+
+		if err != nil {
+			return os.NewSyscallError("epoll_create1", err)
+		}
+		r.running, r.epfd, r.conns = true, epfd, map[int]*parkedConn{}
+		r.done = p.s.ctx.Done()
+
+		go r.run(epfd)
+	}
+	if err = r.ctl(syscall.EPOLL_CTL_ADD, p.fd); err != nil {
+		return err
+	}
+	r.conns[p.fd] = p
+	p.s.parked.Add(1)
+
+	return nil
+}
+
+// run is used to wake up connections as they become readable. Once the server
+// shuts down, the parked connections are ended, since their endpoints would not
+// be called to see their context cancelled until they had something to read.
+func (r *reactor) run(epfd int) {
+	events := make([]syscall.EpollEvent, 128)
+
+	for {
+		n, err := syscall.EpollWait(epfd, events, reactorWait)
+
+		if err == syscall.EINTR {
+			continue
+		}
+		r.mu.Lock()
+
+		if err != nil || (n == 0 && len(r.conns) == 0) {
+			r.stop(os.NewSyscallError("epoll_wait", err))
+			return
+		}
+		select {
+		case <-r.done:
+			r.stop(nil)
+			return
+		default:
+		}
+		for _, event := range events[:n] {
+			if p, ok := r.conns[int(event.Fd)]; ok && !p.awake {
+				p.awake = true
+				p.s.parked.Add(-1)
+
+				go r.wake(p)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// stop is used to shut the reactor down, ending the parked connections with
+// err if there are any. It is called with the lock held, and releases it.
+func (r *reactor) stop(err error) {
+	var ended []*parkedConn
+
+	for _, p := range r.conns {
+		if !p.awake { // Awake connections are ended once they fail to rearm.
+			r.remove(p)
+			p.s.parked.Add(-1)
+			ended = append(ended, p)
+		}
+	}
+	syscall.Close(r.epfd)
+	r.running = false
+	r.mu.Unlock()
+
+	for _, p := range ended {
+		p.end(err)
+	}
+}
+
+// wake is used to run the endpoint of a connection that became readable, and
+// to park the connection again afterwards, unless its stream is over or the
+// server is shutting down.
+func (r *reactor) wake(p *parkedConn) {
+	p.s.connGoroutines.Add(1)
+	defer p.s.connGoroutines.Add(-1)
+
+	err := p.endpoint(p.ctx, p.meta, p.client)
+
+	r.mu.Lock()
+
+	if err == nil && !p.client.isClosed() && p.ctx.Err() == nil {
+		if err = r.ctl(syscall.EPOLL_CTL_MOD, p.fd); err == nil {
+			p.awake = false
+			p.s.parked.Add(1)
+			r.mu.Unlock()
+			return
+		}
+	}
+	r.remove(p)
+	r.mu.Unlock()
+
+	p.end(err)
+}
+
+// closed is called once the client of a connection has been closed, which ends
+// the stream right away if it is parked.
+func (r *reactor) closed(p *parkedConn) {
+	r.mu.Lock()
+
+	if p.awake || p.removed {
+		r.mu.Unlock()
+		return
+	}
+	r.remove(p)
+	p.s.parked.Add(-1)
+	r.mu.Unlock()
+
+	p.end(nil)
+}
+
+// remove is used to stop watching a connection. It is called with the lock
+// held. The file descriptor may be reused once the connection is closed, so it
+// is only forgotten if it still belongs to p.
+func (r *reactor) remove(p *parkedConn) {
+	p.removed = true
+
+	if r.conns[p.fd] != p {
+		return
+	}
+	delete(r.conns, p.fd)
+
+	// This fails harmlessly if the connection is already closed, which takes it
+	// out of the epoll instance.
+	r.ctl(syscall.EPOLL_CTL_DEL, p.fd)
+}
+
+func (r *reactor) ctl(op, fd int) error {
+	event := syscall.EpollEvent{Events: reactorEvents, Fd: int32(fd)}
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(r.epfd, op, fd, &event))
+}
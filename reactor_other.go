@@ -0,0 +1,13 @@
+//go:build !linux
+
+package srv
+
+// reactor is only implemented on Linux; elsewhere, event endpoints are served on
+// the goroutine of their connection.
+type reactor struct{}
+
+func (r *reactor) park(p *parkedConn) error {
+	return errNoReactor
+}
+
+func (r *reactor) closed(p *parkedConn) {}
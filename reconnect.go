@@ -0,0 +1,64 @@
+package srv
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for the reconnection settings of clients; see Client.AutoReconnect.
+const (
+	DefaultReconnectAttempts = 3                      // The dials made to reconnect before giving up.
+	DefaultReconnectDelay    = 100 * time.Millisecond // The delay before the second dial, doubled for every other.
+)
+
+// canReconnect reports whether the client should dial the server again before
+// going on: its connection failed, the caller asked for it and did not close
+// the client, and no stream was started on it.
+func (c *Client) canReconnect() bool {
+	return c.AutoReconnect && c.protocol != "" && !c.streaming.Load() && !c.isClosed() && c.failed.Load()
+}
+
+// reconnect is used to replace the connection of the client with a new one to
+// the same server, dialled the same way. The first dial is made right away, and
+// the others after a delay doubling each time, with jitter, like
+// NewClientRetry. The options negotiated with Handshake are dropped along with
+// the old connection, and the deadlines set on the client apply to the new one.
+func (c *Client) reconnect() error {
+	attempts, delay := c.ReconnectAttempts, c.ReconnectDelay
+
+	if attempts <= 0 {
+		attempts = DefaultReconnectAttempts
+	}
+	if delay <= 0 {
+		delay = DefaultReconnectDelay
+	}
+	var (
+		next *Client
+		err  error
+	)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(jitter(delay))
+			delay *= 2
+		}
+		if next, err = c.dial(c.uri); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not reconnect after %d attempts", attempts)
+	}
+	c.conn.Close()
+	c.conn = next.conn
+	c.r, c.w, c.wireR, c.wireW = nil, nil, nil, nil
+	c.compression, c.compact, c.caps = "", false, nil
+	c.unread, c.headerWire, c.headerSize = nil, 0, 0
+	c.failed.Store(false)
+
+	if !c.rDeadline.IsZero() || !c.wDeadline.IsZero() {
+		c.conn.SetReadDeadline(c.rDeadline)
+		c.conn.SetWriteDeadline(c.wDeadline)
+	}
+	return nil
+}
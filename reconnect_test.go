@@ -0,0 +1,184 @@
+package srv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// restartingServer serves echo servers one after the other on the same
+// address, so that clients see the server restart.
+type restartingServer struct {
+	t      *testing.T
+	addr   string
+	server *Server
+}
+
+func newRestartingServer(t *testing.T) *restartingServer {
+	r := &restartingServer{t: t, addr: "127.0.0.1:0"}
+	r.start()
+
+	t.Cleanup(func() { r.server.ShutdownTimeout(time.Millisecond) })
+
+	return r
+}
+
+// start is used to serve a new echo server on the address.
+func (r *restartingServer) start() {
+	listener, err := net.Listen(ProtocolTCP, r.addr)
+
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.addr = listener.Addr().String()
+	r.server = newEchoServer()
+
+	go r.server.serve(listener)
+}
+
+// stop is used to kill the server, closing the connections it serves.
+func (r *restartingServer) stop() {
+	r.server.ShutdownTimeout(time.Millisecond)
+}
+
+func (r *restartingServer) restart() {
+	r.stop()
+	r.start()
+}
+
+func TestClientAutoReconnectSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		reconnect bool
+		resend    bool
+		wantErr   bool
+	}{
+		{"reconnect", true, true, false},
+		{"reconnect without resending", true, false, true},
+		{"no reconnect", false, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := newRestartingServer(t)
+			client, err := NewClient(ProtocolTCP, server.addr)
+
+			if err != nil {
+				t.Fatalf("Could not connect: %v", err)
+			}
+			defer client.Close()
+
+			client.AutoReconnect = tt.reconnect
+			client.ResendOnReconnect = tt.resend
+
+			for i := 0; i < 3; i++ {
+				resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+				if i > 0 && tt.wantErr {
+					if err == nil {
+						t.Fatalf("request %d: Should return an error", i)
+					}
+					if !tt.reconnect {
+						continue
+					}
+					// The request is not sent again, but the next one goes over
+					// a new connection.
+					resp, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+				}
+				if err != nil || string(resp.Body) != "hello" {
+					t.Fatalf("request %d: body = %q, %v, want %q", i, resp.Body, err, "hello")
+				}
+				server.restart()
+			}
+		})
+	}
+}
+
+func TestClientAutoReconnectData(t *testing.T) {
+	server := newRestartingServer(t)
+	client, err := NewClient(ProtocolTCP, server.addr)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer client.Close()
+
+	client.AutoReconnect = true
+	server.restart()
+
+	// The write may go through on the dead connection, in which case the
+	// response is lost, but the next request is written on a new one.
+	if _, err = client.WriteDataString("echo", "lost"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err == nil && body != "lost" {
+		t.Errorf("body = %q, want %q", body, "lost")
+	}
+	if _, err = client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+		t.Errorf("body = %q, %v, want %q", body, err, "hello")
+	}
+	if got := server.server.Stats().TotalConnections; got != 1 {
+		t.Errorf("connections = %d, want 1", got)
+	}
+}
+
+func TestClientAutoReconnectGivesUp(t *testing.T) {
+	server := newRestartingServer(t)
+	client, err := NewClient(ProtocolTCP, server.addr)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer client.Close()
+
+	client.AutoReconnect = true
+	client.ReconnectAttempts = 2
+	client.ReconnectDelay = time.Millisecond
+	server.stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}}); err == nil {
+			t.Fatalf("request %d: Should return an error while the server is down", i)
+		}
+	}
+
+	// The client recovers once the server is back.
+	server.start()
+
+	if resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil || string(resp.Body) != "hello" {
+		t.Errorf("body = %q, %v, want %q", resp.Body, err, "hello")
+	}
+}
+
+func TestClientAutoReconnectStream(t *testing.T) {
+	server := newRestartingServer(t)
+	client, err := NewClient(ProtocolTCP, server.addr)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer client.Close()
+
+	client.AutoReconnect = true
+
+	if _, err = client.WriteMeta(Metadata{EndpointType: EndpointStream, Endpoint: "echo"}); err != nil {
+		t.Fatalf("Could not write stream header: %v", err)
+	}
+	server.restart()
+
+	if _, err = client.ReadMessage(); err == nil {
+		t.Fatal("Should return an error once the server is gone")
+	}
+	if _, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}}); err == nil {
+		t.Error("Should not reconnect once a stream was started")
+	}
+	if got := server.server.Stats().TotalConnections; got != 0 {
+		t.Errorf("connections = %d, want 0", got)
+	}
+}
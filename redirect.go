@@ -0,0 +1,129 @@
+package srv
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTooManyRedirects is returned by Send and SendContext when a request is
+// redirected more than the client's MaxRedirects allow, such as when redirects
+// form a loop.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// Redirect is returned by request endpoints to send the client elsewhere, such
+// as to the new name of an endpoint, or to a less busy server. The server
+// answers with a redirect frame instead of a response, and the connection
+// remains usable. Clients return it as an error, unless they follow it (see
+// Client.MaxRedirects).
+//
+// On the wire, the body of a redirect frame is the JSON encoding of the
+// redirect, such as {"endpoint":"v2/echo","addr":"10.0.0.2:8080"}.
+type Redirect struct {
+	Endpoint string `json:"endpoint,omitempty"` // The endpoint to call instead, if it changes.
+	Addr     string `json:"addr,omitempty"`     // The server to call instead, if it changes.
+}
+
+func (r *Redirect) Error() string {
+	switch {
+	case r.Addr == "":
+		return "srv: redirected to endpoint " + r.Endpoint
+	case r.Endpoint == "":
+		return "srv: redirected to " + r.Addr
+	default:
+		return "srv: redirected to endpoint " + r.Endpoint + " at " + r.Addr
+	}
+}
+
+// parseRedirect is used to turn a redirect frame into a *Redirect. It returns
+// nil for any other kind of frame.
+func parseRedirect(meta Metadata, body []byte) error {
+	if meta.EndpointType != EndpointRedirect {
+		return nil
+	}
+	r := &Redirect{}
+
+	if err := json.Unmarshal(body, r); err != nil {
+		return errors.Wrap(err, "could not decode redirect")
+	}
+	return r
+}
+
+// writeRedirect is used to answer a request with a redirect frame.
+func (c *Client) writeRedirect(endpoint string, r *Redirect) (n int, err error) {
+	if c.isClosed() {
+		return 0, errConnectionClosed
+	}
+	body, err := json.Marshal(r)
+
+	if err != nil {
+		return 0, err
+	}
+	meta := Metadata{EndpointType: EndpointRedirect, BodySize: int64(len(body)), Endpoint: endpoint}
+
+	return c.Write(append(c.encodeMeta(meta), body...))
+}
+
+// redirect is used to answer a request whose endpoint returned a *Redirect.
+func (s *Server) redirect(meta Metadata, client *Client, r *Redirect) error {
+	if meta.EndpointType == EndpointOneWay {
+		return recoverableError{r}
+	}
+	if _, err := client.writeRedirect(meta.Endpoint, r); err != nil {
+		return s.logWriteError(client, "redirect frame", err)
+	}
+	return recoverableError{r}
+}
+
+// dial is used to connect to another server the way the client was connected,
+// including with TLS.
+func (c *Client) dial(uri string) (*Client, error) {
+	if c.tlsConfig != nil {
+		return NewClientTLS(c.protocol, uri, c.tlsConfig)
+	}
+	return NewClient(c.protocol, uri)
+}
+
+// followRedirects is used to send a request with send, following the redirects
+// it gets back up to MaxRedirects times.
+func (c *Client) followRedirects(req Request, send func(client *Client, req Request) (Response, error)) (Response, error) {
+	client := c
+
+	defer func() {
+		if client != c {
+			client.Close()
+		}
+	}()
+
+	for redirects := 0; ; redirects++ {
+		resp, err := send(client, req)
+
+		var r *Redirect
+
+		if c.MaxRedirects <= 0 || !errors.As(err, &r) {
+			return resp, err
+		}
+		if redirects == c.MaxRedirects {
+			return resp, errors.Wrapf(ErrTooManyRedirects, "stopped after %d", redirects)
+		}
+		if r.Endpoint != "" {
+			req.Meta.Endpoint, req.Meta.EndpointID = r.Endpoint, 0
+		}
+		if r.Addr == "" {
+			continue
+		}
+		if c.protocol == "" { // The client cannot tell how to reach the server.
+			return resp, err
+		}
+		next, err := c.dial(r.Addr)
+
+		if err != nil {
+			return resp, errors.Wrap(err, "could not follow redirect")
+		}
+		if client != c {
+			client.Close()
+		}
+		client = next
+		client.MaxResponseBody = c.MaxResponseBody
+	}
+}
@@ -0,0 +1,138 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// redirectTo returns an endpoint that redirects every request to target.
+func redirectTo(target Redirect) RequestEndpoint {
+	return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		return &target
+	}
+}
+
+// listenOn starts serving s on a local TCP port, returning its address.
+func listenOn(t testing.TB, s *Server) string {
+	listener, err := net.Listen(ProtocolTCP, "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(listener)
+
+	t.Cleanup(s.Shutdown)
+
+	return listener.Addr().String()
+}
+
+func TestClientRedirectEndpoint(t *testing.T) {
+	s := newEchoServer()
+	s.AddRequestEndpoint("old", redirectTo(Redirect{Endpoint: "echo"}))
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	_, err := client.Send(Request{Meta: Metadata{Endpoint: "old"}, Body: []byte("hello")})
+
+	var r *Redirect
+
+	if !errors.As(err, &r) || r.Endpoint != "echo" {
+		t.Fatalf("error = %v, want a redirect to echo", err)
+	}
+	client.MaxRedirects = 3
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "old"}, Body: []byte("hello")})
+
+	if err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	if string(resp.Body) != "hello" || resp.Meta.Endpoint != "echo" {
+		t.Errorf("response = %q from %q, want %q from %q", resp.Body, resp.Meta.Endpoint, "hello", "echo")
+	}
+}
+
+func TestClientRedirectAddr(t *testing.T) {
+	target := newEchoServer()
+	targetAddr := listenOn(t, target)
+
+	origin, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+	origin.AddRequestEndpoint("echo", redirectTo(Redirect{Addr: targetAddr}))
+	originAddr := listenOn(t, origin)
+
+	client, err := NewClient(ProtocolTCP, originAddr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.MaxRedirects = 1
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+	if err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	if string(resp.Body) != "hello" {
+		t.Errorf("body = %q, want %q", resp.Body, "hello")
+	}
+
+	// The original connection is still usable.
+	client.MaxRedirects = 0
+
+	if _, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}}); !errors.As(err, new(*Redirect)) {
+		t.Errorf("error = %v, want a redirect", err)
+	}
+}
+
+func TestClientRedirectAddrTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	target := newEchoServer()
+	target.TLSConfig = cfg
+	targetAddr := listenOnTLS(t, target)
+
+	origin := NewInMemoryServer()
+	origin.TLSConfig = cfg
+	origin.AddRequestEndpoint("echo", redirectTo(Redirect{Addr: targetAddr}))
+	originAddr := listenOnTLS(t, origin)
+
+	client, err := NewClientTLS(ProtocolTCP, originAddr, &tls.Config{RootCAs: pool})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.MaxRedirects = 1
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+	if err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	if string(resp.Body) != "hello" {
+		t.Errorf("body = %q, want %q", resp.Body, "hello")
+	}
+}
+
+func TestClientRedirectLoop(t *testing.T) {
+	s := newEchoServer()
+	s.AddRequestEndpoint("ping", redirectTo(Redirect{Endpoint: "pong"}))
+	s.AddRequestEndpoint("pong", redirectTo(Redirect{Endpoint: "ping"}))
+	client := s.NewInMemoryClient()
+	client.MaxRedirects = 5
+
+	defer client.Close()
+
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "ping"}}); errors.Cause(err) != ErrTooManyRedirects {
+		t.Fatalf("error = %v, want %v", err, ErrTooManyRedirects)
+	}
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil {
+		t.Errorf("Connection unusable after the loop: %v", err)
+	}
+}
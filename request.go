@@ -0,0 +1,296 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Request bundles the metadata and the body of a request. When a request is
+// written, the body size in the metadata is filled in from the body.
+type Request struct {
+	Meta Metadata
+	Body []byte
+}
+
+// Response bundles the metadata and the body of a response.
+type Response struct {
+	Meta Metadata
+	Body []byte
+}
+
+// RequestHandler is an alternative to RequestEndpoint for endpoints that work on
+// whole requests and responses rather than on streams. Only the body of the
+// returned response is sent; its metadata is set by the server.
+type RequestHandler func(req Request) (Response, error)
+
+// HandleRequest is used to turn a RequestHandler into a RequestEndpoint.
+func HandleRequest(handler RequestHandler) RequestEndpoint {
+	return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		body, err := io.ReadAll(r)
+
+		if err != nil {
+			return err
+		}
+		resp, err := handler(Request{Meta: meta, Body: body})
+
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(resp.Body)
+		return err
+	}
+}
+
+// WriteRequest is used to write a request to the connection.
+func (c *Client) WriteRequest(req Request) (n int, err error) {
+	if c.isClosed() {
+		return 0, errConnectionClosed
+	}
+	if c.canReconnect() {
+		if err = c.reconnect(); err != nil {
+			return 0, err
+		}
+	}
+	if req.Meta.EndpointType == EndpointStream {
+		c.streaming.Store(true)
+	}
+	c.expectResponse(req.Meta)
+
+	if n, err = c.writeRequest(req); err == nil || !c.canReconnect() {
+		return n, err
+	}
+	if rerr := c.reconnect(); rerr != nil {
+		return n, errors.Wrapf(rerr, "after %v", err)
+	}
+	return c.writeRequest(req)
+}
+
+// writeRequest is like WriteRequest, but it does not reconnect. The header is
+// encoded as late as possible, since its form depends on the connection.
+func (c *Client) writeRequest(req Request) (n int, err error) {
+	meta := req.Meta
+	meta.BodySize = int64(len(req.Body))
+
+	return c.Write(append(c.encodeMeta(meta), req.Body...))
+}
+
+// ReadRequest is used to read a request from the connection.
+func (c *Client) ReadRequest() (req Request, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if req.Meta, err = c.ReadMeta(); err != nil {
+		return req, err
+	}
+	req.Body, err = c.ReadBody(req.Meta)
+	return req, err
+}
+
+// responseGrace is how much longer than the Timeout of a request ReadResponse
+// waits for its response, so that the server, which answers requests that time
+// out with an error frame, is normally the one to report it.
+const responseGrace = time.Second
+
+// expectResponse is used to note when the response to a request is due, before
+// its header is written, so that a request without a Timeout does not inherit
+// the deadline of an earlier one. Frames other than requests leave it as it is.
+func (c *Client) expectResponse(meta Metadata) {
+	switch {
+	case meta.EndpointType != EndpointRequest:
+	case meta.Timeout > 0:
+		c.respDue.Store(time.Now().Add(meta.Timeout).UnixNano())
+	default:
+		c.respDue.Store(0)
+	}
+}
+
+// ReadResponse is used to read a response from the connection. If the server
+// rejected the request with an error frame, the error is an *Error.
+//
+// If the last request written had a Timeout, the client waits for the response
+// no longer than that, counted from when the request was written, like the
+// server does; this also applies to every frame of a multi-frame response. The
+// server answers requests that time out with an error frame, which the client
+// gives a second to arrive. If it does not, context.DeadlineExceeded (a timeout
+// error) is returned instead, and since the response may still be on its way,
+// the connection is marked as failed: a Pool closes it rather than reusing it,
+// and AutoReconnect replaces it.
+func (c *Client) ReadResponse() (resp Response, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	due := c.respDue.Load()
+
+	if due == 0 {
+		return c.readResponse()
+	}
+	deadline := time.Unix(0, due).Add(responseGrace)
+
+	if err = c.conn.SetReadDeadline(earliest(c.rDeadline, deadline)); err != nil {
+		return resp, errors.Wrap(err, "could not set deadline")
+	}
+	defer c.conn.SetReadDeadline(c.rDeadline)
+
+	resp, err = c.readResponse()
+
+	var ne interface{ Timeout() bool }
+
+	if errors.As(err, &ne) && ne.Timeout() && !time.Now().Before(deadline) {
+		c.failed.Store(true)
+		return resp, context.DeadlineExceeded
+	}
+	return resp, err
+}
+
+// readResponse is like ReadResponse, but it does not apply the Timeout of the
+// request. The caller must hold readMu.
+func (c *Client) readResponse() (resp Response, err error) {
+	if resp.Meta, err = c.ReadMeta(); err != nil {
+		return resp, err
+	}
+	return c.readResponseBody(resp.Meta)
+}
+
+// readResponseBody is used to read the rest of a response, once its header has
+// been read.
+func (c *Client) readResponseBody(meta Metadata) (resp Response, err error) {
+	resp.Meta = meta
+
+	if resp.Body, err = c.ReadBody(resp.Meta); err != nil {
+		return resp, err
+	}
+	if err = parseError(resp.Meta, resp.Body); err != nil {
+		return Response{Meta: resp.Meta}, err
+	}
+	if err = parseRedirect(resp.Meta, resp.Body); err != nil {
+		return Response{Meta: resp.Meta}, err
+	}
+	return resp, nil
+}
+
+// Notify is used to send a one-way request, for commands that have nothing to
+// answer. The server runs the endpoint but sends nothing back, not even an
+// error if the endpoint does not exist, so there is nothing to read afterwards.
+func (c *Client) Notify(endpoint string, body []byte) (n int, err error) {
+	return c.WriteRequest(Request{Meta: Metadata{EndpointType: EndpointOneWay, Endpoint: endpoint}, Body: body})
+}
+
+// Send is used to write a request and wait for its response. If the request has
+// a Timeout, the client waits for the response no longer than that, as the
+// server does, and returns context.DeadlineExceeded (a timeout error) once it
+// runs out; see SendContext. Redirects are followed as described on
+// MaxRedirects.
+func (c *Client) Send(req Request) (Response, error) {
+	return c.followRedirects(req, (*Client).send)
+}
+
+// Do is used to send a request with the given body to an endpoint, and to
+// return the body of its response, like Send. Unlike Send, it may be called
+// from several goroutines at once: the round trips are made one at a time, so
+// that every caller gets the response to its own request. Responses must not
+// be read by other means meanwhile.
+func (c *Client) Do(endpoint string, body []byte) ([]byte, error) {
+	c.doMu.Lock()
+	defer c.doMu.Unlock()
+
+	resp, err := c.Send(Request{Meta: Metadata{Endpoint: endpoint}, Body: body})
+	return resp.Body, err
+}
+
+// send is like Send, but it does not follow redirects.
+func (c *Client) send(req Request) (Response, error) {
+	if req.Meta.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), req.Meta.Timeout)
+		defer cancel()
+
+		return c.sendContext(ctx, req)
+	}
+	for resent := false; ; resent = true {
+		if _, err := c.WriteRequest(req); err != nil {
+			return Response{}, err
+		}
+		c.readMu.Lock()
+		meta, err := c.ReadMeta()
+
+		// The connection ended before the response started, such as when the
+		// server restarted; the request is sent again over a new one, if the
+		// caller allows it.
+		if err == io.EOF && !resent && c.ResendOnReconnect && req.Meta.EndpointType != EndpointStream && c.canReconnect() {
+			c.readMu.Unlock()
+			continue
+		}
+		if err != nil {
+			c.readMu.Unlock()
+			return Response{Meta: meta}, err
+		}
+		resp, err := c.readResponseBody(meta)
+		c.readMu.Unlock()
+
+		return resp, err
+	}
+}
+
+// WriteRequestContext is like WriteRequest, but it passes the deadline of ctx on
+// to the server as the request's Timeout, so that the server knows how long the
+// client is willing to wait. Without a deadline, the Timeout is left as is. If
+// the deadline has already passed, nothing is written and the context's error
+// is returned.
+func (c *Client) WriteRequestContext(ctx context.Context, req Request) (n int, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+
+		if remaining <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		req.Meta.Timeout = remaining
+	}
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.WriteRequest(req)
+}
+
+// SendContext is like Send, but the request is bounded by ctx: its deadline is
+// passed on to the server (see WriteRequestContext) and also applies to the
+// connection, and cancelling ctx interrupts the exchange. When that happens,
+// the context's error is returned, and the connection should not be used
+// anymore, since a response may still be on its way; it is marked as failed,
+// like ReadResponse does. The deadlines set with
+// SetDeadline and friends still apply, and are restored when SendContext
+// returns. Redirects are followed within the same context.
+func (c *Client) SendContext(ctx context.Context, req Request) (Response, error) {
+	return c.followRedirects(req, func(client *Client, req Request) (Response, error) {
+		return client.sendContext(ctx, req)
+	})
+}
+
+// sendContext is like SendContext, but it does not follow redirects.
+func (c *Client) sendContext(ctx context.Context, req Request) (resp Response, err error) {
+	err = c.withContext(ctx, func() error {
+		if _, err := c.WriteRequestContext(ctx, req); err != nil {
+			return err
+		}
+		c.readMu.Lock()
+		defer c.readMu.Unlock()
+
+		resp, err = c.readResponse()
+		return err
+	})
+	// The server times the request out on the deadline of ctx as well, so it
+	// may notice first.
+	if errors.Is(err, ErrRequestTimeout) {
+		if _, ok := ctx.Deadline(); ok {
+			<-ctx.Done()
+			return resp, ctx.Err()
+		}
+	}
+	// Otherwise, the response may still be on its way, and would be read in
+	// place of the next one.
+	if err != nil && err == ctx.Err() {
+		c.failed.Store(true)
+	}
+	return resp, err
+}
@@ -0,0 +1,396 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestClientWriteRequest(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	server := NewClientConn(serverConn)
+	client := NewClientConn(clientConn)
+
+	defer server.Close()
+	defer client.Close()
+
+	req := Request{
+		Meta: Metadata{UserID: 42, ContentType: "text/plain", Endpoint: "echo", Accept: "text/plain", BodySize: 1},
+		Body: []byte("hello"),
+	}
+	go client.WriteRequest(req)
+
+	got, err := server.ReadRequest()
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	want := req
+	want.Meta.BodySize = int64(len(req.Body))
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("request = %#v, want %#v", got, want)
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	s := NewInMemoryServer()
+	s.AddRequestHandler("upper", func(req Request) (Response, error) {
+		return Response{Body: bytes.ToUpper(req.Body)}, nil
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "upper"}, Body: []byte("hello")})
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	if string(resp.Body) != "HELLO" {
+		t.Errorf("body = %q, want %q", resp.Body, "HELLO")
+	}
+	if resp.Meta.Endpoint != "upper" || resp.Meta.BodySize != 5 {
+		t.Errorf("metadata = %#v, want a 5 byte response from upper", resp.Meta)
+	}
+
+	_, err = client.Send(Request{Meta: Metadata{Endpoint: "missing"}})
+
+	if _, ok := errors.Cause(err).(*Error); !ok {
+		t.Errorf("error = %v, want an *Error", err)
+	}
+}
+
+func TestClientDoConcurrent(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+	}{
+		{"uncompressed", ""},
+		{"compressed", CompressionFlate}, // Whose writer is not safe for concurrent use.
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			client, err := NewClient(ProtocolTCP, listenOn(t, s))
+
+			if err != nil {
+				t.Fatalf("Could not connect: %v", err)
+			}
+			defer client.Close()
+
+			if tt.compression != "" {
+				if _, err = client.Handshake(tt.compression); err != nil {
+					t.Fatalf("Handshake error = %v, want nil", err)
+				}
+			}
+			var wg sync.WaitGroup
+
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					for j := 0; j < 50; j++ {
+						body := bytes.Repeat([]byte(fmt.Sprintf("%d-%d;", i, j)), j*10+1)
+						got, err := client.Do("echo", body)
+
+						if err != nil || !bytes.Equal(got, body) {
+							t.Errorf("request %d-%d: body is %d bytes, %v, want %d", i, j, len(got), err, len(body))
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestClientConcurrentWritesAndReads(t *testing.T) {
+	s := newEchoServer()
+	client, err := NewClient(ProtocolTCP, listenOn(t, s))
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer client.Close()
+
+	if _, err = client.Handshake(CompressionFlate); err != nil {
+		t.Fatalf("Handshake error = %v, want nil", err)
+	}
+	const goroutines, requests = 4, 100
+
+	var (
+		writers, readers sync.WaitGroup
+		mu               sync.Mutex
+		sent             = map[string]int{}
+	)
+	for i := 0; i < goroutines; i++ {
+		writers.Add(1)
+		readers.Add(1)
+
+		go func(i int) {
+			defer writers.Done()
+
+			for j := 0; j < requests; j++ {
+				body := fmt.Sprintf("%d-%d", i, j)
+
+				mu.Lock()
+				sent[body]++
+				mu.Unlock()
+
+				if _, err := client.WriteDataString("echo", body); err != nil {
+					t.Errorf("Could not write request: %v", err)
+					return
+				}
+			}
+		}(i)
+
+		go func() {
+			defer readers.Done()
+
+			for j := 0; j < requests; j++ {
+				_, body, err := client.ReadDataString()
+
+				if err != nil {
+					t.Errorf("Could not read response: %v", err)
+					return
+				}
+				mu.Lock()
+				sent[body]--
+				mu.Unlock()
+			}
+		}()
+	}
+	writers.Wait()
+	readers.Wait()
+
+	for body, count := range sent {
+		if count != 0 {
+			t.Errorf("body %q: %d responses missing", body, count)
+		}
+	}
+}
+
+func TestClientSendTimeout(t *testing.T) {
+	s := NewInMemoryServer()
+	release := make(chan struct{})
+
+	defer close(release)
+
+	s.AddRequestEndpoint("hang", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		<-release
+		return nil
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	_, err := client.Send(Request{Meta: Metadata{Endpoint: "hang", Timeout: timeout}})
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if e, ok := err.(interface{ Timeout() bool }); !ok || !e.Timeout() {
+		t.Errorf("error = %v, want a timeout error", err)
+	}
+	if elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("Send returned after %v, want about %v", elapsed, timeout)
+	}
+}
+
+func TestClientReadDataTimeout(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(clientConn)
+
+	defer serverConn.Close()
+	defer client.Close()
+
+	// The server reads the request, but never answers.
+	go io.Copy(io.Discard, serverConn)
+
+	timeout := 100 * time.Millisecond
+
+	if _, err := client.WriteRequest(Request{Meta: Metadata{Endpoint: "hang", Timeout: timeout}}); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	start := time.Now()
+	_, _, err := client.ReadData()
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if want := timeout + responseGrace; elapsed < want || elapsed > want+time.Second {
+		t.Errorf("ReadData returned after %v, want about %v", elapsed, want)
+	}
+	if !client.failed.Load() {
+		t.Error("The connection should be marked as failed, with a response on its way")
+	}
+}
+
+func TestClientReadResponseStaleTimeout(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	timeout := 50 * time.Millisecond
+
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo", Timeout: timeout}, Body: []byte("timed")}); err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	// The deadline of the timed request passes while the connection is idle,
+	// and must not apply to the next request, which has no Timeout.
+	time.Sleep(timeout + responseGrace)
+
+	if _, err := client.WriteMeta(Metadata{Endpoint: "echo", BodySize: 5}); err != nil {
+		t.Fatalf("Could not write header: %v", err)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Could not write body: %v", err)
+	}
+	resp, err := client.ReadResponse()
+
+	if err != nil || string(resp.Body) != "hello" {
+		t.Fatalf("response = %q, %v, want %q", resp.Body, err, "hello")
+	}
+	if client.failed.Load() {
+		t.Error("The connection should not be marked as failed")
+	}
+}
+
+func TestClientNotify(t *testing.T) {
+	s := newEchoServer()
+	commands := make(chan string, 1)
+
+	s.AddRequestHandler("record", func(req Request) (Response, error) {
+		commands <- string(req.Body)
+		return Response{Body: []byte("never sent")}, nil
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.Notify("record", []byte("command")); err != nil {
+		t.Fatalf("Could not send command: %v", err)
+	}
+	if _, err := client.Notify("missing", []byte("dropped")); err != nil {
+		t.Fatalf("Could not send command: %v", err)
+	}
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("next")})
+
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	if resp.Meta.Endpoint != "echo" || string(resp.Body) != "next" {
+		t.Errorf("response = %q from %q, want %q from %q", resp.Body, resp.Meta.Endpoint, "next", "echo")
+	}
+	if got := <-commands; got != "command" {
+		t.Errorf("command = %q, want %q", got, "command")
+	}
+}
+
+func TestClientSendContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"deadline", time.Second, time.Second},
+		{"no deadline", 0, 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan time.Duration, 1)
+			s := NewInMemoryServer()
+			s.AddRequestEndpoint("timeout", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				received <- meta.Timeout
+				return nil
+			})
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			ctx := context.Background()
+
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			if _, err := client.SendContext(ctx, Request{Meta: Metadata{Endpoint: "timeout"}}); err != nil {
+				t.Fatalf("Should not return an error, got %v", err)
+			}
+			// The header carries milliseconds, and some time passes before the
+			// request is written.
+			if got := <-received; got > tt.want || got < tt.want-100*time.Millisecond {
+				t.Errorf("timeout = %v, want about %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientSendContextCancel(t *testing.T) {
+	s := NewInMemoryServer()
+	release := make(chan struct{})
+
+	defer close(release)
+
+	s.AddRequestEndpoint("slow", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		<-release
+		return nil
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.SendContext(ctx, Request{Meta: Metadata{Endpoint: "slow"}}); err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Without a deadline, the server does not answer with a timeout, so the
+	// response is still on its way once the request is cancelled.
+	other := s.NewInMemoryClient()
+
+	defer other.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if _, err := other.SendContext(ctx, Request{Meta: Metadata{Endpoint: "slow"}}); err != context.Canceled {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+	if !other.failed.Load() {
+		t.Error("The connection should be marked as failed, with a response on its way")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := client.WriteRequestContext(ctx, Request{Meta: Metadata{Endpoint: "slow"}}); err != context.Canceled {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -2,25 +2,54 @@ package srv
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-// Protocol constants
+// Protocol constants. ProtocolUDP only serves request endpoints, one datagram
+// per request and one per response; see MaxDatagramSize.
 const (
 	ProtocolTCP  = "tcp"
 	ProtocolUnix = "unix"
+	ProtocolUDP  = "udp"
 )
 
 var (
-	errInvalidProtocol = errors.New("invalid protocol specified")
-	errInvalidEndpoint = errors.New("invalid endpoint specified")
+	errInvalidProtocol     = errors.New("invalid protocol specified")
+	errInvalidEndpoint     = errors.New("invalid endpoint specified")
+	errInvalidEndpointType = errors.New("invalid endpoint type specified")
+	errInvalidCA           = errors.New("no certificates found in CA file")
 )
 
+// ErrEmptyEndpoint is the error reported for frames that do not name an
+// endpoint at all. This is told apart from an unknown endpoint, since it usually
+// means the client has a bug or is out of sync with the framing.
+var ErrEmptyEndpoint = errors.New("empty endpoint name")
+
+// ErrBodyTooLarge is the error reported for requests declaring a body larger
+// than the server's MaxBodySize.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// ErrShutdownTimedOut is returned by ShutdownTimeout when connections were still
+// being served once the timeout elapsed.
+var ErrShutdownTimedOut = errors.New("shutdown timed out")
+
+// ErrTooManyConnections is the reason given to OnConnClose for connections that
+// were closed right away because the server already serves MaxConnections.
+var ErrTooManyConnections = errors.New("too many connections")
+
 // NewServer is used to return a default Server.
 func NewServer(protocol, uri string) (*Server, error) {
 	switch protocol {
@@ -32,50 +61,628 @@ func NewServer(protocol, uri string) (*Server, error) {
 		if _, err := net.ResolveUnixAddr(ProtocolUnix, uri); err != nil {
 			return nil, err
 		}
+	case ProtocolUDP:
+		if _, err := net.ResolveUDPAddr(ProtocolUDP, uri); err != nil {
+			return nil, err
+		}
 	default:
-		return nil, errInvalidProtocol
+		if _, ok := platformTransports[protocol]; !ok {
+			return nil, errInvalidProtocol
+		}
 	}
-	return &Server{
+	return newServer(protocol, uri), nil
+}
+
+// transport describes how to listen and dial for a protocol that is only
+// available on some platforms.
+type transport struct {
+	listen func(uri string) (net.Listener, error)
+	dial   func(uri string) (net.Conn, error)
+}
+
+// platformTransports holds the protocols available on this platform besides TCP
+// and Unix domain sockets, such as ProtocolPipe on Windows.
+var platformTransports = map[string]transport{}
+
+func newServer(protocol, uri string) *Server {
+	s := &Server{
 		MaxRetries:         10,
+		MaxBackoff:         DefaultMaxBackoff,
+		MaxTimeout:         DefaultMaxTimeout,
+		MaxDrainBytes:      DefaultMaxDrainBytes,
+		MaxBodySize:        DefaultMaxBodySize,
+		MaxMessageSize:     DefaultMaxMessageSize,
 		protocol:           protocol,
 		uri:                uri,
-		requestEndpoints:   map[string]RequestEndpoint{},
 		streamingEndpoints: map[string]StreamingEndpoint{},
+		eventEndpoints:     map[string]EventEndpoint{},
+		versionedEndpoints: map[string]endpointVersions{},
+		aliases:            map[string]string{},
+		unbuffered:         map[string]bool{},
+		scopes:             map[string][]string{},
+		endpointIDs:        map[string]uint32{},
+		active:             map[net.Conn]struct{}{},
 		willShutdown:       make(chan struct{}),
 		didShutdown:        make(chan struct{}),
-	}, nil
+	}
+	s.ctx, s.cancelCtx = context.WithCancel(context.Background())
+	s.requestEndpoints = map[string]RequestEndpoint{}
+	s.setRequestEndpoint(CapabilitiesEndpoint, s.capabilitiesEndpoint)
+	return s
 }
 
+// LogPolicy decides what happens to log messages when the async log buffer is
+// full.
+type LogPolicy int
+
+// Constants describing the policies for a full async log buffer.
+const (
+	LogDrop  LogPolicy = iota // Drop the message, never delaying the caller.
+	LogBlock                  // Wait for room in the buffer, never losing a message.
+)
+
+// ConnPolicy decides what happens to new connections when the server already
+// serves MaxConnections.
+type ConnPolicy int
+
+// Constants describing the policies for connections over the limit.
+const (
+	ConnReject ConnPolicy = iota // Close the connection right away.
+	ConnWait                     // Wait for another connection to end, leaving it in the backlog.
+)
+
+// smallBodySize is the size of the largest request body read into a pooled
+// buffer, sparing an allocation for every small request.
+const smallBodySize = 512
+
+// smallBodies holds the buffers small request bodies are read into.
+var smallBodies = sync.Pool{New: func() interface{} { return new([smallBodySize]byte) }}
+
+// Defaults used by NewServer.
+const (
+	DefaultMaxBackoff     = 1 * time.Second  // The cap on the delay between accept retries.
+	DefaultMaxTimeout     = 30 * time.Second // The time allowed for each request.
+	DefaultMaxDrainBytes  = 64 << 10         // The largest rejected body discarded to keep a connection.
+	DefaultMaxBodySize    = 16 << 20         // The largest request body read into memory.
+	DefaultMaxMessageSize = 16 << 20         // The largest message read by streaming endpoints.
+)
+
 // Server is used to handle serving requests.
+//
+// Each connection is served by a goroutine of its own, which handles its
+// requests one at a time, in the order in which they were received. Responses
+// are thus always written in request order, even when a client pipelines
+// requests whose endpoints take very different times; concurrency comes from
+// serving several connections at once.
 type Server struct {
 	MaxRetries int
+
+	// MaxTimeout bounds how long a connection may take to send a request and
+	// receive its response, including the idle time before the request starts.
+	// A stalled client is disconnected once it elapses. It defaults to
+	// DefaultMaxTimeout; setting it to 0 disables the timeout. Streaming
+	// endpoints are not bounded by it, since they own their connection.
 	MaxTimeout time.Duration
 	Log        bool
 
+	// Logger, if set, receives the log messages of the server in place of the
+	// standard logger, so that their format and destination can be chosen, such
+	// as by adapting a structured logger. Setting it turns logging on, as if Log
+	// were set.
+	Logger Logger
+
+	// MaxDrainBytes is the largest body the server will read and discard when it
+	// rejects a request without reading it, such as one for an unknown endpoint.
+	// Draining keeps the connection usable for the next request; past this size
+	// it is cheaper for the client to reconnect, so the connection is closed
+	// instead. It defaults to DefaultMaxDrainBytes.
+	MaxDrainBytes int64
+
+	// MaxBodySize is the largest request body the server accepts, in bytes. The
+	// declared size is checked before anything is allocated, and larger requests
+	// are rejected with ErrBodyTooLarge, like requests for unknown endpoints. It
+	// defaults to DefaultMaxBodySize; setting it to 0 removes the limit. It does
+	// not apply to endpoints added with AddRequestEndpointUnbuffered, whose body
+	// is not read into memory.
+	MaxBodySize int64
+
+	// MaxMessageSize is the largest message the streaming endpoints of the
+	// server read with ReadMessage, in bytes. It is set on the clients they are
+	// given, along with CloseOnLargeMessage, so that a peer announcing a larger
+	// message gets its connection closed before anything is allocated; see
+	// Client.MaxMessageSize. Endpoints can change it on their client. It
+	// defaults to DefaultMaxMessageSize; setting it to 0 removes the limit.
+	MaxMessageSize int64
+
+	// BodyBufferSize, if greater than zero, gives every connection a buffer of
+	// this size for request bodies and another for responses, which are reused
+	// from one request to the next. For connections carrying many requests of
+	// a similar size, this spares allocating, and growing, new buffers every
+	// time. Bodies larger than the buffer are read as usual, and responses
+	// that outgrow it are not kept for the next request.
+	BodyBufferSize int
+
+	// FlushPolicy decides when the frames written to a connection are sent. By
+	// default (FlushEach), every frame is sent as soon as it is written, so
+	// that a client waiting on a response gets it right away. With
+	// FlushCoalesce, frames are buffered and sent together once FlushThreshold
+	// bytes are waiting, or FlushInterval after the first of them was buffered,
+	// which trades latency for fewer writes when clients pipeline many
+	// requests. A client waiting on a single response gets it within
+	// FlushInterval. The interval and threshold default to
+	// DefaultFlushInterval and DefaultFlushThreshold. It does not apply to UDP,
+	// and it should be set before the server starts listening.
+	FlushPolicy    FlushPolicy
+	FlushInterval  time.Duration
+	FlushThreshold int
+
+	// CompressionMethods, if not nil, restricts the compression methods clients
+	// may enable to those listed, in order of preference. Otherwise, every
+	// registered method is offered; see RegisterCompression.
+	CompressionMethods []string
+
+	// MaxBackoff caps the delay between retries of temporary accept errors.
+	// Without a cap, the doubling backoff could grow large enough to stall the
+	// listener long after the underlying condition has cleared.
+	MaxBackoff time.Duration
+
+	// AsyncLog, if greater than zero, makes logging asynchronous: messages are
+	// queued on a buffer of this size and written by a background goroutine, so
+	// a slow log sink does not add latency to request handling. What happens
+	// when the buffer is full is decided by AsyncLogPolicy. The queued messages
+	// are all logged before Shutdown returns, and those logged afterwards are
+	// written right away.
+	AsyncLog       int
+	AsyncLogPolicy LogPolicy
+
+	// MaxConnections, if greater than zero, is the largest number of
+	// connections served at once, counting those passed to ServeConn and
+	// in-memory clients. What happens to connections over the limit is decided
+	// by MaxConnectionsPolicy. It should be set before the server starts
+	// listening.
+	MaxConnections       int
+	MaxConnectionsPolicy ConnPolicy
+
+	// Metrics, if set, is notified after every request endpoint is served and
+	// whenever a streaming endpoint returns; see Metrics for details.
+	Metrics Metrics
+
+	// OnRequestStats, if set, is called after every request endpoint is served
+	// with the sizes of the request and its response, before and after
+	// compression, and the time spent reading, handling and answering it; see
+	// RequestStats. Requests that are rejected or redirected are not reported.
+	OnRequestStats func(stats RequestStats)
+
+	// OnConnClose, if set, is called after a connection has been closed with
+	// the reason it ended. The reason is io.EOF when the client disconnected
+	// cleanly, between frames (or an endpoint closed the connection), and the
+	// underlying error otherwise, such as an invalid endpoint, or a *ConnError
+	// for failed reads and writes. A connection that ends partway through a
+	// frame is one of those: its *ConnError wraps io.ErrUnexpectedEOF, which
+	// errors.Is tells apart from a clean disconnection. Shutdown waits for the
+	// calls in progress to return, so the hook must not call Shutdown itself.
+	OnConnClose func(conn net.Conn, reason error)
+
+	// Authenticator, if set, is called with the header of requests and streams
+	// before they are dispatched, and with the connection they came from, such
+	// as to check their UserID. If it returns an error, the request is rejected
+	// with an error frame with CodeUnauthorized and the text of the error. By
+	// default, every request is checked, and the connection is kept open after
+	// a rejection, except that of a stream, since the rest of the connection
+	// belongs to it.
+	//
+	// If AuthenticateOnce is set, only the first request or stream of each
+	// connection is checked: the ones following it are trusted if it passes,
+	// and the connection is closed after the error frame if it fails.
+	Authenticator    func(meta Metadata, conn net.Conn) error
+	AuthenticateOnce bool
+
+	// Authorizer, if set, is called with the header of requests and streams
+	// for endpoints that require scopes (see RequireScopes), once they are
+	// authenticated, with the connection they came from and the scopes the
+	// endpoint requires. It returns an error if the caller lacks any of them,
+	// such as by looking up the scopes granted to its UserID, in which case
+	// the request is rejected with an error frame with CodeForbidden and the
+	// text of the error. Without an Authorizer, requests for those endpoints
+	// are always rejected. It is called for every request, even with
+	// AuthenticateOnce set, and the connection is kept open after a rejection,
+	// except that of a stream.
+	Authorizer func(meta Metadata, conn net.Conn, scopes []string) error
+
+	// RateLimiter, if set, is asked whether each request and stream may be
+	// served, with the address of the client, before they are authenticated
+	// and dispatched. Requests it turns down are rejected with an error frame
+	// with CodeTooManyRequests, and the connection is kept open; streams it
+	// turns down close the connection after the error frame, since the rest of
+	// it belongs to the stream. See TokenBucket for a limiter allowing a number
+	// of requests per second.
+	RateLimiter RateLimiter
+
+	// Dispatcher, if set, chooses the endpoints that serve requests and streams
+	// in place of the endpoints registered on the server, such as to route by
+	// prefix or pattern. Middleware added with Use still applies to the request
+	// endpoints it returns, but the built-in CapabilitiesEndpoint is only served
+	// if the dispatcher routes to it. It should be set before the server starts
+	// listening.
+	Dispatcher Dispatcher
+
+	// TLSConfig, if set, is the base configuration of TLS listeners; it is
+	// cloned, so it can be shared. Session tickets are enabled by default, so
+	// that clients reconnecting with a ClientSessionCache in their configuration
+	// resume their session instead of going through a full handshake. They can
+	// be turned off with SessionTicketsDisabled, and the keys can be shared by
+	// several servers, or rotated, with SetSessionTicketKeys.
+	TLSConfig *tls.Config
+
+	// OnListenError, if set, is called whenever accepting a connection fails,
+	// with whether the listener will retry. Once it is called with willRetry set
+	// to false, Listen returns the error. The error caused by Shutdown closing the
+	// listener is not reported.
+	OnListenError func(err error, willRetry bool)
+
 	// Internal fields; used to keep track of connection state, etc.
 	protocol           string
 	uri                string
 	requestEndpoints   map[string]RequestEndpoint   // A map of endpoints, representing all the possible handlers for requests.
 	streamingEndpoints map[string]StreamingEndpoint // A map of streaming endpionts, representing all the possible handlers for streaming requests.
-	willShutdown       chan struct{}                // Notifies the listen process that we should shutdown.
-	didShutdown        chan struct{}                // Notifies the shutdown process that we did shutdown.
+	eventEndpoints     map[string]EventEndpoint     // A map of event endpoints, which serve streams without a goroutine each.
+	versionedEndpoints map[string]endpointVersions  // The request endpoints registered for specific versions, by name.
+	aliases            map[string]string            // A map of request endpoint aliases to the names they stand for.
+	unbuffered         map[string]bool              // The names of the request endpoints that read their body from the connection.
+	scopes             map[string][]string          // The scopes required by endpoints, by name; see RequireScopes.
+	endpointIDs        map[string]uint32            // The IDs assigned to request endpoint names; see EndpointIDs.
+	endpointNames      []string                     // The request endpoint names, indexed by ID - 1.
+	endpointsByID      []RequestEndpoint            // The request endpoints, indexed by ID - 1; nil once removed.
+	middleware         []Middleware                 // Wraps every request endpoint, outermost first.
+	mu                 sync.RWMutex                 // Guards the endpoint and alias maps, so endpoints can be added while serving.
+	willShutdown       chan struct{}                // Closed to notify the listen process that we should shutdown.
+	didShutdown        chan struct{}                // Closed to notify the shutdown process that we did shutdown.
+	shutdownOnce       sync.Once                    // Makes sure willShutdown is only closed once.
+	didShutdownOnce    sync.Once                    // Makes sure didShutdown is only closed once.
+	listeners          int                          // Number of accept loops running; guarded by listenersMu.
+	listenersMu        sync.Mutex                   // Guards listeners, and orders it with willShutdown.
+	connSlots          chan struct{}                // Holds a value for every connection served, when MaxConnections is set.
+	connSlotsOnce      sync.Once                    // Creates connSlots.
+	active             map[net.Conn]struct{}        // The connections being served, so that ShutdownTimeout can close them.
+	activeMu           sync.Mutex                   // Guards active.
+	ctx                context.Context              // The parent of the contexts passed to endpoints.
+	cancelCtx          context.CancelFunc           // Cancels ctx, once Shutdown is called.
 	wg                 sync.WaitGroup               // This keeps a counter of how many clients are connected for gracefully shutting down
+	sleepFunc          func(time.Duration)          // Replaces time.Sleep between accept retries; only set in tests.
+	asyncLogs          chan string                  // Queue of messages waiting to be logged when AsyncLog is set.
+	asyncLogOnce       sync.Once                    // Starts the goroutine draining asyncLogs.
+	asyncLogDone       chan struct{}                // Closed once the goroutine draining asyncLogs returns.
+	asyncLogClosed     bool                         // Whether asyncLogs was closed, on shutdown.
+	asyncLogMu         sync.RWMutex                 // Held for writing while asyncLogs is closed.
+	connGoroutines     atomic.Int64                 // Number of goroutines serving connections.
+	parked             atomic.Int64                 // Number of connections parked by the reactor.
+	events             reactor                      // Parks the connections of event endpoints between events.
+	counters           serverCounters               // The counters behind Stats.
 }
 
 // AddRequestEndpoint is used to add an endpoint to the internal set of
-// endpoints.
+// endpoints. It panics if the name starts with the endpoint ID marker (0x01),
+// since requests could not tell it apart from an endpoint ID.
 func (s *Server) AddRequestEndpoint(name string, endpoint RequestEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setRequestEndpoint(name, endpoint)
+}
+
+// setRequestEndpoint is used to register a request endpoint, assigning an ID to
+// its name the first time it is seen. The caller must hold mu.
+func (s *Server) setRequestEndpoint(name string, endpoint RequestEndpoint) {
+	if err := checkEndpointIDMarker(name); err != nil {
+		panic(err)
+	}
 	s.requestEndpoints[name] = endpoint
+	delete(s.unbuffered, name)
+
+	if id, ok := s.endpointIDs[name]; ok {
+		s.endpointsByID[id-1] = endpoint
+		return
+	}
+	s.endpointNames = append(s.endpointNames, name)
+	s.endpointsByID = append(s.endpointsByID, endpoint)
+	s.endpointIDs[name] = uint32(len(s.endpointNames))
+}
+
+// EndpointIDs is used to return the IDs of the request endpoints, by name. Each
+// name is given an ID when it is first registered, which it keeps for the
+// lifetime of the server; IDs of removed endpoints are not reused. Clients can
+// send the ID (see Metadata.EndpointID) instead of the name, which spares the
+// server from hashing the name on every request. The IDs are also advertised in
+// the server's capabilities.
+func (s *Server) EndpointIDs() map[string]uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make(map[string]uint32, len(s.requestEndpoints))
+
+	for name := range s.requestEndpoints {
+		ids[name] = s.endpointIDs[name]
+	}
+	return ids
+}
+
+// Use is used to wrap every request endpoint in the given middleware, in order:
+// the first one is the outermost, seeing the request first and the outcome
+// last. Middleware is applied when requests are dispatched, so it also covers
+// endpoints added after the call to Use, as well as the built-in ones.
+func (s *Server) Use(middleware ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// endpointVersions holds the request endpoints registered for each version of
+// an endpoint.
+type endpointVersions map[uint32]RequestEndpoint
+
+// AddRequestEndpointVersioned is used to add an endpoint serving one version of
+// the named endpoint's contract, so that several versions can be served side by
+// side. Requests are routed by their EndpointVersion: to the endpoint registered
+// for it if there is one, and otherwise to the endpoint registered with
+// AddRequestEndpoint under the same name, if any. Requests without a version are
+// served by the latter, or else by the latest version. A version of zero or less
+// is the same as calling AddRequestEndpoint. Versioned endpoints do not get
+// endpoint IDs of their own.
+func (s *Server) AddRequestEndpointVersioned(name string, version int, endpoint RequestEndpoint) {
+	if version <= 0 {
+		s.AddRequestEndpoint(name, endpoint)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.versionedEndpoints[name] == nil {
+		s.versionedEndpoints[name] = endpointVersions{}
+	}
+	s.versionedEndpoints[name][uint32(version)] = endpoint
+}
+
+// AddRequestEndpointAlias is used to make requests for alias reach the request
+// endpoint named target. This allows endpoints to be renamed without breaking
+// existing clients. Aliases are resolved at dispatch time, so the target does
+// not need to be registered yet; an endpoint registered under the alias itself
+// takes precedence over the alias.
+func (s *Server) AddRequestEndpointAlias(alias, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.aliases[alias] = target
+}
+
+// RequestEndpointAliases is used to return a copy of the registered aliases,
+// mapped to the names of the endpoints they stand for.
+func (s *Server) RequestEndpointAliases() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	aliases := make(map[string]string, len(s.aliases))
+
+	for alias, target := range s.aliases {
+		aliases[alias] = target
+	}
+	return aliases
+}
+
+// RequestEndpoints is used to return a copy of the registered request
+// endpoints, including the built-in ones.
+func (s *Server) RequestEndpoints() map[string]RequestEndpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoints := make(map[string]RequestEndpoint, len(s.requestEndpoints))
+
+	for name, endpoint := range s.requestEndpoints {
+		endpoints[name] = endpoint
+	}
+	return endpoints
+}
+
+// SetRequestEndpoints is used to replace all of the request endpoints at once,
+// such as when switching between two configurations. Requests see either the
+// old set or the new one, never a mix of both; those already being served
+// carry on with the endpoint they started with. The built-in endpoints are kept
+// unless endpoints takes them over. The map is copied, so the caller may keep
+// using it. Like AddRequestEndpoint, it panics on names starting with the
+// endpoint ID marker, leaving the endpoints as they were.
+func (s *Server) SetRequestEndpoints(endpoints map[string]RequestEndpoint) {
+	registry := map[string]RequestEndpoint{CapabilitiesEndpoint: s.capabilitiesEndpoint}
+
+	for name, endpoint := range endpoints {
+		if err := checkEndpointIDMarker(name); err != nil {
+			panic(err)
+		}
+		registry[name] = endpoint
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requestEndpoints = make(map[string]RequestEndpoint, len(registry))
+	s.unbuffered = map[string]bool{}
+
+	for i := range s.endpointsByID {
+		s.endpointsByID[i] = nil
+	}
+	for name, endpoint := range registry {
+		s.setRequestEndpoint(name, endpoint)
+	}
+}
+
+// AddRequestEndpointUnbuffered is used to add a request endpoint that reads the
+// body straight from the connection, such as to copy a large upload to disk
+// without holding it in memory. The reader it is given ends after BodySize
+// bytes, and whatever the endpoint leaves unread is discarded before the
+// response is sent, so that the next request is read from the right place.
+// MaxBodySize does not apply, so the endpoint should stop reading bodies that
+// are too large for it itself, such as with io.LimitReader.
+//
+// Since the endpoint reads from the connection, its request is not abandoned
+// once its Timeout elapses, although its context is still cancelled, and cancel
+// frames are not watched for while it runs. Requests reaching it through an
+// alias are unbuffered as well, but requests with an EndpointVersion served by
+// a versioned endpoint are not, nor are those routed by a Dispatcher.
+func (s *Server) AddRequestEndpointUnbuffered(name string, endpoint RequestEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setRequestEndpoint(name, endpoint)
+	s.unbuffered[name] = true
+}
+
+// isUnbuffered reports whether the request endpoint that serves meta was added
+// with AddRequestEndpointUnbuffered.
+func (s *Server) isUnbuffered(meta Metadata) bool {
+	if s.Dispatcher != nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.versionedEndpoints[meta.Endpoint][meta.EndpointVersion]; ok {
+		return false
+	}
+	if _, ok := s.requestEndpoints[meta.Endpoint]; !ok {
+		return s.unbuffered[s.aliases[meta.Endpoint]]
+	}
+	return s.unbuffered[meta.Endpoint]
+}
+
+// AddSerializedRequestEndpoint is used to add an endpoint that is never invoked
+// concurrently; see Serialize.
+func (s *Server) AddSerializedRequestEndpoint(name string, endpoint RequestEndpoint) {
+	s.AddRequestEndpoint(name, Serialize(endpoint))
+}
+
+// AddRequestHandler is used to add a RequestHandler to the internal set of
+// endpoints, as a request endpoint.
+func (s *Server) AddRequestHandler(name string, handler RequestHandler) {
+	s.AddRequestEndpoint(name, HandleRequest(handler))
 }
 
 // AddStreamingEndpoint is used to add an endpoint to the internal set of
 // endpoints.
 func (s *Server) AddStreamingEndpoint(name string, endpoint StreamingEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.streamingEndpoints[name] = endpoint
 }
 
+// AddEventEndpoint is used to add an event endpoint to the internal set of
+// endpoints. Streams are served by the event endpoint of their name, if there is
+// one, ahead of any streaming endpoint, and regardless of the Dispatcher.
+func (s *Server) AddEventEndpoint(name string, endpoint EventEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.eventEndpoints[name] = endpoint
+}
+
+func (s *Server) requestEndpoint(name string) (RequestEndpoint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoint, ok := s.requestEndpoints[name]
+
+	if !ok {
+		if target, isAlias := s.aliases[name]; isAlias {
+			endpoint, ok = s.requestEndpoints[target]
+		}
+	}
+	return endpoint, ok
+}
+
+// versionedEndpoint is like requestEndpoint, but it looks up the endpoint
+// registered for the given version with AddRequestEndpointVersioned. Without a
+// version, the latest one is used, unless there is an unversioned endpoint.
+func (s *Server) versionedEndpoint(name string, version uint32) (RequestEndpoint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions, ok := s.versionedEndpoints[name]
+
+	if !ok {
+		if target, isAlias := s.aliases[name]; isAlias {
+			name, versions = target, s.versionedEndpoints[target]
+		}
+	}
+	if version != 0 {
+		endpoint, ok := versions[version]
+		return endpoint, ok
+	}
+	if _, ok = s.requestEndpoints[name]; ok {
+		return nil, false
+	}
+	for v := range versions {
+		if v > version {
+			version = v
+		}
+	}
+	endpoint, ok := versions[version]
+	return endpoint, ok
+}
+
+// requestEndpointByID is like requestEndpoint, but it looks the endpoint up by
+// its ID.
+func (s *Server) requestEndpointByID(id uint32) (RequestEndpoint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id == 0 || int(id) > len(s.endpointsByID) || s.endpointsByID[id-1] == nil {
+		return nil, false
+	}
+	return s.endpointsByID[id-1], true
+}
+
+// endpointName returns the name of the request endpoint with the given ID.
+func (s *Server) endpointName(id uint32) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id == 0 || int(id) > len(s.endpointNames) {
+		return "", false
+	}
+	return s.endpointNames[id-1], true
+}
+
+// applyMiddleware wraps endpoint in the middleware.
+func (s *Server) applyMiddleware(endpoint RequestEndpoint) RequestEndpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		endpoint = s.middleware[i](endpoint)
+	}
+	return endpoint
+}
+
+func (s *Server) streamingEndpoint(name string) (StreamingEndpoint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoint, ok := s.streamingEndpoints[name]
+	return endpoint, ok
+}
+
+func (s *Server) eventEndpoint(name string) (EventEndpoint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoint, ok := s.eventEndpoints[name]
+	return endpoint, ok
+}
+
 // ListenTLS is used to listen for requests using TLS encryption. This is only
-// possible when using TCP.
+// possible when using TCP. The certificate and key are loaded from the given PEM
+// files, and added to TLSConfig. They may be empty if TLSConfig already holds
+// the certificates. If ca is not empty, it names a PEM file of certificate
+// authorities, and clients are required to present a certificate signed by one
+// of them (mutual TLS). Otherwise, it behaves like Listen.
 func (s *Server) ListenTLS(cert, key, ca string) error {
 	switch s.protocol {
 	case ProtocolTCP:
@@ -85,39 +692,157 @@ func (s *Server) ListenTLS(cert, key, ca string) error {
 	}
 }
 
-// Listen is used to listen for requests on the specified URI and protocol.
+// Listen is used to listen for requests on the specified URI and protocol. It
+// returns nil once the server has shut down, or right away if Shutdown was
+// called before.
 func (s *Server) Listen() error {
 	switch s.protocol {
 	case ProtocolTCP:
 		return s.listenTCP()
 	case ProtocolUnix:
 		return s.listenUnix()
+	case ProtocolUDP:
+		return s.listenUDP()
 	default:
+		return s.listenPlatform()
+	}
+}
+
+func (s *Server) listenPlatform() error {
+	t, ok := platformTransports[s.protocol]
+
+	if !ok {
 		return errInvalidProtocol
 	}
+	listener, err := t.listen(s.uri)
+
+	if err != nil {
+		return err
+	}
+	s.maybeLogf("Listening for requests on %s://%s", s.protocol, s.uri)
+
+	return s.serve(listener)
 }
 
-// Shutdown is used to tell the server to stop listening for requests.
+// Shutdown is used to tell the server to stop listening for requests. The
+// contexts passed to endpoints are cancelled, so that they can wrap up, and it
+// returns once the connected clients are done. It is safe to call Shutdown
+// several times, including concurrently; every call returns when the server has
+// shut down. Shutdown does not need a listener either: if the server is not
+// listening, it only waits for the clients connected otherwise, such as in-memory
+// clients, and a later call to Listen returns right away.
 func (s *Server) Shutdown() {
-	s.willShutdown <- struct{}{}
+	s.beginShutdown()
 	<-s.didShutdown
 }
 
-func (s *Server) handleShutdown(listener net.Listener) error {
-	if err := listener.Close(); err != nil {
-		return err
+// Wait is used to block until the server has shut down, without starting the
+// shutdown itself: its accept loops have returned and closed their listeners,
+// and the connected clients are done. It returns when Shutdown does, and blocks
+// until some other caller shuts the server down.
+func (s *Server) Wait() {
+	<-s.didShutdown
+}
+
+// Done returns a channel that is closed once the server has shut down, like
+// Wait, for use in a select statement.
+func (s *Server) Done() <-chan struct{} {
+	return s.didShutdown
+}
+
+// ShutdownTimeout is like Shutdown, but it waits no longer than d for the
+// connected clients, such as a long-lived stream whose endpoint ignores its
+// context. Once d elapses, the remaining connections are closed, which ends the
+// endpoints blocked on them, and ErrShutdownTimedOut is returned without waiting
+// for the endpoints to return.
+func (s *Server) ShutdownTimeout(d time.Duration) error {
+	s.beginShutdown()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-s.didShutdown:
+		return nil
+	case <-timer.C:
+	}
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+
+	s.maybeLogf("Shutdown timed out, closing %d connections", len(s.active))
+
+	for conn := range s.active {
+		conn.Close()
 	}
+	return ErrShutdownTimedOut
+}
+
+// beginShutdown is used to stop listening and cancel the contexts of the
+// endpoints, once. Without an accept loop to finish the shutdown, it is
+// finished in the background.
+func (s *Server) beginShutdown() {
+	s.shutdownOnce.Do(func() {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+
+		close(s.willShutdown)
+		s.cancelCtx()
+
+		if s.listeners == 0 {
+			go s.finishShutdown()
+		}
+	})
+}
+
+// finishShutdown is used to wait for the connected clients, and then to notify
+// the callers of Shutdown. It may be called several times.
+func (s *Server) finishShutdown() {
 	s.wg.Wait()
-	s.didShutdown <- struct{}{}
-	return nil
+	s.didShutdownOnce.Do(func() {
+		s.flushLogs()
+		close(s.didShutdown)
+	})
 }
 
-func (s *Server) listenTCPTLS(cert, key, ca string) error {
-	return nil
+// startServing is used to count an accept loop. It returns false if the server
+// is already shutting down, in which case there is nothing to serve.
+func (s *Server) startServing() bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	select {
+	case <-s.willShutdown:
+		return false
+	default:
+	}
+	s.listeners++
+	return true
 }
 
-func (s *Server) listenTCP() error {
-	timeout, tries := defaultRetries()
+// stopServing is used when an accept loop returns. If the server is shutting
+// down and this was the last loop, it finishes the shutdown, which may have been
+// waiting for it.
+func (s *Server) stopServing() {
+	s.listenersMu.Lock()
+	s.listeners--
+	last := s.listeners == 0
+	s.listenersMu.Unlock()
+
+	select {
+	case <-s.willShutdown:
+		if last {
+			s.finishShutdown()
+		}
+	default:
+	}
+}
+
+func (s *Server) listenTCPTLS(cert, key, ca string) error {
+	cfg, err := s.loadTLSConfig(cert, key, ca)
+
+	if err != nil {
+		return err
+	}
 	addr, err := net.ResolveTCPAddr(ProtocolTCP, s.uri)
 
 	if err != nil {
@@ -128,56 +853,92 @@ func (s *Server) listenTCP() error {
 	if err != nil {
 		return err
 	}
-	s.maybeLogf("Listening for requests on tcp://%s", s.uri)
+	s.maybeLogf("Listening for requests on tcp+tls://%s", s.uri)
 
-	defer listener.Close()
+	return s.serve(tls.NewListener(listener, cfg))
+}
 
-	for {
-		select {
-		case <-s.willShutdown:
-			return s.handleShutdown(listener)
-		default:
-		}
-		if err = listener.SetDeadline(newDeadline(1 * time.Second)); err != nil {
-			return err
+// loadTLSConfig returns the configuration of ListenTLS, with the certificate
+// and certificate authorities loaded from the given files.
+func (s *Server) loadTLSConfig(cert, key, ca string) (*tls.Config, error) {
+	cfg := s.tlsConfig()
+
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+
+		if err != nil {
+			return nil, err
 		}
-		conn, err := listener.AcceptTCP()
+		cfg.Certificates = append(cfg.Certificates, pair)
+	}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
 
-		switch e := err.(type) {
-		case net.Error:
-			timeout, tries, e = s.handleNetError(timeout, tries, e)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
 
-			if e != nil {
-				conn.Close()
-				return e
-			}
-		default:
-			if err != nil {
-				conn.Close()
-				return e
-			}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errInvalidCA
 		}
-		go s.handleConn(conn)
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// tlsConfig returns the configuration of TLS listeners, based on TLSConfig.
+func (s *Server) tlsConfig() *tls.Config {
+	if s.TLSConfig == nil {
+		return &tls.Config{}
+	}
+	return s.TLSConfig.Clone()
+}
+
+func (s *Server) listenTCP() error {
+	addr, err := net.ResolveTCPAddr(ProtocolTCP, s.uri)
+
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenTCP(ProtocolTCP, addr)
+
+	if err != nil {
+		return err
 	}
+	s.maybeLogf("Listening for requests on tcp://%s", s.uri)
+
+	return s.serve(listener)
 }
 
 func (s *Server) handleNetError(timeout time.Duration, tries int, err net.Error) (time.Duration, int, net.Error) {
 	if err.Timeout() {
 		return timeout, tries, nil
 	}
-	if err.Temporary() {
-		if tries > s.MaxRetries {
-			return timeout, tries, err
-		}
-		timeout, tries = incrementRetries(timeout, tries)
-		time.Sleep(timeout)
+	if err.Temporary() && tries <= s.MaxRetries {
+		s.listenError(err, true)
+		timeout, tries = incrementRetries(timeout, tries, s.MaxBackoff)
+		s.sleep(timeout)
 		return timeout, tries, nil
 	}
+	s.listenError(err, false)
 	return timeout, tries, err
 }
 
+// listenError reports an accept error to the log and the OnListenError hook.
+func (s *Server) listenError(err error, willRetry bool) {
+	if willRetry {
+		s.maybeLogf("Error accepting connection, retrying: %v", err)
+	} else {
+		s.maybeLogf("Error accepting connection, giving up: %v", err)
+	}
+	if s.OnListenError != nil {
+		s.OnListenError(err, willRetry)
+	}
+}
+
 func (s *Server) listenUnix() error {
-	timeout, tries := defaultRetries()
 	addr, err := net.ResolveUnixAddr(ProtocolUnix, s.uri)
 
 	if err != nil {
@@ -190,150 +951,675 @@ func (s *Server) listenUnix() error {
 	}
 	s.maybeLogf("Listening for requests on unix://%s", s.uri)
 
+	return s.serve(listener)
+}
+
+// serve runs the accept loop shared by all of the stream-oriented listeners.
+// Temporary accept errors are retried with an exponential backoff, which is
+// capped at MaxBackoff. Both the backoff and the retry counter are reset after
+// every successful accept, so MaxRetries only trips on consecutive failures.
+func (s *Server) serve(listener net.Listener) error {
+	if !s.startServing() {
+		return listener.Close()
+	}
+	defer s.stopServing()
+
+	timeout, tries := defaultRetries()
+	done := make(chan struct{})
+
+	defer close(done)
 	defer listener.Close()
 
-	for {
+	// Accept blocks without a deadline, so that connections are picked up as
+	// soon as they arrive; Shutdown interrupts it by closing the listener.
+	go func() {
 		select {
 		case <-s.willShutdown:
-			return s.handleShutdown(listener)
-		default:
-		}
-		if err = listener.SetDeadline(newDeadline(1 * time.Second)); err != nil {
-			return err
+			listener.Close()
+		case <-done:
 		}
-		conn, err := listener.AcceptUnix()
+	}()
 
-		switch e := err.(type) {
-		case net.Error:
-			timeout, tries, e = s.handleNetError(timeout, tries, e)
+	for {
+		conn, err := listener.Accept()
 
-			if e != nil {
-				conn.Close()
-				return e
+		if err != nil {
+			select {
+			case <-s.willShutdown:
+				return nil
+			default:
 			}
-		default:
-			if err != nil {
-				conn.Close()
+			e, ok := err.(net.Error)
+
+			if !ok {
+				s.listenError(err, false)
+				return err
+			}
+			if timeout, tries, e = s.handleNetError(timeout, tries, e); e != nil {
 				return e
 			}
+			continue
+		}
+		timeout, tries = defaultRetries()
+
+		s.wg.Add(1)
+
+		if !s.admit(conn) {
+			continue
 		}
 		go s.handleConn(conn)
 	}
 }
 
+// ConnGoroutines is used to report how many goroutines the server is running to
+// serve connections. Each connection is served by one goroutine for its whole
+// lifetime: requests are handled one after the other on it, and streaming
+// endpoints run on it as well. The only exception are the streams of event
+// endpoints, which only get a goroutine while they have something to read (see
+// ParkedConns). Together, the two are therefore the number of open connections;
+// a figure that keeps growing while clients come and go points to connections
+// that are never closed. Short-lived helpers are not counted: while a request
+// endpoint runs, a second goroutine watches its connection for cancel frames,
+// and endpoints with a Timeout run on a goroutine of their own. Neither are
+// goroutines started by endpoints themselves.
+func (s *Server) ConnGoroutines() int {
+	return int(s.connGoroutines.Load())
+}
+
+// ParkedConns is used to report how many connections of event endpoints are
+// parked, waiting for something to read without a goroutine of their own.
+func (s *Server) ParkedConns() int {
+	return int(s.parked.Load())
+}
+
+// ServeConn is used to serve a single connection that was accepted elsewhere,
+// such as a stream from a multiplexed session or one end of a `net.Pipe`. It
+// blocks until the connection is done, and the connection is closed before it
+// returns. Connections served this way are waited on by Shutdown like any other.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.wg.Add(1)
+
+	if s.admit(conn) {
+		s.handleConn(conn)
+	}
+}
+
+// admit is used to take a slot for a new connection, if MaxConnections is set.
+// Over the limit, the connection is either closed right away or kept waiting
+// for a slot, depending on MaxConnectionsPolicy; a waiting connection is closed
+// if the server shuts down. admit returns false if the connection was closed,
+// in which case it must not be served.
+func (s *Server) admit(conn net.Conn) bool {
+	s.connSlotsOnce.Do(func() {
+		if s.MaxConnections > 0 {
+			s.connSlots = make(chan struct{}, s.MaxConnections)
+		}
+	})
+	if s.connSlots == nil {
+		return true
+	}
+	if s.MaxConnectionsPolicy == ConnWait {
+		select {
+		case s.connSlots <- struct{}{}:
+			return true
+		case <-s.willShutdown:
+		}
+	} else {
+		select {
+		case s.connSlots <- struct{}{}:
+			return true
+		default:
+		}
+	}
+	s.maybeLogf("Closing connection from %v: %v", conn.RemoteAddr(), ErrTooManyConnections)
+	conn.Close()
+
+	if s.OnConnClose != nil {
+		s.OnConnClose(conn, ErrTooManyConnections)
+	}
+	s.wg.Done()
+	return false
+}
+
 func (s *Server) handleConn(conn net.Conn) {
+	var reason error
+
+	s.connGoroutines.Add(1)
+
 	defer func() {
-		s.wg.Done()
-		conn.Close()
-		s.maybeLogf("Client disconnected: %v", conn.RemoteAddr())
+		s.connGoroutines.Add(-1)
+
+		if reason != errParked { // Otherwise, the reactor closes it later.
+			s.closeConn(conn, reason)
+		}
 	}()
 
-	s.wg.Add(1)
 	s.maybeLogf("Client connected: %v", conn.RemoteAddr())
+	s.counters.activeConns.Add(1)
+	s.counters.totalConns.Add(1)
+
+	s.activeMu.Lock()
+	s.active[conn] = struct{}{}
+	s.activeMu.Unlock()
 
+	// The context of the connection is passed to its endpoints, and is
+	// cancelled once it ends or the server shuts down.
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	if dc, ok := conn.(*datagramConn); ok {
+		reason = s.serveDatagram(ctx, dc)
+		return
+	}
 	client := NewClientConn(conn)
+	client.counters = &s.counters
 
-	if err := s.setDeadline(client); err != nil {
-		s.maybeLogf("Error setting deadline on connection: %v", err)
+	if s.FlushPolicy == FlushCoalesce {
+		client.coalesce = newCoalescer(conn, s.FlushInterval, s.FlushThreshold)
 	}
-	var (
-		meta Metadata
-		err  error
-	)
-	for {
-		meta, err = client.ReadMeta()
+	reason = s.serveClient(ctx, client)
+
+	if reason != errParked {
+		client.flushWrites()
+	}
+}
+
+// closeConn is used to close a connection once it is done being served. The
+// connection is closed first, then OnConnClose is called, and only then is the
+// connection done as far as Shutdown is concerned, so that Shutdown does not
+// return while the hook runs.
+func (s *Server) closeConn(conn net.Conn, reason error) {
+	defer s.wg.Done()
+
+	s.activeMu.Lock()
+	delete(s.active, conn)
+	s.activeMu.Unlock()
+
+	conn.Close()
+	s.counters.activeConns.Add(-1)
+
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+	s.maybeLogf("Client disconnected: %v", conn.RemoteAddr())
+
+	if s.OnConnClose != nil {
+		s.OnConnClose(conn, reason)
+	}
+}
+
+// serveClient reads and dispatches requests until the connection ends. The
+// returned error is the reason it ended, which is io.EOF when the client
+// disconnected cleanly or the connection was closed by an endpoint.
+func (s *Server) serveClient(ctx context.Context, client *Client) error {
+	header := make([]byte, HeaderSize) // Reused for every frame on the connection.
+	authenticated := false             // Whether the connection passed AuthenticateOnce.
+
+	for first := true; ; first = false {
+		// A failure here is not fatal in itself; if the connection is gone, the
+		// read below reports it.
+		if err := s.setDeadline(client); err != nil {
+			s.maybeLogf("Error setting deadline on connection: %v", err)
+		}
+		meta, err := client.ReadMetaInto(header)
 
 		switch err {
-		case io.EOF:
-			return
-		case errConnectionClosed:
-			return
+		case io.EOF, errConnectionClosed:
+			return io.EOF
 		case nil:
 		default:
-			s.logReadError(err, "Unable to read metadata")
+			return s.logReadError(client, "header", err)
+		}
+		start := time.Now()
+
+		if err = s.limitRate(meta, client); err == nil {
+			err = s.authenticate(meta, client, &authenticated)
+		}
+		if err == nil {
+			err = s.authorize(meta, client)
+		}
+		if err != nil {
+			if s.Metrics != nil {
+				s.Metrics.Observe(meta, time.Since(start), err)
+			}
+			if _, ok := err.(recoverableError); ok {
+				continue
+			}
+			return err
 		}
 		switch meta.EndpointType {
 		case EndpointRequest:
-			err = s.handleRequestConn(meta, client)
+			if meta.Endpoint == CompressionEndpoint {
+				err = s.handleCompression(meta, client)
+				break
+			}
+			err = s.handleRequestConn(ctx, meta, client)
+		case EndpointOneWay:
+			err = s.handleRequestConn(ctx, meta, client)
 		case EndpointStream:
-			err = s.handleStreamingConn(meta, client)
+			err = s.handleStreamingConn(ctx, meta, client)
+		case EndpointHello:
+			err = s.handleHello(meta, client, first)
+		case EndpointCancel:
+			// The request it was meant for has already been answered.
+			if _, err = io.CopyN(io.Discard, client, meta.BodySize); err != nil {
+				err = s.logReadError(client, "cancel frame body", err)
+			}
 		default:
 			s.maybeLogf("Invalid endpoint type specified: %v", meta.EndpointType)
-			return
+			return errInvalidEndpointType
+		}
+		if err == errParked { // Observed once the stream ends.
+			return err
+		}
+		closing := err == errCloseAfterResponse
+
+		if closing {
+			err = nil
+		}
+		if s.Metrics != nil {
+			s.Metrics.Observe(meta, time.Since(start), err)
+		}
+		if closing {
+			return io.EOF
+		}
+		if _, ok := err.(recoverableError); ok {
+			continue
 		}
 		if err != nil {
-			return
+			return err
 		}
 	}
 }
 
-func (s *Server) handleStreamingConn(meta Metadata, client *Client) error {
-	endpoint, ok := s.streamingEndpoints[meta.Endpoint]
+func (s *Server) handleStreamingConn(ctx context.Context, meta Metadata, client *Client) error {
+	if meta.Endpoint == "" {
+		s.maybeLogf("Received a %s frame without an endpoint from %v", EndpointTypeName(meta.EndpointType), client.RemoteAddr())
 
-	if !ok {
-		s.maybeLogf("Could not find requested endpoint: %v", meta.Endpoint)
+		if _, err := client.writeError(meta.Endpoint, CodeBadRequest, ErrEmptyEndpoint.Error()); err != nil {
+			s.logWriteError(client, "error frame", err)
+		}
+		return ErrEmptyEndpoint
+	}
+	endpoint, ok := s.dispatcher().StreamingHandler(meta)
+	events, isEvent := s.eventEndpoint(meta.Endpoint)
+
+	if !ok && !isEvent {
+		s.maybeLogf("Could not find requested %s endpoint: %v", EndpointTypeName(meta.EndpointType), meta.Endpoint)
+
+		// The rest of the connection belongs to the stream, so it cannot be
+		// resynchronized; the client is told why before it gets closed.
+		if _, err := client.writeError(meta.Endpoint, CodeNotFound, errInvalidEndpoint.Error()); err != nil {
+			s.logWriteError(client, "error frame", err)
+		}
 		return errInvalidEndpoint
 	}
-	return endpoint(meta, client)
+	// The request deadline does not apply to streams; the endpoint is free to
+	// set its own.
+	if err := client.SetDeadline(time.Time{}); err != nil {
+		s.maybeLogf("Error clearing deadline on connection: %v", err)
+		return err
+	}
+	client.MaxMessageSize = s.MaxMessageSize
+	client.CloseOnLargeMessage = true
+
+	if isEvent {
+		return s.serveEvents(ctx, meta, client, events)
+	}
+	err := endpoint(ctx, meta, client)
+
+	if err != nil {
+		s.maybeLogf("Error serving %s endpoint %v: %v", EndpointTypeName(meta.EndpointType), meta.Endpoint, err)
+	}
+	return err
 }
 
-func (s *Server) handleRequestConn(meta Metadata, client *Client) error {
-	endpoint, ok := s.requestEndpoints[meta.Endpoint]
+func (s *Server) handleRequestConn(ctx context.Context, meta Metadata, client *Client) error {
+	s.counters.requests.Add(1)
+
+	if meta.EndpointID != 0 && meta.Endpoint == "" {
+		meta.Endpoint, _ = s.endpointName(meta.EndpointID)
+	}
+	if meta.Endpoint == "" && meta.EndpointID == 0 {
+		s.maybeLogf("Received a %s frame without an endpoint from %v", EndpointTypeName(meta.EndpointType), client.RemoteAddr())
+		return s.reject(meta, client, CodeBadRequest, ErrEmptyEndpoint)
+	}
+	endpoint, ok := s.dispatcher().RequestHandler(meta)
 
 	if !ok {
-		s.maybeLogf("Could not find requested endpoint: %v", meta.Endpoint)
-		return errInvalidEndpoint
+		s.maybeLogf("Could not find requested %s endpoint: %v (#%d)", EndpointTypeName(meta.EndpointType), meta.Endpoint, meta.EndpointID)
+		return s.reject(meta, client, CodeNotFound, errInvalidEndpoint)
+	}
+	unbuffered := s.isUnbuffered(meta)
+
+	if !unbuffered && s.MaxBodySize > 0 && meta.BodySize > s.MaxBodySize {
+		s.maybeLogf("Rejecting %d byte body for %s endpoint %v, limit is %d", meta.BodySize, EndpointTypeName(meta.EndpointType), meta.Endpoint, s.MaxBodySize)
+		return s.reject(meta, client, CodePayloadTooLarge, ErrBodyTooLarge)
+	}
+	if meta.Priority != 0 {
+		s.maybeLogf("Serving %s endpoint %v with priority %d", EndpointTypeName(meta.EndpointType), meta.Endpoint, meta.Priority)
 	}
-	body, err := client.ReadBody(meta)
+	s.counters.countEndpoint(meta.Endpoint)
+	endpoint = s.applyMiddleware(endpoint)
+	trace := s.traceRequest(meta, client)
 
+	var (
+		body      []byte
+		err       error
+		pooled    *[smallBodySize]byte
+		abandoned bool        // Whether the endpoint may still be using the body.
+		unread    *bodyReader // The body left on the connection, for unbuffered endpoints.
+	)
+	if unbuffered {
+		unread = &bodyReader{r: client, remaining: meta.BodySize}
+	} else if meta.BodySize > 0 && meta.BodySize <= int64(s.BodyBufferSize) {
+		if client.bodyBuf == nil {
+			client.bodyBuf = make([]byte, s.BodyBufferSize)
+		}
+		body, err = client.readBodyInto(meta, client.bodyBuf)
+	} else if meta.BodySize > 0 && meta.BodySize <= smallBodySize {
+		pooled = smallBodies.Get().(*[smallBodySize]byte)
+
+		defer func() {
+			if !abandoned {
+				smallBodies.Put(pooled)
+			}
+		}()
+
+		body, err = client.readBodyInto(meta, pooled[:])
+	} else {
+		body, err = client.ReadBody(meta)
+	}
 	if err != nil {
-		s.logReadError(err, "Unable to read body")
-		return err
+		return s.logReadError(client, "body", err)
 	}
-	wbuf := &bytes.Buffer{}
-	rbuf := bytes.NewBuffer(body)
+	trace.read()
 
-	if err = endpoint(meta, wbuf, rbuf); err != nil {
-		s.maybeLogf("Error serving endpoint: %v", err)
-		return err
+	// The context of the request also ends with its timeout, if it has one.
+	var cancel context.CancelFunc
+
+	if meta.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, meta.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
 	}
-	if _, err = client.WriteData(meta.Endpoint, wbuf.Bytes()); err != nil {
-		s.maybeLogf("Error writing response: %v", err)
-		return err
+	wbuf := &responseWriter{Buffer: s.responseBuffer(client), client: client, ctx: ctx}
+
+	if unread != nil {
+		// The endpoint reads from the connection, so it is neither abandoned
+		// nor watched for cancel frames, and the rest of its body is skipped.
+		err = endpoint(ctx, meta, wbuf, unread)
+
+		if _, derr := io.Copy(io.Discard, unread); derr != nil {
+			cancel()
+			return s.logReadError(client, "body", derr)
+		}
+	} else if meta.EndpointType == EndpointOneWay {
+		// Nobody waits for the outcome of a one-way request, so it is never
+		// cancelled either.
+		abandoned, err = callEndpoint(ctx, endpoint, meta, wbuf, bytes.NewBuffer(body))
+	} else {
+		stopWatching := client.watchCancel(cancel)
+		abandoned, err = callEndpoint(ctx, endpoint, meta, wbuf, bytes.NewBuffer(body))
+		stopWatching()
 	}
-	if err = s.setDeadline(client); err != nil {
-		s.maybeLogf("Error setting deadline on connection: %v", err)
-		return err
+	err = canceledError(ctx, err)
+
+	if abandoned {
+		s.maybeLogf("Abandoned %s endpoint %v after its %v timeout", EndpointTypeName(meta.EndpointType), meta.Endpoint, meta.Timeout)
+
+		// The endpoint may still use the buffers of the connection.
+		client.bodyBuf, client.respBuf = nil, nil
+	}
+	cancel()
+	trace.handled()
+
+	if err != nil {
+		s.maybeLogf("Error serving %s endpoint %v: %v", EndpointTypeName(meta.EndpointType), meta.Endpoint, err)
+
+		var (
+			e *Error
+			r *Redirect
+		)
+		if errors.As(err, &r) {
+			return s.redirect(meta, client, r)
+		}
+		if !errors.As(err, &e) {
+			e = &Error{Code: CodeInternal, Message: err.Error()}
+		}
+		if meta.EndpointType == EndpointOneWay {
+			trace.written(0)
+			return recoverableError{err}
+		}
+		n, werr := client.writeErrorFrame(meta.Endpoint, e)
+
+		if werr != nil {
+			return s.logWriteError(client, "error frame", werr)
+		}
+		trace.written(n)
+		return recoverableError{err}
+	}
+	n := 0
+
+	if meta.EndpointType != EndpointOneWay {
+		if n, err = client.WriteData(meta.Endpoint, wbuf.Bytes()); err != nil {
+			return s.logWriteError(client, "response", err)
+		}
+	}
+	trace.written(n)
+
+	if wbuf.closeAfter {
+		return errCloseAfterResponse
 	}
 	return nil
 }
 
-// This is a simple wrapper around the stdlib's logging facilities. It checks
-// if logging was requested, then logs the message. If logging was not requested,
-// nothing happens.
+// responseBuffer is used to get the buffer a response is written to. With a
+// BodyBufferSize, the buffer of the connection is reset and reused, unless the
+// last response outgrew it.
+func (s *Server) responseBuffer(client *Client) *bytes.Buffer {
+	if s.BodyBufferSize <= 0 {
+		return &bytes.Buffer{}
+	}
+	if client.respBuf == nil || client.respBuf.Cap() > s.BodyBufferSize {
+		client.respBuf = bytes.NewBuffer(make([]byte, 0, s.BodyBufferSize))
+	}
+	client.respBuf.Reset()
+	return client.respBuf
+}
+
+// bodyReader is used to read the body of a request from the connection, for
+// unbuffered endpoints. It ends after the body, and reports a connection that
+// ends sooner with io.ErrUnexpectedEOF.
+type bodyReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (r *bodyReader) Read(b []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.r.Read(b)
+	r.remaining -= int64(n)
+
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// callEndpoint is used to run a request endpoint. Without a Timeout, it runs on
+// the goroutine of the connection. Otherwise, it runs on its own, and if it is
+// still running once the Timeout elapses, it is abandoned: the connection moves
+// on, leaving the endpoint to return whenever it notices that its context is
+// done, and the context's error is returned. Requests cancelled for other
+// reasons are still waited for.
+func callEndpoint(ctx context.Context, endpoint RequestEndpoint, meta Metadata, w io.Writer, r io.Reader) (abandoned bool, err error) {
+	if meta.Timeout <= 0 {
+		return false, endpoint(ctx, meta, w, r)
+	}
+	done := make(chan error, 1)
+
+	go func() { done <- endpoint(ctx, meta, w, r) }()
+
+	select {
+	case err = <-done:
+		return false, err
+	case <-ctx.Done():
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		return false, <-done
+	}
+	select {
+	case err = <-done: // It returned at the same time.
+		return false, err
+	default:
+		return true, ctx.Err()
+	}
+}
+
+// This is a simple wrapper around the logging facilities. It checks if logging
+// was requested, then logs the message. If logging was not requested, nothing
+// happens.
 func (s *Server) maybeLogf(format string, v ...interface{}) {
-	if s.Log {
-		log.Printf(format, v...)
+	if s.Log || s.Logger != nil {
+		s.output(fmt.Sprintf(format, v...))
 	}
 }
 
-// This is a simple wrapper around the stdlib's logging facilities. It checks
-// if logging was requested, then logs the message. If logging was not requested,
-// nothing happens.
+// This is a simple wrapper around the logging facilities. It checks if logging
+// was requested, then logs the message. If logging was not requested, nothing
+// happens.
 func (s *Server) maybeLogln(v ...interface{}) {
-	if s.Log {
-		log.Println(v...)
+	if s.Log || s.Logger != nil {
+		s.output(fmt.Sprintln(v...))
+	}
+}
+
+// output writes a formatted log message, either directly or through the async
+// log queue if AsyncLog was requested.
+func (s *Server) output(msg string) {
+	if s.AsyncLog <= 0 {
+		s.print(msg)
+		return
+	}
+	s.asyncLogMu.RLock()
+	defer s.asyncLogMu.RUnlock()
+
+	if s.asyncLogClosed {
+		s.print(msg)
+		return
+	}
+	s.asyncLogOnce.Do(func() {
+		s.asyncLogs = make(chan string, s.AsyncLog)
+		s.asyncLogDone = make(chan struct{})
+
+		go func() {
+			defer close(s.asyncLogDone)
+
+			for msg := range s.asyncLogs {
+				s.print(msg)
+			}
+		}()
+	})
+	if s.AsyncLogPolicy == LogBlock {
+		s.asyncLogs <- msg
+		return
+	}
+	select {
+	case s.asyncLogs <- msg:
+	default: // The queue is full; drop the message rather than wait.
 	}
 }
 
+// flushLogs is used to stop the async log queue once the server has shut down,
+// after the messages left on it were logged.
+func (s *Server) flushLogs() {
+	s.asyncLogMu.Lock()
+	defer s.asyncLogMu.Unlock()
+
+	s.asyncLogClosed = true
+
+	if s.asyncLogs != nil {
+		close(s.asyncLogs)
+		<-s.asyncLogDone
+	}
+}
+
+// print writes a log message to the Logger, or to the standard logger.
+func (s *Server) print(msg string) {
+	if s.Logger == nil {
+		log.Print(msg)
+		return
+	}
+	s.Logger.Printf("%s", strings.TrimSuffix(msg, "\n"))
+}
+
+// ConnError describes a failed read or write on a client connection: what the
+// server was doing, and who it was talking to. It is the reason given to
+// OnConnClose for connections that end this way, and what gets logged, which
+// helps to tell network problems apart when connections misbehave.
+type ConnError struct {
+	Op    string   // Either "read" or "write".
+	Phase string   // What was being read or written, such as "header" or "response".
+	Addr  net.Addr // The remote address of the connection.
+	Err   error    // The underlying error.
+}
+
+func (e *ConnError) Error() string {
+	if e.Op == "write" {
+		return fmt.Sprintf("writing %s to %v: %v", e.Phase, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("reading %s from %v: %v", e.Phase, e.Addr, e.Err)
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
 // This function is designed to help simplify logging errors from io.Readers. We
 // can  encounter the io.EOF error, which doesn't mean a problem occurred,
-// simply that the client disconnected, so we just discard those errors.
-func (s *Server) logReadError(err error, msg string) {
-	if err == io.EOF { // Client disconnected; no need to log
-		return
+// simply that the client disconnected, so we just discard those errors. The
+// error is returned wrapped in a *ConnError.
+func (s *Server) logReadError(client *Client, phase string, err error) error {
+	// Past the header, the connection ended partway through a frame.
+	if err == io.EOF && phase != "header" {
+		err = io.ErrUnexpectedEOF
 	}
-	s.maybeLogln(msg, err)
+	cerr := &ConnError{Op: "read", Phase: phase, Addr: client.RemoteAddr(), Err: err}
+
+	if err != io.EOF { // Client disconnected; no need to log
+		s.maybeLogf("Error %v", cerr)
+	}
+	return cerr
+}
+
+// logWriteError is the counterpart of logReadError for writes. A client that
+// disconnects without waiting for its response is not a problem with the
+// server, so it is only mentioned in passing rather than reported as an error.
+func (s *Server) logWriteError(client *Client, phase string, err error) error {
+	cerr := &ConnError{Op: "write", Phase: phase, Addr: client.RemoteAddr(), Err: err}
+
+	if clientGone(err) {
+		s.maybeLogf("Client went away before the response was written: %v", cerr)
+	} else {
+		s.maybeLogf("Error %v", cerr)
+	}
+	return cerr
+}
+
+// clientGone reports whether err means that the peer closed the connection.
+func clientGone(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED)
 }
 
 // If timeouts were requested, we set the deadline here. This could prevent
@@ -348,6 +1634,16 @@ func (s *Server) setDeadline(client *Client) error {
 	return nil
 }
 
+// sleep pauses the accept loop between retries. It can be swapped out in tests
+// to observe the backoff without actually waiting.
+func (s *Server) sleep(d time.Duration) {
+	if s.sleepFunc != nil {
+		s.sleepFunc(d)
+		return
+	}
+	time.Sleep(d)
+}
+
 func newDeadline(duration time.Duration) time.Time {
 	return time.Now().Add(duration)
 }
@@ -356,6 +1652,13 @@ func defaultRetries() (timeout time.Duration, tries int) {
 	return 10 * time.Millisecond, 0
 }
 
-func incrementRetries(timeout time.Duration, tries int) (time.Duration, int) {
-	return timeout * 2, tries + 1
+// incrementRetries doubles the timeout, never letting it grow past max. A max
+// of zero or less leaves the backoff uncapped.
+func incrementRetries(timeout time.Duration, tries int, max time.Duration) (time.Duration, int) {
+	timeout *= 2
+
+	if max > 0 && timeout > max {
+		timeout = max
+	}
+	return timeout, tries + 1
 }
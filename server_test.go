@@ -2,12 +2,26 @@ package srv
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -117,7 +131,7 @@ func TestIncrementTries(t *testing.T) {
 
 			wantTimeout := tt.timeout * 2
 			wantTries := tt.tries + 1
-			timeout, tries := incrementRetries(tt.timeout, tt.tries)
+			timeout, tries := incrementRetries(tt.timeout, tt.tries, 0)
 
 			if timeout != wantTimeout {
 				t.Errorf("timeout = %v, want %v", timeout, wantTimeout)
@@ -129,6 +143,1982 @@ func TestIncrementTries(t *testing.T) {
 	}
 }
 
+func TestIncrementRetriesMaxBackoff(t *testing.T) {
+	max := 50 * time.Millisecond
+	timeout, tries := defaultRetries()
+
+	for i := 0; i < 10; i++ {
+		timeout, tries = incrementRetries(timeout, tries, max)
+
+		if timeout > max {
+			t.Fatalf("timeout = %v after %v tries, want at most %v", timeout, tries, max)
+		}
+	}
+	if timeout != max {
+		t.Errorf("timeout = %v, want %v", timeout, max)
+	}
+	if tries != 10 {
+		t.Errorf("tries = %v, want %v", tries, 10)
+	}
+}
+
+// tempError is a net.Error reporting a temporary, non-timeout failure, like
+// running out of file descriptors.
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// scriptedListener is a net.Listener that returns a fixed sequence of
+// accept results. A nil entry produces a successful accept. Once the script
+// runs out, Accept fails with errScriptDone.
+type scriptedListener struct {
+	script []error
+}
+
+var errScriptDone = errors.New("script done")
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	if len(l.script) == 0 {
+		return nil, errScriptDone
+	}
+	err := l.script[0]
+	l.script = l.script[1:]
+
+	if err != nil {
+		return nil, err
+	}
+	server, client := net.Pipe()
+	client.Close()
+	return server, nil
+}
+
+func (l *scriptedListener) Close() error   { return nil }
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServerServeBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackoff time.Duration
+		script     []error
+		want       []time.Duration
+	}{
+		{
+			"capped",
+			30 * time.Millisecond,
+			[]error{tempError{}, tempError{}, tempError{}},
+			[]time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond},
+		},
+		{
+			"reset after success",
+			time.Second,
+			[]error{tempError{}, tempError{}, nil, tempError{}},
+			[]time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 20 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var slept []time.Duration
+
+			s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+			s.MaxBackoff = tt.maxBackoff
+			s.sleepFunc = func(d time.Duration) { slept = append(slept, d) }
+
+			if err := s.serve(&scriptedListener{script: tt.script}); err != errScriptDone {
+				t.Errorf("serve() error = %v, want %v", err, errScriptDone)
+			}
+			if !reflect.DeepEqual(slept, tt.want) {
+				t.Errorf("backoff = %v, want %v", slept, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerServeRetryReset(t *testing.T) {
+	var script []error
+
+	for i := 0; i < 5; i++ {
+		script = append(script, tempError{}, tempError{}, nil)
+	}
+	s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+	s.MaxRetries = 2
+	s.sleepFunc = func(time.Duration) {}
+
+	if err := s.serve(&scriptedListener{script: script}); err != errScriptDone {
+		t.Errorf("serve() error = %v, want %v", err, errScriptDone)
+	}
+
+	// Without any successes in between, consecutive errors trip the retry
+	// limit.
+	script = []error{tempError{}, tempError{}, tempError{}, tempError{}}
+
+	if err := s.serve(&scriptedListener{script: script}); err != (tempError{}) {
+		t.Errorf("serve() error = %v, want %v", err, tempError{})
+	}
+}
+
+func TestServerOnListenError(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  []error
+		want    []bool
+		wantErr error
+	}{
+		{"retry limit", []error{tempError{}, tempError{}, tempError{}, tempError{}}, []bool{true, true, true, false}, tempError{}},
+		{"permanent error", []error{tempError{}}, []bool{true, false}, errScriptDone},
+		{"successes are not reported", []error{nil, nil}, []bool{false}, errScriptDone},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got []bool
+
+			s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+			s.MaxRetries = 2
+			s.sleepFunc = func(time.Duration) {}
+			s.OnListenError = func(err error, willRetry bool) { got = append(got, willRetry) }
+
+			if err := s.serve(&scriptedListener{script: tt.script}); err != tt.wantErr {
+				t.Errorf("serve() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("willRetry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConcurrentShutdown(t *testing.T) {
+	s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+	listenErr := make(chan error, 1)
+
+	go func() { listenErr <- s.Listen() }()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			s.Shutdown()
+		}()
+	}
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return for every caller")
+	}
+	if err := <-listenErr; err != nil {
+		t.Errorf("Listen error = %v, want nil", err)
+	}
+	s.Shutdown() // Calling it again after the fact must not block either.
+}
+
+func TestServerShutdownWaitsForOnConnClose(t *testing.T) {
+	var done atomic.Bool
+
+	s := newEchoServer()
+	s.OnConnClose = func(conn net.Conn, reason error) {
+		time.Sleep(100 * time.Millisecond)
+		done.Store(true)
+	}
+	client := s.NewInMemoryClient()
+
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")}); err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	client.Close()
+	s.Shutdown()
+
+	if !done.Load() {
+		t.Error("Shutdown returned before OnConnClose")
+	}
+}
+
+// slowListener is a listener that takes a while to return from Accept once it
+// is closed, and records when it did.
+type slowListener struct {
+	closed   chan struct{}
+	once     sync.Once
+	returned atomic.Bool
+}
+
+func (l *slowListener) Accept() (net.Conn, error) {
+	<-l.closed
+	time.Sleep(100 * time.Millisecond)
+	l.returned.Store(true)
+	return nil, net.ErrClosed
+}
+
+func (l *slowListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *slowListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServerWait(t *testing.T) {
+	s := newEchoServer()
+	listenOn(t, s)
+	slow := &slowListener{closed: make(chan struct{})}
+
+	go s.serve(slow)
+
+	select {
+	case <-s.Done():
+		t.Fatal("Done was closed before Shutdown")
+	case <-time.After(50 * time.Millisecond):
+	}
+	go s.Shutdown()
+
+	waited := make(chan struct{})
+
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Shutdown")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Done was not closed after Wait returned")
+	}
+	if !slow.returned.Load() {
+		t.Error("Wait returned before every listener was closed")
+	}
+}
+
+func TestServerShutdownWithoutListener(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *Server)
+	}{
+		{"idle", func(s *Server) {}},
+		{"shut down", func(s *Server) { s.Shutdown() }},
+		{"in-memory client", func(s *Server) {
+			client := s.NewInMemoryClient()
+			client.Close()
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			tt.setup(s)
+			done := make(chan error, 1)
+
+			go func() {
+				s.Shutdown()
+				s.Shutdown()
+				done <- s.ShutdownTimeout(time.Second)
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("ShutdownTimeout error = %v, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Shutdown blocked without a listener")
+			}
+
+			// Listening afterwards serves nothing.
+			listenErr := make(chan error, 1)
+
+			go func() { listenErr <- s.serve(&scriptedListener{}) }()
+
+			select {
+			case err := <-listenErr:
+				if err != nil {
+					t.Errorf("Listen error = %v, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Listen did not return after Shutdown")
+			}
+		})
+	}
+}
+
+func TestServerShutdownCancelsEndpoints(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *Server, canceled chan<- error)
+		open  func(client *Client) error
+	}{
+		{
+			"request",
+			func(s *Server, canceled chan<- error) {
+				s.AddRequestEndpoint("block", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+					<-ctx.Done()
+					canceled <- ctx.Err()
+					return ctx.Err()
+				})
+			},
+			func(client *Client) error {
+				_, err := client.WriteDataString("block", "")
+				return err
+			},
+		},
+		{
+			"stream",
+			func(s *Server, canceled chan<- error) {
+				s.AddStreamingEndpoint("block", func(ctx context.Context, meta Metadata, client *Client) error {
+					<-ctx.Done()
+					canceled <- ctx.Err()
+					return ctx.Err()
+				})
+			},
+			func(client *Client) error {
+				_, err := client.WriteMeta(Metadata{EndpointType: EndpointStream, Endpoint: "block"})
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			canceled := make(chan error, 1)
+			s := NewInMemoryServer()
+			tt.setup(s, canceled)
+			client, err := NewClient(ProtocolTCP, listenOn(t, s))
+
+			if err != nil {
+				t.Fatalf("Could not connect: %v", err)
+			}
+			defer client.Close()
+
+			if err = tt.open(client); err != nil {
+				t.Fatalf("Could not reach the endpoint: %v", err)
+			}
+			// The endpoint only returns once its context is cancelled, so
+			// Shutdown could not return otherwise.
+			go s.Shutdown()
+
+			select {
+			case err := <-canceled:
+				if err != context.Canceled {
+					t.Errorf("context error = %v, want %v", err, context.Canceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("The context was not cancelled by Shutdown")
+			}
+		})
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	const limit = 2
+
+	tests := []struct {
+		name   string
+		policy ConnPolicy
+	}{
+		{"reject", ConnReject},
+		{"wait", ConnWait},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rejected := make(chan error, 10)
+			s := newEchoServer()
+			s.MaxConnections = limit
+			s.MaxConnectionsPolicy = tt.policy
+			s.OnConnClose = func(conn net.Conn, reason error) {
+				if reason == ErrTooManyConnections {
+					rejected <- reason
+				}
+			}
+			addr := listenOn(t, s)
+			echo := func(client *Client) error {
+				if _, err := client.WriteDataString("echo", "hello"); err != nil {
+					return err
+				}
+				_, _, err := client.ReadData()
+				return err
+			}
+			clients := make([]*Client, limit+1)
+
+			for i := range clients {
+				client, err := NewClient(ProtocolTCP, addr)
+
+				if err != nil {
+					t.Fatalf("Could not connect: %v", err)
+				}
+				defer client.Close()
+
+				clients[i] = client
+			}
+			for i, client := range clients[:limit] {
+				if err := echo(client); err != nil {
+					t.Fatalf("Connection %d was not served: %v", i, err)
+				}
+			}
+			excess := make(chan error, 1)
+
+			go func() { excess <- echo(clients[limit]) }()
+
+			if tt.policy == ConnReject {
+				if err := <-excess; err == nil {
+					t.Error("The connection over the limit was served")
+				}
+				select {
+				case <-rejected:
+				case <-time.After(5 * time.Second):
+					t.Error("OnConnClose was not told about the rejected connection")
+				}
+				return
+			}
+			select {
+			case err := <-excess:
+				t.Fatalf("The connection over the limit did not wait, got %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			clients[0].Close()
+
+			if err := <-excess; err != nil {
+				t.Errorf("The waiting connection was not served once a slot freed: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	s := newEchoServer()
+	started := make(chan struct{})
+
+	// The endpoint ignores its context, and only returns once its connection
+	// is closed.
+	s.AddStreamingEndpoint("hang", func(ctx context.Context, meta Metadata, client *Client) error {
+		close(started)
+		_, err := io.Copy(io.Discard, client)
+		return err
+	})
+	client := openStream(t, listenOn(t, s), "hang")
+
+	defer client.Close()
+
+	<-started
+	start := time.Now()
+
+	if err := s.ShutdownTimeout(100 * time.Millisecond); err != ErrShutdownTimedOut {
+		t.Errorf("error = %v, want %v", err, ErrShutdownTimedOut)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ShutdownTimeout took %v", elapsed)
+	}
+	done := make(chan struct{})
+
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The hung connection was not closed")
+	}
+
+	// Once the server is down, there is nothing left to wait for.
+	if err := s.ShutdownTimeout(time.Millisecond); err != nil {
+		t.Errorf("error = %v, want nil", err)
+	}
+}
+
+func TestServerFirstAccept(t *testing.T) {
+	s := newEchoServer()
+	listener, err := net.Listen(ProtocolTCP, "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+
+	go func() { serveErr <- s.serve(listener) }()
+
+	start := time.Now()
+	client, err := NewClient(ProtocolTCP, listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err = client.WriteDataString("echo", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, body, err := client.ReadDataString(); err != nil || body != "hello" {
+		t.Fatalf("body = %q, %v, want %q", body, err, "hello")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("first request took %v, want it served without waiting on the listener", elapsed)
+	}
+	client.Close()
+
+	start = time.Now()
+	s.Shutdown()
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("serve error = %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Shutdown took %v, want it to interrupt Accept", elapsed)
+	}
+}
+
+func TestServerServeConn(t *testing.T) {
+	s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(clientConn)
+	done := make(chan struct{})
+
+	s.AddRequestEndpoint("echo", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+
+	go func() {
+		s.ServeConn(serverConn)
+		close(done)
+	}()
+
+	for _, body := range []string{"hello", "world"} {
+		if _, err := client.WriteDataString("echo", body); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		meta, got, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		if meta.Endpoint != "echo" {
+			t.Errorf("endpoint = %v, want %v", meta.Endpoint, "echo")
+		}
+		if got != body {
+			t.Errorf("body = %v, want %v", got, body)
+		}
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("ServeConn did not return after the client disconnected")
+	}
+}
+
+func TestServerPipelinedRequests(t *testing.T) {
+	s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer l.Close()
+
+	s.AddRequestEndpoint("echo", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+		s.ServeConn(conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatalf("Could not dial: %v", err)
+	}
+	client := NewClientConn(conn)
+
+	defer client.Close()
+
+	// Every frame goes out in a single write, so the server sees several
+	// headers and bodies in the same segment.
+	bodies := []string{"first", "", "third\x00with\x00nulls", strings.Repeat("x", 4096), "last"}
+	buf := &bytes.Buffer{}
+
+	for _, body := range bodies {
+		meta := Metadata{BodySize: int64(len(body)), Endpoint: "echo"}
+
+		buf.Write(meta.Encode())
+		buf.WriteString(body)
+	}
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("Could not write requests: %v", err)
+	}
+	for i, want := range bodies {
+		meta, got, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response %d: %v", i, err)
+		}
+		if meta.Endpoint != "echo" {
+			t.Errorf("response %d: endpoint = %q, want %q", i, meta.Endpoint, "echo")
+		}
+		if got != want {
+			t.Errorf("response %d: body = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestServerSplitHeaders(t *testing.T) {
+	s := newEchoServer()
+	serverConn, clientConn := net.Pipe()
+	client := NewClientConn(clientConn)
+
+	go s.ServeConn(serverConn)
+
+	defer client.Close()
+
+	// The frames are sent a few bytes at a time, with pauses in between, so
+	// that the server has to reassemble every header from many reads, and the
+	// second header starts in the middle of a write.
+	bodies := []string{"hello", "world"}
+	var frames []byte
+
+	for _, body := range bodies {
+		frames = append(frames, Metadata{BodySize: int64(len(body)), Endpoint: "echo"}.Encode()...)
+		frames = append(frames, body...)
+	}
+	go func() {
+		for len(frames) > 0 {
+			n := 3
+
+			if len(frames) < n {
+				n = len(frames)
+			}
+			if _, err := clientConn.Write(frames[:n]); err != nil {
+				return
+			}
+			frames = frames[n:]
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	for i, want := range bodies {
+		_, got, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response %d: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("response %d: body = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestServerPipelinedRequestsInOrder(t *testing.T) {
+	s := NewInMemoryServer()
+
+	// Each request takes as many milliseconds as its body says, so that later
+	// requests would finish first if they were served concurrently.
+	s.AddRequestEndpoint("sleep", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		body, err := io.ReadAll(r)
+
+		if err != nil {
+			return err
+		}
+		ms, err := strconv.Atoi(string(body))
+
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		_, err = w.Write(body)
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	bodies := []string{"50", "40", "30", "20", "10", "0"}
+
+	go func() {
+		for _, body := range bodies {
+			if _, err := client.WriteDataString("sleep", body); err != nil {
+				return
+			}
+		}
+	}()
+	for i, want := range bodies {
+		_, got, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response %d: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("response %d: body = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// reuseServer returns a server whose endpoints answer in ways that depend on
+// everything about the request, for TestServerConnectionReuse.
+func reuseServer() *Server {
+	s := newEchoServer()
+	s.AddRequestEndpoint("describe", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		body, err := io.ReadAll(r)
+
+		if err != nil {
+			return err
+		}
+		_, deadline := ctx.Deadline()
+		_, err = fmt.Fprint(w, describeRequest(meta.Endpoint, meta.UserID, meta.ContentType, len(body), deadline))
+		return err
+	})
+	s.AddRequestEndpoint("reverse", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		body, err := io.ReadAll(r)
+
+		for i, j := 0, len(body)-1; i < j; i, j = i+1, j-1 {
+			body[i], body[j] = body[j], body[i]
+		}
+		w.Write(body)
+		return err
+	})
+	return s
+}
+
+func describeRequest(endpoint string, userID int64, contentType string, size int, deadline bool) string {
+	return fmt.Sprintf("%s user=%d type=%q size=%d deadline=%v", endpoint, userID, contentType, size, deadline)
+}
+
+// TestServerConnectionReuse sends many different requests on one connection,
+// checking every response against its request, so that state left behind by a
+// request cannot go unnoticed.
+func TestServerConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(s *Server)
+		compact   bool
+		pipelined bool // Whether the requests are all sent before reading the responses.
+	}{
+		{"default", func(s *Server) {}, false, false},
+		{"body buffer", func(s *Server) { s.BodyBufferSize = 64 }, false, false},
+		{"max timeout", func(s *Server) { s.MaxTimeout = 5 * time.Second }, false, false},
+		{"compact headers", func(s *Server) {}, true, false},
+		{"pipelined", func(s *Server) {}, false, true},
+		{"pipelined body buffer", func(s *Server) { s.BodyBufferSize = 64 }, false, true},
+		{"pipelined compact headers", func(s *Server) {}, true, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := reuseServer()
+			tt.setup(s)
+			ids := s.EndpointIDs()
+			requestSizes := make(chan int64, 200)
+			s.OnRequestStats = func(stats RequestStats) { requestSizes <- stats.RequestSize }
+			client, err := NewClient(ProtocolTCP, listenOn(t, s))
+
+			if err != nil {
+				t.Fatalf("Could not connect: %v", err)
+			}
+			defer client.Close()
+
+			client.CompactHeaders = tt.compact
+
+			if _, err = client.Handshake(); err != nil {
+				t.Fatalf("Handshake error = %v, want nil", err)
+			}
+			endpoints := []string{"echo", "describe", "reverse"}
+			sizes := []int{0, 1, 63, 64, 65, 4096, 1 << 20, 3}
+			contentTypes := []string{"", "text/plain", "application/json"}
+
+			var (
+				requests  []Request
+				wants     [][]byte
+				wantCodes []ErrorCode // The codes of the requests answered with an error frame.
+			)
+			for i := 0; i < 120; i++ {
+				body := make([]byte, sizes[i%len(sizes)])
+
+				for j := range body {
+					body[j] = byte(i + j)
+				}
+				meta := Metadata{
+					Endpoint:    endpoints[i%len(endpoints)],
+					UserID:      int64(i),
+					ContentType: contentTypes[i%len(contentTypes)],
+				}
+				if i%4 == 0 {
+					meta.Timeout = 5 * time.Second
+				}
+				// Rejected bodies are drained, unless they are too large to.
+				if i%7 == 0 && int64(len(body)) <= DefaultMaxDrainBytes {
+					meta.Endpoint = "missing"
+				}
+				var (
+					want     []byte
+					wantCode ErrorCode
+				)
+				switch meta.Endpoint {
+				case "echo":
+					want = append([]byte(nil), body...)
+				case "describe":
+					want = []byte(describeRequest(meta.Endpoint, meta.UserID, meta.ContentType, len(body), meta.Timeout > 0))
+				case "reverse":
+					for j := len(body) - 1; j >= 0; j-- {
+						want = append(want, body[j])
+					}
+				case "missing":
+					wantCode = CodeNotFound
+				}
+				if i%5 == 0 && wantCode == 0 {
+					meta.EndpointID, meta.Endpoint = ids[meta.Endpoint], ""
+				}
+				requests = append(requests, Request{Meta: meta, Body: body})
+				wants, wantCodes = append(wants, want), append(wantCodes, wantCode)
+			}
+			if tt.pipelined {
+				go func() {
+					for _, req := range requests {
+						if _, err := client.WriteRequest(req); err != nil {
+							return
+						}
+					}
+				}()
+			}
+			responses := make([][]byte, len(requests))
+
+			for i, req := range requests {
+				var resp Response
+
+				if tt.pipelined {
+					resp, err = client.ReadResponse()
+				} else {
+					resp, err = client.Send(req)
+				}
+				if wantCodes[i] != 0 {
+					if code, _ := ErrorCodeOf(err); code != wantCodes[i] {
+						t.Fatalf("request %d: error = %v, want code %d", i, err, wantCodes[i])
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("request %d: error = %v, want nil", i, err)
+				}
+				if !bytes.Equal(resp.Body, wants[i]) {
+					t.Fatalf("request %d to %v (#%d): body = %.64q, want %.64q", i, req.Meta.Endpoint, req.Meta.EndpointID, resp.Body, wants[i])
+				}
+				responses[i] = resp.Body
+			}
+			// Responses are not overwritten by the ones that follow.
+			for i := range responses {
+				if !bytes.Equal(responses[i], wants[i]) {
+					t.Errorf("response %d changed after the fact", i)
+				}
+			}
+			// The stats of each request account for the form of its header.
+			for i, req := range requests {
+				if wantCodes[i] != 0 {
+					continue // Rejected requests are not reported.
+				}
+				req.Meta.BodySize = int64(len(req.Body))
+				want := int64(len(client.encodeMeta(req.Meta)) + len(req.Body))
+
+				select {
+				case size := <-requestSizes:
+					if size != want {
+						t.Errorf("request %d: size = %d, want %d", i, size, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("request %d: no stats were reported", i)
+				}
+			}
+		})
+	}
+}
+
+func TestServerMaxBodySize(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int64
+		bodySize int
+		wantCode ErrorCode
+		closed   bool
+	}{
+		{"within the default limit", DefaultMaxBodySize, 1024, CodeUnknown, false},
+		{"over a limit small enough to drain", 8, 9, CodePayloadTooLarge, false},
+		{"over the default limit", DefaultMaxBodySize, DefaultMaxBodySize + 1, CodeUnknown, true},
+		{"without a limit", 0, DefaultMaxBodySize + 1, CodeUnknown, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reasons := make(chan error, 1)
+			s := newEchoServer()
+			s.MaxBodySize = tt.max
+			s.OnConnClose = func(conn net.Conn, reason error) {
+				reasons <- reason
+			}
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			body := bytes.Repeat([]byte("a"), tt.bodySize)
+			resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: body})
+
+			if tt.closed {
+				if err == nil {
+					t.Fatal("The oversized request was served")
+				}
+				if reason := <-reasons; reason != ErrBodyTooLarge {
+					t.Errorf("reason = %v, want %v", reason, ErrBodyTooLarge)
+				}
+				return
+			}
+			if tt.wantCode != CodeUnknown {
+				var e *Error
+
+				if !errors.As(err, &e) || e.Code != tt.wantCode {
+					t.Fatalf("error = %v, want code %d", err, tt.wantCode)
+				}
+				// The body was drained, so the connection is still usable.
+				resp, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hi")})
+				body = []byte("hi")
+			}
+			if err != nil {
+				t.Fatalf("Could not send request: %v", err)
+			}
+			if !bytes.Equal(resp.Body, body) {
+				t.Errorf("body is %d bytes, want %d", len(resp.Body), len(body))
+			}
+		})
+	}
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	reasons := make(chan error, 1)
+	s := NewInMemoryServer()
+	s.MaxMessageSize = 8
+	s.OnConnClose = func(conn net.Conn, reason error) {
+		reasons <- reason
+	}
+	s.AddStreamingEndpoint("messages", func(ctx context.Context, meta Metadata, client *Client) error {
+		for {
+			body, err := client.ReadMessage()
+
+			if err != nil {
+				return err
+			}
+			if _, err = client.WriteMessage(body); err != nil {
+				return err
+			}
+		}
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.WriteMeta(Metadata{EndpointType: EndpointStream, Endpoint: "messages"}); err != nil {
+		t.Fatalf("Could not open stream: %v", err)
+	}
+	if _, err := client.WriteMessage([]byte("hello")); err != nil {
+		t.Fatalf("Could not write message: %v", err)
+	}
+	if body, err := client.ReadMessage(); err != nil || string(body) != "hello" {
+		t.Fatalf("message = %q, %v, want %q", body, err, "hello")
+	}
+
+	// Only the header of the oversized message is sent; the server closes the
+	// connection without waiting for the rest.
+	if _, err := client.WriteMeta(Metadata{EndpointType: EndpointStream, BodySize: 1 << 40}); err != nil {
+		t.Fatalf("Could not write message header: %v", err)
+	}
+	if reason := <-reasons; !errors.Is(reason, ErrMessageTooLarge) {
+		t.Errorf("reason = %v, want %v", reason, ErrMessageTooLarge)
+	}
+	if _, err := client.ReadMessage(); err == nil {
+		t.Error("The connection should be closed")
+	}
+}
+
+// listenOnTLS is like listenOn, but it serves TLS connections using the
+// server's TLS configuration.
+func listenOnTLS(t testing.TB, s *Server) string {
+	listener, err := net.Listen(ProtocolTCP, "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(tls.NewListener(listener, s.tlsConfig()))
+
+	t.Cleanup(s.Shutdown)
+
+	return listener.Addr().String()
+}
+
+// echoOverTLS connects to the server at addr, and makes sure that the
+// connection works with an echo request. It returns the state of the session.
+func echoOverTLS(t testing.TB, addr string, cfg *tls.Config) *tls.ConnectionState {
+	t.Helper()
+
+	conn, err := tls.Dial(ProtocolTCP, addr, cfg)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	client := NewClientConn(conn)
+
+	defer client.Close()
+
+	// Reading the response also picks up the session ticket, which TLS 1.3
+	// sends after the handshake.
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+
+	if err != nil || string(resp.Body) != "hello" {
+		t.Fatalf("response = %q, %v, want %q", resp.Body, err, "hello")
+	}
+	return client.ConnState().TLS
+}
+
+func TestServerTLSSessionResumption(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+
+	tests := []struct {
+		name       string
+		disabled   bool
+		wantResume bool
+	}{
+		{"session tickets", false, true},
+		{"session tickets disabled", true, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, SessionTicketsDisabled: tt.disabled}
+			addr := listenOnTLS(t, s)
+			cfg := &tls.Config{RootCAs: pool, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+
+			if state := echoOverTLS(t, addr, cfg); state.DidResume {
+				t.Fatal("The first connection resumed a session")
+			}
+			if state := echoOverTLS(t, addr, cfg); state.DidResume != tt.wantResume {
+				t.Errorf("resumed = %v, want %v", state.DidResume, tt.wantResume)
+			}
+		})
+	}
+}
+
+// BenchmarkTLSReconnect measures connecting to a TLS server and making a
+// request, with and without resuming the previous session.
+func BenchmarkTLSReconnect(b *testing.B) {
+	cert, pool := selfSignedCert(b)
+
+	for _, bb := range []struct {
+		name  string
+		cache tls.ClientSessionCache
+	}{
+		{"full handshake", nil},
+		{"resumed", tls.NewLRUClientSessionCache(1)},
+	} {
+		bb := bb
+
+		b.Run(bb.name, func(b *testing.B) {
+			s := newEchoServer()
+			s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			addr := listenOnTLS(b, s)
+			cfg := &tls.Config{RootCAs: pool, ClientSessionCache: bb.cache}
+
+			echoOverTLS(b, addr, cfg)
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				echoOverTLS(b, addr, cfg)
+			}
+		})
+	}
+}
+
+// writeCert writes the certificate and its key to PEM files in dir.
+func writeCert(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: der},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("Could not write %s: %v", file, err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// freeAddr returns a TCP address that is free to listen on, for servers that
+// listen on their own.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen(ProtocolTCP, "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+func TestServerListenTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	certFile, keyFile := writeCert(t, t.TempDir(), cert)
+
+	tests := []struct {
+		name       string
+		ca         string
+		clientCert bool
+		wantErr    bool
+	}{
+		{"server certificate", "", false, false},
+		{"mutual TLS", certFile, true, false},
+		{"mutual TLS without a client certificate", certFile, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			addr := freeAddr(t)
+			s, _ := NewServer(ProtocolTCP, addr)
+			s.AddRequestEndpoint("echo", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				_, err := io.Copy(w, r)
+				return err
+			})
+			listenErr := make(chan error, 1)
+
+			go func() { listenErr <- s.ListenTLS(certFile, keyFile, tt.ca) }()
+
+			cfg := &tls.Config{RootCAs: pool}
+
+			if tt.clientCert {
+				cfg.Certificates = []tls.Certificate{cert}
+			}
+			var (
+				client *Client
+				err    error
+			)
+			waitUntil(t, "the server to listen", func() bool {
+				client, err = NewClientTLS(ProtocolTCP, addr, cfg)
+				return err == nil
+			})
+			resp, err := client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")})
+			client.Close()
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("The server accepted a client without a certificate")
+				}
+			} else if err != nil || string(resp.Body) != "hello" {
+				t.Errorf("response = %q, %v, want %q", resp.Body, err, "hello")
+			}
+			s.Shutdown()
+
+			if err := <-listenErr; err != nil {
+				t.Errorf("ListenTLS returned %v", err)
+			}
+		})
+	}
+}
+
+func TestServerListenTLSInvalidFiles(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, cert)
+
+	tests := []struct {
+		name          string
+		cert, key, ca string
+	}{
+		{"missing certificate", filepath.Join(dir, "missing.pem"), keyFile, ""},
+		{"missing CA", certFile, keyFile, filepath.Join(dir, "missing.pem")},
+		{"CA without certificates", certFile, keyFile, keyFile},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, _ := NewServer(ProtocolTCP, "127.0.0.1:0")
+
+			if err := s.ListenTLS(tt.cert, tt.key, tt.ca); err == nil {
+				t.Error("Should return an error")
+			}
+		})
+	}
+}
+
+func TestServerOnConnClose(t *testing.T) {
+	tests := []struct {
+		name   string
+		send   func(client *Client)
+		reason error
+	}{
+		{
+			"clean close",
+			func(client *Client) {
+				client.WriteDataString("echo", "hello")
+				client.ReadData()
+			},
+			io.EOF,
+		},
+		{
+			"invalid endpoint type",
+			func(client *Client) {
+				client.WriteMeta(Metadata{EndpointType: 9, Endpoint: "echo"})
+			},
+			errInvalidEndpointType,
+		},
+		{
+			"empty streaming endpoint",
+			func(client *Client) {
+				client.WriteMeta(Metadata{EndpointType: EndpointStream})
+			},
+			ErrEmptyEndpoint,
+		},
+		{
+			"missing endpoint with an undrainable body",
+			func(client *Client) {
+				client.WriteMeta(Metadata{BodySize: DefaultMaxDrainBytes + 1, Endpoint: "missing"})
+			},
+			errInvalidEndpoint,
+		},
+		{
+			"negative body size",
+			func(client *Client) {
+				client.WriteMeta(Metadata{BodySize: -1, Endpoint: "echo"})
+			},
+			ErrInvalidBodySize,
+		},
+		{
+			"corrupted header",
+			func(client *Client) {
+				header := Metadata{BodySize: 5, Endpoint: "echo"}.Encode()
+				header[24] ^= 0x40 // Claims a body of exabytes.
+
+				client.Write(header)
+			},
+			ErrHeaderChecksum,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reasons := make(chan error, 1)
+			s := newEchoServer()
+			s.OnConnClose = func(conn net.Conn, reason error) {
+				reasons <- reason
+			}
+			client := s.NewInMemoryClient()
+
+			tt.send(client)
+			client.Close()
+
+			select {
+			case reason := <-reasons:
+				if !errors.Is(reason, tt.reason) {
+					t.Errorf("reason = %v, want %v", reason, tt.reason)
+				}
+			case <-time.After(time.Second):
+				t.Error("OnConnClose was not called")
+			}
+		})
+	}
+}
+
+// flakyConn is a connection from a fixed remote address, whose writes can be
+// made to fail as if the peer had reset the connection.
+type flakyConn struct {
+	net.Conn
+	failWrites bool
+}
+
+func (c *flakyConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 4242}
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.failWrites {
+		return 0, syscall.ECONNRESET
+	}
+	return c.Conn.Write(b)
+}
+
+func TestServerConnErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		send    func(client *Client)
+		op      string
+		phase   string
+		wantErr error
+	}{
+		{
+			"truncated header",
+			func(client *Client) {
+				client.Write(Metadata{Endpoint: "echo"}.Encode()[:100])
+			},
+			"read", "header", io.ErrUnexpectedEOF,
+		},
+		{
+			"truncated body",
+			func(client *Client) {
+				client.Write(append(Metadata{Endpoint: "echo", BodySize: 10}.Encode(), "hel"...))
+			},
+			"read", "body", io.ErrUnexpectedEOF,
+		},
+		{
+			"missing body",
+			func(client *Client) {
+				client.Write(Metadata{Endpoint: "echo", BodySize: 10}.Encode())
+			},
+			"read", "body", io.ErrUnexpectedEOF,
+		},
+		{
+			"connection reset before the response",
+			func(client *Client) {
+				client.WriteDataString("echo", "hello")
+			},
+			"write", "response", syscall.ECONNRESET,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reasons := make(chan error, 1)
+			s := newEchoServer()
+			s.OnConnClose = func(conn net.Conn, reason error) {
+				reasons <- reason
+			}
+			serverConn, clientConn := net.Pipe()
+			conn := &flakyConn{Conn: serverConn, failWrites: tt.op == "write"}
+			client := NewClientConn(clientConn)
+
+			go s.ServeConn(conn)
+
+			tt.send(client)
+			client.Close()
+
+			var reason error
+
+			select {
+			case reason = <-reasons:
+			case <-time.After(time.Second):
+				t.Fatal("OnConnClose was not called")
+			}
+			var cerr *ConnError
+
+			if !errors.As(reason, &cerr) {
+				t.Fatalf("reason = %v, want a *ConnError", reason)
+			}
+			if cerr.Op != tt.op || cerr.Phase != tt.phase || cerr.Addr.String() != "10.0.0.5:4242" {
+				t.Errorf("error = %s %s with %v, want %s %s with 10.0.0.5:4242", cerr.Op, cerr.Phase, cerr.Addr, tt.op, tt.phase)
+			}
+			if !errors.Is(reason, tt.wantErr) {
+				t.Errorf("reason = %v, want %v", reason, tt.wantErr)
+			}
+			if msg := reason.Error(); !strings.Contains(msg, tt.phase) || !strings.Contains(msg, "10.0.0.5:4242") {
+				t.Errorf("message %q does not mention the phase and the address", msg)
+			}
+		})
+	}
+}
+
+func TestServerMaxDrainBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		bodySize  int
+		wantReuse bool
+	}{
+		{"empty body", 0, true}, // Written as a separate, empty write, which reads as nothing.
+		{"small body", 1024, true},
+		{"body at the limit", DefaultMaxDrainBytes, true},
+		{"body over the limit", DefaultMaxDrainBytes + 1, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			// The body is written separately, since the server stops reading
+			// it when it closes the connection.
+			go func() {
+				client.WriteMeta(Metadata{BodySize: int64(tt.bodySize), Endpoint: "missing"})
+				client.Write(make([]byte, tt.bodySize))
+			}()
+
+			_, _, err := client.ReadData()
+
+			if !tt.wantReuse {
+				if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+					return
+				}
+				t.Fatalf("error = %v, want the connection to be closed", err)
+			}
+			var srvErr *Error
+
+			if !errors.As(err, &srvErr) {
+				t.Fatalf("error = %v, want an *Error", err)
+			}
+			if srvErr.Endpoint != "missing" || srvErr.Message != errInvalidEndpoint.Error() {
+				t.Errorf("error = %#v, want the missing endpoint rejected", srvErr)
+			}
+			if _, err = client.WriteDataString("echo", "still framed"); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			if _, got, err := client.ReadDataString(); err != nil || got != "still framed" {
+				t.Errorf("response = %q, %v, want %q", got, err, "still framed")
+			}
+		})
+	}
+}
+
+func TestServerSetRequestEndpoints(t *testing.T) {
+	names := []string{"e0", "e1", "e2", "e3", "e4"}
+	set := func(generation string) map[string]RequestEndpoint {
+		endpoints := map[string]RequestEndpoint{}
+
+		for _, name := range names {
+			endpoints[name] = func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+				_, err := io.WriteString(w, generation)
+				return err
+			}
+		}
+		return endpoints
+	}
+	generationOf := func(endpoint RequestEndpoint) string {
+		buf := &bytes.Buffer{}
+		endpoint(context.Background(), Metadata{}, buf, &bytes.Buffer{})
+		return buf.String()
+	}
+	blue, green := set("blue"), set("green")
+	s := NewInMemoryServer()
+	s.SetRequestEndpoints(blue)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	failures := make(chan string, 100)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			client := s.NewInMemoryClient()
+			defer client.Close()
+
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := client.Send(Request{Meta: Metadata{Endpoint: names[n%len(names)]}})
+
+				if err != nil {
+					failures <- fmt.Sprintf("request failed: %v", err)
+					return
+				}
+				if body := string(resp.Body); body != "blue" && body != "green" {
+					failures <- fmt.Sprintf("unexpected response %q", body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			snapshot := s.RequestEndpoints()
+			generation := generationOf(snapshot[names[0]])
+
+			for _, name := range names {
+				if endpoint, ok := snapshot[name]; !ok || generationOf(endpoint) != generation {
+					failures <- fmt.Sprintf("snapshot mixes generations: %s", name)
+					return
+				}
+			}
+			if _, ok := snapshot[CapabilitiesEndpoint]; !ok {
+				failures <- "snapshot lost the built-in endpoints"
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			s.SetRequestEndpoints(green)
+		} else {
+			s.SetRequestEndpoints(blue)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(failures)
+
+	for failure := range failures {
+		t.Error(failure)
+	}
+}
+
+func TestServerVersionedEndpoints(t *testing.T) {
+	respond := func(body string) RequestEndpoint {
+		return func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			_, err := io.WriteString(w, body)
+			return err
+		}
+	}
+	s := NewInMemoryServer()
+	s.AddRequestEndpointVersioned("greet", 1, respond("hello"))
+	s.AddRequestEndpointVersioned("greet", 2, respond("hello, world"))
+	s.AddRequestEndpoint("search", respond("unversioned search"))
+	s.AddRequestEndpointVersioned("search", 2, respond("search v2"))
+	s.AddRequestEndpointAlias("find", "search")
+	ids := s.EndpointIDs()
+
+	tests := []struct {
+		name string
+		meta Metadata
+		want string
+	}{
+		{"first version", Metadata{Endpoint: "greet", EndpointVersion: 1}, "hello"},
+		{"second version", Metadata{Endpoint: "greet", EndpointVersion: 2}, "hello, world"},
+		{"no version is the latest", Metadata{Endpoint: "greet"}, "hello, world"},
+		{"unknown version", Metadata{Endpoint: "greet", EndpointVersion: 3}, ""},
+		{"no version is unversioned", Metadata{Endpoint: "search"}, "unversioned search"},
+		{"registered version", Metadata{Endpoint: "search", EndpointVersion: 2}, "search v2"},
+		{"other versions are unversioned", Metadata{Endpoint: "search", EndpointVersion: 1}, "unversioned search"},
+		{"alias", Metadata{Endpoint: "find", EndpointVersion: 2}, "search v2"},
+		{"endpoint ID", Metadata{EndpointID: ids["search"], EndpointVersion: 2}, "search v2"},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			resp, err := client.Send(Request{Meta: tt.meta})
+
+			if tt.want == "" {
+				var e *Error
+
+				if !errors.As(err, &e) || e.Code != CodeNotFound {
+					t.Fatalf("error = %v, want code %d", err, CodeNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not send request: %v", err)
+			}
+			if string(resp.Body) != tt.want {
+				t.Errorf("body = %q, want %q", resp.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerEndpointIDs(t *testing.T) {
+	s := newEchoServer()
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	caps, err := client.Capabilities()
+
+	if err != nil {
+		t.Fatalf("Could not fetch capabilities: %v", err)
+	}
+	id, ok := caps.Endpoints["echo"]
+
+	if !ok || id == 0 {
+		t.Fatalf("echo has no ID in %v", caps.Endpoints)
+	}
+	resp, err := client.Send(Request{Meta: Metadata{EndpointID: id}, Body: []byte("hello")})
+
+	if err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	if string(resp.Body) != "hello" || resp.Meta.Endpoint != "echo" {
+		t.Errorf("response = %q from %q, want %q from %q", resp.Body, resp.Meta.Endpoint, "hello", "echo")
+	}
+
+	// IDs survive the endpoints being replaced, and are not reused once an
+	// endpoint is removed.
+	s.SetRequestEndpoints(map[string]RequestEndpoint{"other": func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		return nil
+	}})
+	if got := s.EndpointIDs()[CapabilitiesEndpoint]; got != caps.Endpoints[CapabilitiesEndpoint] {
+		t.Errorf("capabilities ID = %d, want %d", got, caps.Endpoints[CapabilitiesEndpoint])
+	}
+	if got := s.EndpointIDs()["other"]; got <= id {
+		t.Errorf("new ID = %d, want more than %d", got, id)
+	}
+	var e *Error
+
+	for _, missing := range []uint32{id, 1000} {
+		if _, err = client.Send(Request{Meta: Metadata{EndpointID: missing}, Body: []byte("hello")}); !errors.As(err, &e) || e.Code != CodeNotFound {
+			t.Errorf("ID %d: error = %v, want code %d", missing, err, CodeNotFound)
+		}
+	}
+}
+
+func TestServerEndpointIDMarkerName(t *testing.T) {
+	name := "\x01\x01\x00\x00\x00"
+	endpoint := func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		return nil
+	}
+	tests := []struct {
+		name     string
+		register func(s *Server)
+	}{
+		{"AddRequestEndpoint", func(s *Server) { s.AddRequestEndpoint(name, endpoint) }},
+		{"AddRequestEndpointUnbuffered", func(s *Server) { s.AddRequestEndpointUnbuffered(name, endpoint) }},
+		{"SetRequestEndpoints", func(s *Server) {
+			s.SetRequestEndpoints(map[string]RequestEndpoint{"other": endpoint, name: endpoint})
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+
+			func() {
+				defer func() {
+					err, _ := recover().(error)
+
+					if !errors.Is(err, ErrInvalidEndpointName) {
+						t.Errorf("panic = %v, want %v", err, ErrInvalidEndpointName)
+					}
+				}()
+				tt.register(s)
+			}()
+			ids := s.EndpointIDs()
+
+			if _, ok := ids[name]; ok {
+				t.Errorf("endpoint IDs = %v, want no %q", ids, name)
+			}
+			if _, ok := ids["echo"]; !ok {
+				t.Errorf("endpoint IDs = %v, want %q kept", ids, "echo")
+			}
+		})
+	}
+}
+
+func TestServerAddRequestEndpointAlias(t *testing.T) {
+	s := NewInMemoryServer()
+	s.AddRequestEndpoint("greet", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := fmt.Fprintf(w, "hello from %s", meta.Endpoint)
+		return err
+	})
+	s.AddRequestEndpointAlias("hello", "greet")
+	s.AddRequestEndpointAlias("dangling", "missing")
+
+	client := s.NewInMemoryClient()
+	defer client.Close()
+
+	for _, name := range []string{"greet", "hello"} {
+		if _, err := client.WriteDataString(name, ""); err != nil {
+			t.Fatalf("Could not write request: %v", err)
+		}
+		meta, body, err := client.ReadDataString()
+
+		if err != nil {
+			t.Fatalf("Could not read response: %v", err)
+		}
+		if want := "hello from " + name; body != want {
+			t.Errorf("body = %v, want %v", body, want)
+		}
+		if meta.Endpoint != name {
+			t.Errorf("endpoint = %v, want %v", meta.Endpoint, name)
+		}
+	}
+	want := map[string]string{"hello": "greet", "dangling": "missing"}
+
+	if aliases := s.RequestEndpointAliases(); !reflect.DeepEqual(aliases, want) {
+		t.Errorf("aliases = %v, want %v", aliases, want)
+	}
+	if _, ok := s.requestEndpoint("dangling"); ok {
+		t.Error("Alias to a missing endpoint should not resolve")
+	}
+}
+
+func TestServerMaxTimeout(t *testing.T) {
+	if s, _ := NewServer(ProtocolTCP, "127.0.0.1:0"); s.MaxTimeout != DefaultMaxTimeout {
+		t.Errorf("MaxTimeout = %v, want %v", s.MaxTimeout, DefaultMaxTimeout)
+	}
+	tests := []struct {
+		name       string
+		maxTimeout time.Duration
+		wantClosed bool
+	}{
+		{"stalled request is cut off", 50 * time.Millisecond, true},
+		{"timeout disabled", 0, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newEchoServer()
+			s.MaxTimeout = tt.maxTimeout
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			// Send half a header, then stall.
+			header := Metadata{Endpoint: "echo", BodySize: 5}.Encode()
+
+			if _, err := client.Write(header[:HeaderSize/2]); err != nil {
+				t.Fatalf("Could not write header: %v", err)
+			}
+			client.SetReadDeadline(newDeadline(200 * time.Millisecond))
+
+			_, err := client.Read(make([]byte, 1))
+			closed := err == io.EOF
+
+			if closed != tt.wantClosed {
+				t.Errorf("closed = %v, want %v (error %v)", closed, tt.wantClosed, err)
+			}
+		})
+	}
+}
+
+func TestServerMaxTimeoutStreaming(t *testing.T) {
+	s := NewInMemoryServer()
+	s.MaxTimeout = 20 * time.Millisecond
+	s.AddStreamingEndpoint("slow", func(ctx context.Context, meta Metadata, client *Client) error {
+		time.Sleep(5 * s.MaxTimeout)
+		_, err := client.Write([]byte("still here"))
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	client.WriteMeta(Metadata{EndpointType: EndpointStream, Endpoint: "slow"})
+	buf := make([]byte, 10)
+
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("Stream was cut off: %v", err)
+	}
+	if string(buf) != "still here" {
+		t.Errorf("body = %q, want %q", buf, "still here")
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"EOF", io.EOF, true},
+		{"closed pipe", io.ErrClosedPipe, true},
+		{"connection reset", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"timeout", os.ErrDeadlineExceeded, false},
+		{"other", errors.New("disk full"), false},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := clientGone(tt.err); got != tt.want {
+				t.Errorf("clientGone(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerPriority(t *testing.T) {
+	logger := make(capturingLogger, 100)
+	s := NewInMemoryServer()
+	s.Logger = logger
+	s.AddRequestEndpoint("priority", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := w.Write([]byte{meta.Priority})
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "priority", Priority: 200}})
+
+	if err != nil || !bytes.Equal(resp.Body, []byte{200}) {
+		t.Fatalf("body = %v, %v, want the priority passed to the endpoint", resp.Body, err)
+	}
+	timeout := time.After(5 * time.Second)
+
+	for logged := false; !logged; {
+		select {
+		case msg := <-logger:
+			logged = msg == "Serving request endpoint priority with priority 200"
+		case <-timeout:
+			t.Fatal("The priority was never logged")
+		}
+	}
+}
+
+func TestServerLogger(t *testing.T) {
+	logger := make(capturingLogger, 100)
+	s := newEchoServer()
+	s.Logger = logger
+	client := s.NewInMemoryClient()
+
+	if _, err := client.WriteDataString("missing", ""); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	if _, _, err := client.ReadData(); err == nil {
+		t.Fatal("Should return an error for a missing endpoint")
+	}
+	client.Close()
+
+	want := []string{"Client connected", "Could not find requested request endpoint: missing", "Client disconnected"}
+	timeout := time.After(5 * time.Second)
+
+	for _, prefix := range want {
+		for logged := false; !logged; {
+			select {
+			case msg := <-logger:
+				if strings.HasSuffix(msg, "\n") {
+					t.Errorf("message %q ends with a newline", msg)
+				}
+				logged = strings.HasPrefix(msg, prefix)
+			case <-timeout:
+				t.Fatalf("%q was never logged", prefix)
+			}
+		}
+	}
+}
+
+func TestServerClientGoneBeforeResponse(t *testing.T) {
+	// We can't run this test in parallel, since it replaces the logging
+	// output.
+	out := &bytes.Buffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	s := NewInMemoryServer()
+	s.Log = true
+	received := make(chan struct{})
+	proceed := make(chan struct{})
+	reasons := make(chan error, 1)
+
+	s.AddRequestEndpoint("slow", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		close(received)
+		<-proceed
+		_, err := io.WriteString(w, "too late")
+		return err
+	})
+	s.OnConnClose = func(conn net.Conn, reason error) { reasons <- reason }
+
+	client := s.NewInMemoryClient()
+
+	if _, err := client.WriteDataString("slow", "hello"); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	<-received
+	client.Close()
+	close(proceed)
+
+	select {
+	case reason := <-reasons:
+		if !clientGone(reason) {
+			t.Errorf("reason = %v, want the client to be gone", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The connection was not cleaned up")
+	}
+	if logged := out.String(); strings.Contains(logged, "Error writing response") {
+		t.Errorf("Logged the disconnect as an error: %q", logged)
+	} else if !strings.Contains(logged, "Client went away") {
+		t.Errorf("Did not log the disconnect: %q", logged)
+	}
+}
+
 func TestServerMaybeLogf(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -201,11 +2191,161 @@ func TestServerMaybeLogln(t *testing.T) {
 	log.SetOutput(os.Stderr)
 }
 
+// slowWriter is a log sink that takes a long time to write each message.
+type slowWriter struct {
+	delay time.Duration
+	out   chan string
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.out <- string(b)
+	return len(b), nil
+}
+
+func TestServerAsyncLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy LogPolicy
+	}{
+		{"drop", LogDrop},
+		{"block", LogBlock},
+	}
+	// We can't run these tests in parallel, since they replace the logging
+	// output.
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &slowWriter{delay: 200 * time.Millisecond, out: make(chan string, 100)}
+			log.SetOutput(sink)
+			defer log.SetOutput(os.Stderr)
+
+			s := newEchoServer()
+			s.Log = true
+			s.AsyncLog = 100
+			s.AsyncLogPolicy = tt.policy
+
+			start := time.Now()
+			client := s.NewInMemoryClient()
+			client.WriteDataString("echo", "hello")
+			client.ReadData()
+
+			if elapsed := time.Since(start); elapsed >= sink.delay {
+				t.Errorf("Request took %v with a slow log sink", elapsed)
+			}
+			timeout := time.After(2 * time.Second)
+
+			for logged := false; !logged; {
+				select {
+				case msg := <-sink.out:
+					logged = strings.Contains(msg, "Client connected")
+				case <-timeout:
+					t.Fatal("Message was never logged")
+				}
+			}
+			client.Close()
+		})
+	}
+}
+
+func TestServerAsyncLogDropsWhenFull(t *testing.T) {
+	sink := &slowWriter{delay: time.Second, out: make(chan string, 100)}
+	log.SetOutput(sink)
+	defer log.SetOutput(os.Stderr)
+
+	s := &Server{Log: true, AsyncLog: 1, AsyncLogPolicy: LogDrop}
+	start := time.Now()
+
+	for i := 0; i < 10; i++ {
+		s.maybeLogf("message %d", i)
+	}
+	if elapsed := time.Since(start); elapsed >= sink.delay {
+		t.Errorf("Logging took %v with a full buffer", elapsed)
+	}
+}
+
+// slowLogger is a Logger that takes a long time to log each line.
+type slowLogger struct {
+	delay time.Duration
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *slowLogger) Printf(format string, v ...interface{}) {
+	time.Sleep(l.delay)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestServerAsyncLogFlushedOnShutdown(t *testing.T) {
+	logger := &slowLogger{delay: 10 * time.Millisecond}
+	s := newEchoServer()
+	s.Logger = logger
+	s.AsyncLog = 100
+	s.AsyncLogPolicy = LogBlock
+
+	for i := 0; i < 10; i++ {
+		s.maybeLogf("message %d", i)
+	}
+	s.Shutdown()
+
+	logger.mu.Lock()
+	logged := len(logger.lines)
+	logger.mu.Unlock()
+
+	if logged != 10 {
+		t.Fatalf("%d messages logged before Shutdown returned, want 10", logged)
+	}
+	// Messages logged after the shutdown are written right away.
+	s.maybeLogf("late")
+
+	if last := logger.lines[len(logger.lines)-1]; last != "late" {
+		t.Errorf("Last message = %q, want %q", last, "late")
+	}
+}
+
+func benchmarkEndpointLookup(b *testing.B, lookup func(s *Server, name string, id uint32) bool) {
+	s := NewInMemoryServer()
+	name := strings.Repeat("endpoint", 12)
+
+	for i := 0; i < 100; i++ {
+		s.AddRequestEndpoint(fmt.Sprintf("%s%d", name, i), func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+			return nil
+		})
+	}
+	name += "50"
+	id := s.EndpointIDs()[name]
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if !lookup(s, name, id) {
+			b.Fatal("endpoint not found")
+		}
+	}
+}
+
+func BenchmarkEndpointLookupByName(b *testing.B) {
+	benchmarkEndpointLookup(b, func(s *Server, name string, id uint32) bool {
+		_, ok := s.requestEndpoint(name)
+		return ok
+	})
+}
+
+func BenchmarkEndpointLookupByID(b *testing.B) {
+	benchmarkEndpointLookup(b, func(s *Server, name string, id uint32) bool {
+		_, ok := s.requestEndpointByID(id)
+		return ok
+	})
+}
+
 func BenchmarkEchoServerSharedConnections(b *testing.B) {
 	s, _ := NewServer(ProtocolTCP, "127.0.0.1:1337")
 	body := []byte("hello world")
 
-	s.AddRequestEndpoint("hello", func(meta Metadata, w io.Writer, r io.Reader) error {
+	s.AddRequestEndpoint("hello", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
 		w.Write(body)
 		return nil
 	})
@@ -224,11 +2364,15 @@ func BenchmarkEchoServerSharedConnections(b *testing.B) {
 	}
 	defer client.Close()
 
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
 		client.WriteData("hello", body)
-		client.ReadData()
+
+		if _, got, err := client.ReadData(); err != nil || !bytes.Equal(got, body) {
+			b.Fatalf("body = %q, %v, want %q", got, err, body)
+		}
 	}
 }
 
@@ -236,7 +2380,7 @@ func BenchmarkEchoServerIndividualConnections(b *testing.B) {
 	s, _ := NewServer(ProtocolTCP, "127.0.0.1:1337")
 	body := []byte("hello world")
 
-	s.AddRequestEndpoint("hello", func(meta Metadata, w io.Writer, r io.Reader) error {
+	s.AddRequestEndpoint("hello", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
 		w.Write(body)
 		return nil
 	})
@@ -0,0 +1,97 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// Set is used to store a value on the connection, so that it can be shared by
+// all the requests made on it, such as the user a connection authenticated as.
+// The values are cleared when the client is closed. Keys follow the same rules
+// as those of context.WithValue.
+func (c *Client) Set(key, value interface{}) {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+
+	if c.isClosed() {
+		return
+	}
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = value
+}
+
+// Get is used to fetch a value stored on the connection with Set.
+func (c *Client) Get(key interface{}) (value interface{}, ok bool) {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+
+	value, ok = c.values[key]
+	return value, ok
+}
+
+// clearValues drops the values stored on the connection.
+func (c *Client) clearValues() {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+
+	c.values = nil
+}
+
+// responseWriter is the writer given to request endpoints. It buffers the
+// response, and gives access to the connection the request came from and to the
+// context of the request.
+type responseWriter struct {
+	*bytes.Buffer
+	client     *Client
+	ctx        context.Context
+	closeAfter bool // Whether the connection is closed after the response.
+}
+
+// ClientFromWriter is used by request endpoints to get at the connection a
+// request came from, typically to share values across requests with Get and
+// Set. w is the writer the endpoint was called with; writers wrapping it, such
+// as those of middleware, are unwrapped if they have an Unwrap method returning
+// the writer they wrap. The client must not be used to read or write frames.
+func ClientFromWriter(w io.Writer) (*Client, bool) {
+	if rw, ok := unwrapResponseWriter(w); ok {
+		return rw.client, true
+	}
+	return nil, false
+}
+
+// CloseAfterResponse is used by request endpoints to have the connection closed
+// once their response has been sent, such as after a logout. It only applies if
+// the endpoint succeeds; the client reads the response, then sees the
+// connection end. w is the writer the endpoint was called with, unwrapped as by
+// ClientFromWriter; false is returned if it is not one given by the server.
+func CloseAfterResponse(w io.Writer) bool {
+	rw, ok := unwrapResponseWriter(w)
+
+	if ok {
+		rw.closeAfter = true
+	}
+	return ok
+}
+
+// errCloseAfterResponse is returned by handleRequestConn once it has answered a
+// request whose endpoint called CloseAfterResponse.
+var errCloseAfterResponse = errors.New("endpoint closed the connection")
+
+// unwrapResponseWriter is used to find the responseWriter behind the writers
+// wrapping it.
+func unwrapResponseWriter(w io.Writer) (*responseWriter, bool) {
+	for {
+		switch v := w.(type) {
+		case *responseWriter:
+			return v, true
+		case interface{ Unwrap() io.Writer }:
+			w = v.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type userKey struct{}
+
+func TestClientFromWriter(t *testing.T) {
+	s := NewInMemoryServer()
+	s.Use(LoggingMiddleware(log.New(io.Discard, "", 0)))
+
+	s.AddRequestEndpoint("login", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		client, ok := ClientFromWriter(w)
+
+		if !ok {
+			return errors.New("no client")
+		}
+		user, err := io.ReadAll(r)
+		client.Set(userKey{}, string(user))
+		return err
+	})
+	s.AddRequestEndpoint("whoami", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		client, ok := ClientFromWriter(w)
+
+		if !ok {
+			return errors.New("no client")
+		}
+		user, _ := client.Get(userKey{})
+		_, err := io.WriteString(w, user.(string))
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "login"}, Body: []byte("alice")}); err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "whoami"}})
+
+	if err != nil {
+		t.Fatalf("Could not read the stored value: %v", err)
+	}
+	if string(resp.Body) != "alice" {
+		t.Errorf("user = %q, want %q", resp.Body, "alice")
+	}
+	if _, ok := ClientFromWriter(&bytes.Buffer{}); ok {
+		t.Error("Found a client behind a plain writer")
+	}
+}
+
+func TestCloseAfterResponse(t *testing.T) {
+	reasons := make(chan error, 1)
+
+	s := NewInMemoryServer()
+	s.Use(LoggingMiddleware(log.New(io.Discard, "", 0)))
+	s.OnConnClose = func(conn net.Conn, reason error) {
+		reasons <- reason
+	}
+	s.AddRequestEndpoint("logout", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		if !CloseAfterResponse(w) {
+			return errors.New("no client")
+		}
+		_, err := io.WriteString(w, "bye")
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	resp, err := client.Send(Request{Meta: Metadata{Endpoint: "logout"}})
+
+	if err != nil {
+		t.Fatalf("Could not log out: %v", err)
+	}
+	if string(resp.Body) != "bye" {
+		t.Errorf("body = %q, want %q", resp.Body, "bye")
+	}
+	if _, err = client.ReadMeta(); err != io.EOF {
+		t.Errorf("error = %v, want %v", err, io.EOF)
+	}
+	if reason := <-reasons; reason != io.EOF {
+		t.Errorf("reason = %v, want %v", reason, io.EOF)
+	}
+	if CloseAfterResponse(&bytes.Buffer{}) {
+		t.Error("Closing after a response through a plain writer")
+	}
+}
+
+func TestClientValuesClearedOnClose(t *testing.T) {
+	conn, _ := net.Pipe()
+	client := NewClientConn(conn)
+
+	client.Set(userKey{}, "alice")
+
+	if user, ok := client.Get(userKey{}); !ok || user != "alice" {
+		t.Errorf("value = %v, %v, want %q", user, ok, "alice")
+	}
+	client.Close()
+
+	if _, ok := client.Get(userKey{}); ok {
+		t.Error("Value survived closing the client")
+	}
+	client.Set(userKey{}, "bob")
+
+	if _, ok := client.Get(userKey{}); ok {
+		t.Error("Value was stored on a closed client")
+	}
+}
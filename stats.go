@@ -0,0 +1,176 @@
+package srv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestStats describes how a request was served, for performance analysis:
+// how much was exchanged in either direction, before and after compression, and
+// where the time went. Sizes cover whole frames, headers included. Without
+// compression, the wire sizes are the same as the others; with it, they are
+// approximate, since decompressors may read ahead of the frame they decode.
+type RequestStats struct {
+	Meta             Metadata      // The metadata of the request.
+	Compression      string        // The compression method of the connection, if any.
+	RequestSize      int64         // The size of the request frame.
+	RequestWireSize  int64         // The bytes the request frame took on the connection.
+	ResponseSize     int64         // The size of the response or error frame; zero if none was sent.
+	ResponseWireSize int64         // The bytes the response frame took on the connection.
+	Read             time.Duration // Reading the body of the request.
+	Handler          time.Duration // Running the endpoint, middleware included.
+	Write            time.Duration // Writing the response.
+}
+
+// CompressionRatio returns the bytes exchanged on the connection for the
+// request and its response, divided by their size before compression. A ratio
+// below 1 means compression is paying off; it is 1 without compression.
+func (s RequestStats) CompressionRatio() float64 {
+	size := s.RequestSize + s.ResponseSize
+
+	if size == 0 {
+		return 1
+	}
+	return float64(s.RequestWireSize+s.ResponseWireSize) / float64(size)
+}
+
+// requestTrace is used to collect the RequestStats of a request as it is
+// served. Its methods do nothing on a nil trace, which is what traceRequest
+// returns when nobody is interested in the stats.
+type requestTrace struct {
+	stats       RequestStats
+	client      *Client
+	report      func(stats RequestStats)
+	last        time.Time // When the previous phase ended.
+	wireWritten int64     // The bytes written on the connection before the response.
+}
+
+// traceRequest is used to start tracing a request whose header was just read.
+func (s *Server) traceRequest(meta Metadata, client *Client) *requestTrace {
+	if s.OnRequestStats == nil {
+		return nil
+	}
+	return &requestTrace{
+		stats:  RequestStats{Meta: meta, Compression: client.compression, RequestSize: client.headerSize + meta.BodySize},
+		client: client,
+		report: s.OnRequestStats,
+		last:   time.Now(),
+	}
+}
+
+// read is used to mark the end of reading the body.
+func (t *requestTrace) read() {
+	if t == nil {
+		return
+	}
+	t.stats.Read = t.lap()
+	t.stats.RequestWireSize = t.stats.RequestSize
+
+	if t.client.compression != "" {
+		t.stats.RequestWireSize = t.client.wireRead() - t.client.headerWire
+	}
+}
+
+// handled is used to mark the end of running the endpoint.
+func (t *requestTrace) handled() {
+	if t == nil {
+		return
+	}
+	t.stats.Handler = t.lap()
+	t.wireWritten = t.client.wireWritten()
+}
+
+// written is used to mark the end of writing n bytes in response, and reports
+// the stats.
+func (t *requestTrace) written(n int) {
+	if t == nil {
+		return
+	}
+	t.stats.Write = t.lap()
+	t.stats.ResponseSize = int64(n)
+	t.stats.ResponseWireSize = t.stats.ResponseSize
+
+	if t.client.compression != "" {
+		t.stats.ResponseWireSize = t.client.wireWritten() - t.wireWritten
+	}
+	t.report(t.stats)
+}
+
+// lap returns the time elapsed since the previous phase ended.
+func (t *requestTrace) lap() time.Duration {
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.last = now
+	return d
+}
+
+// wireRead returns the bytes read from the connection since compression was
+// enabled.
+func (c *Client) wireRead() int64 {
+	if c.wireR == nil {
+		return 0
+	}
+	return c.wireR.n
+}
+
+// wireWritten returns the bytes written to the connection since compression
+// was enabled.
+func (c *Client) wireWritten() int64 {
+	if c.wireW == nil {
+		return 0
+	}
+	return c.wireW.n
+}
+
+// Stats is a snapshot of the counters a server keeps of the traffic it served,
+// returned by Server.Stats. The counters start at zero when the server is
+// created, and are never reset.
+type Stats struct {
+	ActiveConnections int64            // The connections being served.
+	TotalConnections  int64            // The connections served so far, active ones included; every datagram counts as one.
+	Requests          int64            // The request and one-way frames received, rejected ones included.
+	BytesRead         int64            // The bytes read from connections, after decompression.
+	BytesWritten      int64            // The bytes written to connections, before compression.
+	Endpoints         map[string]int64 // The requests dispatched to each request endpoint, by the name they were sent to.
+}
+
+// serverCounters holds the counters behind Stats. They are updated with atomic
+// operations only, so that busy connections do not contend for a lock.
+type serverCounters struct {
+	activeConns  atomic.Int64
+	totalConns   atomic.Int64
+	requests     atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	endpoints    sync.Map // The request counts of endpoints, as *atomic.Int64 by name.
+}
+
+// countEndpoint is used to count a request dispatched to the named endpoint.
+func (c *serverCounters) countEndpoint(name string) {
+	count, ok := c.endpoints.Load(name)
+
+	if !ok {
+		count, _ = c.endpoints.LoadOrStore(name, new(atomic.Int64))
+	}
+	count.(*atomic.Int64).Add(1)
+}
+
+// Stats is used to take a snapshot of the counters of the server. The counters
+// are read one at a time while connections keep updating them, so a snapshot
+// of a busy server may be slightly inconsistent.
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		ActiveConnections: s.counters.activeConns.Load(),
+		TotalConnections:  s.counters.totalConns.Load(),
+		Requests:          s.counters.requests.Load(),
+		BytesRead:         s.counters.bytesRead.Load(),
+		BytesWritten:      s.counters.bytesWritten.Load(),
+		Endpoints:         make(map[string]int64),
+	}
+	s.counters.endpoints.Range(func(name, count interface{}) bool {
+		stats.Endpoints[name.(string)] = count.(*atomic.Int64).Load()
+		return true
+	})
+	return stats
+}
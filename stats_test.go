@@ -0,0 +1,132 @@
+package srv
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerOnRequestStats(t *testing.T) {
+	body := strings.Repeat("compressible ", 10000)
+
+	tests := []struct {
+		name        string
+		compression string
+	}{
+		{"uncompressed", ""},
+		{"flate", CompressionFlate},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			reported := make(chan RequestStats, 1)
+			s := newEchoServer()
+			s.OnRequestStats = func(stats RequestStats) {
+				if stats.Meta.Endpoint == "echo" {
+					reported <- stats
+				}
+			}
+			client := s.NewInMemoryClient()
+
+			defer client.Close()
+
+			if tt.compression != "" {
+				if err := client.EnableCompression(tt.compression); err != nil {
+					t.Fatalf("Should not return an error, got %v", err)
+				}
+			}
+			if _, err := client.WriteDataString("echo", body); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			if _, _, err := client.ReadDataString(); err != nil {
+				t.Fatalf("Could not read response: %v", err)
+			}
+			stats := <-reported
+			size := int64(HeaderSize + len(body))
+
+			if stats.Compression != tt.compression {
+				t.Errorf("compression = %q, want %q", stats.Compression, tt.compression)
+			}
+			if stats.RequestSize != size || stats.ResponseSize != size {
+				t.Errorf("sizes = %d, %d, want %d", stats.RequestSize, stats.ResponseSize, size)
+			}
+			if stats.Read <= 0 || stats.Handler <= 0 || stats.Write <= 0 {
+				t.Errorf("durations = %v, %v, %v, want them all positive", stats.Read, stats.Handler, stats.Write)
+			}
+			ratio := stats.CompressionRatio()
+
+			if tt.compression == "" && ratio != 1 {
+				t.Errorf("compression ratio = %v, want 1", ratio)
+			}
+			if tt.compression != "" && (ratio <= 0 || ratio >= 1) {
+				t.Errorf("compression ratio = %v, want it between 0 and 1", ratio)
+			}
+		})
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	s := newEchoServer()
+	closed := make(chan struct{}, 2)
+	s.OnConnClose = func(conn net.Conn, reason error) { closed <- struct{}{} }
+
+	if stats := s.Stats(); !reflect.DeepEqual(stats, Stats{Endpoints: map[string]int64{}}) {
+		t.Errorf("stats = %+v, want zero", stats)
+	}
+	var read, written int64
+
+	for i := 0; i < 2; i++ {
+		client := s.NewInMemoryClient()
+		requests := []Request{
+			{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello")},
+			{Meta: Metadata{Endpoint: "echo"}, Body: []byte("hello, world")},
+			{Meta: Metadata{Endpoint: "missing"}, Body: []byte("lost")},
+			{Meta: Metadata{Endpoint: CapabilitiesEndpoint}},
+		}
+		for _, req := range requests {
+			n, err := client.WriteRequest(req)
+
+			if err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			meta, err := client.ReadMeta()
+
+			if err != nil {
+				t.Fatalf("Could not read response: %v", err)
+			}
+			if _, err = client.ReadBody(meta); err != nil {
+				t.Fatalf("Could not read response: %v", err)
+			}
+			read += int64(n)
+			written += HeaderSize + meta.BodySize
+		}
+		if i == 0 {
+			client.Close()
+			<-closed
+			continue
+		}
+		// The second client is still connected.
+		stats := s.Stats()
+
+		if stats.ActiveConnections != 1 || stats.TotalConnections != 2 {
+			t.Errorf("connections = %d active, %d total, want 1 and 2", stats.ActiveConnections, stats.TotalConnections)
+		}
+		client.Close()
+	}
+	s.Shutdown() // Waits for the connections to be closed.
+
+	want := Stats{
+		TotalConnections: 2,
+		Requests:         8,
+		BytesRead:        read,
+		BytesWritten:     written,
+		Endpoints:        map[string]int64{"echo": 4, CapabilitiesEndpoint: 2},
+	}
+	if stats := s.Stats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,57 @@
+package srv
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidTrailer = errors.New("invalid trailer line")
+
+// Trailer is metadata sent after the data frames of a multi-frame response,
+// such as a row count, a status or a checksum. It is encoded as one
+// "key: value" line per entry, so neither keys nor values may contain newlines,
+// and keys may not contain ": ".
+type Trailer map[string]string
+
+// Encode is used to encode the trailer into the body of an end-of-stream frame.
+// Keys are sorted so the encoding is stable.
+func (t Trailer) Encode() []byte {
+	keys := make([]string, 0, len(t))
+
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteString(": ")
+		buf.WriteString(t[k])
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// DecodeTrailer is used to decode a trailer from the body of an end-of-stream
+// frame.
+func DecodeTrailer(b []byte) (Trailer, error) {
+	t := Trailer{}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ": ", 2)
+
+		if len(kv) != 2 {
+			return t, errors.Wrapf(errInvalidTrailer, "%q", line)
+		}
+		t[kv[0]] = kv[1]
+	}
+	return t, nil
+}
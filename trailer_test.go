@@ -0,0 +1,65 @@
+package srv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrailerEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		trailer Trailer
+		want    string
+	}{
+		{"nil trailer", nil, ""},
+		{"single entry", Trailer{"count": "3"}, "count: 3\n"},
+		{"sorted entries", Trailer{"status": "ok", "count": "3"}, "count: 3\nstatus: ok\n"},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := string(tt.trailer.Encode()); got != tt.want {
+				t.Errorf("Encode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTrailer(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Trailer
+		wantErr bool
+	}{
+		{"empty body", "", Trailer{}, false},
+		{"entries", "count: 3\nstatus: ok\n", Trailer{"count": "3", "status": "ok"}, false},
+		{"value with separator", "note: a: b\n", Trailer{"note": "a: b"}, false},
+		{"malformed line", "count\n", Trailer{}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			trailer, err := DecodeTrailer([]byte(tt.body))
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Should return an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Should not return an error, got %v", err)
+			}
+			if !reflect.DeepEqual(trailer, tt.want) {
+				t.Errorf("trailer = %#v, want %#v", trailer, tt.want)
+			}
+		})
+	}
+}
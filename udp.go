@@ -0,0 +1,198 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxDatagramSize is the size of the largest datagram sent or received over
+// UDP. A frame has to fit in a single datagram, header included, which leaves
+// MaxDatagramSize - HeaderSize bytes for its body. Larger responses are
+// replaced with an error frame with CodePayloadTooLarge.
+const MaxDatagramSize = 65507
+
+// ErrDatagramTooLarge is the error returned for frames that do not fit in a
+// single datagram.
+var ErrDatagramTooLarge = errors.New("frame too large for a datagram")
+
+// errNotDatagram is the reason frames other than requests are rejected over UDP.
+var errNotDatagram = errors.New("only requests can be sent over UDP")
+
+// errTruncatedDatagram is the reason requests declaring a body larger than what
+// is left of their datagram are rejected.
+var errTruncatedDatagram = errors.New("body larger than the datagram")
+
+// errNoReadDeadline is returned by datagrams, which are read from memory.
+var errNoReadDeadline = errors.New("read deadlines are not supported on datagrams")
+
+func (s *Server) listenUDP() error {
+	conn, err := net.ListenPacket(ProtocolUDP, s.uri)
+
+	if err != nil {
+		return err
+	}
+	s.maybeLogf("Listening for requests on udp://%s", s.uri)
+
+	return s.serve(&datagramListener{conn: conn, buf: make([]byte, MaxDatagramSize)})
+}
+
+// datagramListener hands out every datagram received on a packet connection as
+// a connection of its own, so that the accept loop can serve them.
+type datagramListener struct {
+	conn net.PacketConn
+	buf  []byte // Reused for every datagram; Accept is never called concurrently.
+}
+
+func (l *datagramListener) Accept() (net.Conn, error) {
+	n, addr, err := l.conn.ReadFrom(l.buf)
+
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{
+		conn:   l.conn,
+		remote: addr,
+		r:      bytes.NewReader(append([]byte(nil), l.buf[:n]...)),
+	}, nil
+}
+
+func (l *datagramListener) Close() error   { return l.conn.Close() }
+func (l *datagramListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// datagramConn is a request received in a datagram. Reading it ends with the
+// datagram, and whatever is written to it is sent back as a single datagram
+// once it is closed.
+type datagramConn struct {
+	conn      net.PacketConn
+	remote    net.Addr
+	r         *bytes.Reader
+	out       []byte
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	c.out = append(c.out, b...)
+	return len(b), nil
+}
+
+func (c *datagramConn) Close() error {
+	c.closeOnce.Do(func() {
+		if len(c.out) > 0 {
+			_, c.closeErr = c.conn.WriteTo(c.out, c.remote)
+		}
+	})
+	return c.closeErr
+}
+
+func (c *datagramConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *datagramConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *datagramConn) SetDeadline(t time.Time) error      { return nil }
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline fails, since reads cannot block; this also keeps the server
+// from watching the datagram for cancel frames.
+func (c *datagramConn) SetReadDeadline(t time.Time) error { return errNoReadDeadline }
+
+// serveDatagram is like serveClient, but for the single request of a datagram.
+func (s *Server) serveDatagram(ctx context.Context, conn *datagramConn) error {
+	client := NewClientConn(conn)
+	client.counters = &s.counters
+	meta, err := client.ReadMeta()
+
+	if err != nil {
+		return s.logReadError(client, "header", err)
+	}
+	// The body comes in the same datagram as the header, so a larger declared
+	// size can only be wrong, and is turned down before anything is allocated
+	// for it.
+	if meta.BodySize > int64(conn.r.Len()) {
+		s.maybeLogf("Rejecting %d byte body in a datagram with %d bytes left from %v", meta.BodySize, conn.r.Len(), conn.RemoteAddr())
+
+		if meta.EndpointType == EndpointOneWay {
+			return io.EOF
+		}
+		if _, err = client.writeError(meta.Endpoint, CodeBadRequest, errTruncatedDatagram.Error()); err != nil {
+			return s.logWriteError(client, "error frame", err)
+		}
+		return io.EOF
+	}
+	start := time.Now()
+
+	switch meta.EndpointType {
+	case EndpointRequest, EndpointOneWay:
+		if err = s.limitRate(meta, client); err == nil {
+			// Every datagram is a connection of its own, so it is always
+			// authenticated.
+			err = s.authenticate(meta, client, new(bool))
+		}
+		if err == nil {
+			err = s.authorize(meta, client)
+		}
+		if err == nil {
+			err = s.handleRequestConn(ctx, meta, client)
+		}
+	default:
+		s.maybeLogf("Rejecting %s frame received over UDP from %v", EndpointTypeName(meta.EndpointType), conn.RemoteAddr())
+		err = s.reject(meta, client, CodeBadRequest, errNotDatagram)
+	}
+	if len(conn.out) > MaxDatagramSize {
+		s.maybeLogf("Response of %d bytes for %s endpoint %v does not fit in a datagram", len(conn.out), EndpointTypeName(meta.EndpointType), meta.Endpoint)
+
+		conn.out = nil
+
+		if _, werr := client.writeError(meta.Endpoint, CodePayloadTooLarge, ErrDatagramTooLarge.Error()); werr != nil {
+			return s.logWriteError(client, "error frame", werr)
+		}
+	}
+	if err == errCloseAfterResponse {
+		err = nil
+	}
+	if s.Metrics != nil {
+		s.Metrics.Observe(meta, time.Since(start), err)
+	}
+	if _, ok := err.(recoverableError); ok || err == nil {
+		return io.EOF
+	}
+	return err
+}
+
+// datagramClient is the connection of a client using ProtocolUDP. Every write
+// is sent as a datagram, and datagrams are read whole, then handed out in as
+// many reads as it takes.
+type datagramClient struct {
+	net.Conn
+	buf    []byte
+	unread []byte
+}
+
+func (c *datagramClient) Read(b []byte) (int, error) {
+	if len(c.unread) == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, MaxDatagramSize)
+		}
+		n, err := c.Conn.Read(c.buf)
+
+		if err != nil {
+			return 0, err
+		}
+		c.unread = c.buf[:n]
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *datagramClient) Write(b []byte) (int, error) {
+	if len(b) > MaxDatagramSize {
+		return 0, ErrDatagramTooLarge
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,111 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenOnUDP(t testing.TB, s *Server) string {
+	conn, err := net.ListenPacket(ProtocolUDP, "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(&datagramListener{conn: conn, buf: make([]byte, MaxDatagramSize)})
+
+	t.Cleanup(s.Shutdown)
+
+	return conn.LocalAddr().String()
+}
+
+func TestServerUDP(t *testing.T) {
+	if _, err := NewServer(ProtocolUDP, "127.0.0.1:0"); err != nil {
+		t.Fatalf("NewServer error = %v, want nil", err)
+	}
+	s := newEchoServer()
+	notified := make(chan string, 1)
+	s.AddRequestEndpoint("notify", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		body, err := io.ReadAll(r)
+		notified <- string(body)
+		return err
+	})
+	s.AddRequestEndpoint("large", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := w.Write(make([]byte, MaxDatagramSize))
+		return err
+	})
+	client, err := NewClient(ProtocolUDP, listenOnUDP(t, s))
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		meta     Metadata
+		body     []byte
+		want     []byte
+		wantCode ErrorCode
+	}{
+		{"echo", Metadata{Endpoint: "echo"}, []byte("hello"), []byte("hello"), 0},
+		{"larger body", Metadata{Endpoint: "echo"}, bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("a"), 4096), 0},
+		{"missing", Metadata{Endpoint: "missing"}, nil, nil, CodeNotFound},
+		{"stream", Metadata{EndpointType: EndpointStream, Endpoint: "echo"}, nil, nil, CodeBadRequest},
+		{"large response", Metadata{Endpoint: "large"}, nil, nil, CodePayloadTooLarge},
+	}
+	for _, tt := range tests {
+		// The requests share the client, so they run one after the other.
+		t.Run(tt.name, func(t *testing.T) {
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := client.WriteRequest(Request{Meta: tt.meta, Body: tt.body}); err != nil {
+				t.Fatalf("Could not write request: %v", err)
+			}
+			resp, err := client.ReadResponse()
+
+			if tt.wantCode != 0 {
+				var e *Error
+
+				if !errors.As(err, &e) || e.Code != tt.wantCode {
+					t.Errorf("error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(resp.Body, tt.want) {
+				t.Errorf("body = %d bytes, %v, want %d bytes", len(resp.Body), err, len(tt.want))
+			}
+		})
+	}
+
+	// A request declaring more than its datagram holds is turned down.
+	header := Metadata{Endpoint: "echo", BodySize: 1 << 40}.Encode()
+
+	if _, err = client.Write(append(header, "hi"...)); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	var e *Error
+
+	if _, err = client.ReadResponse(); !errors.As(err, &e) || e.Code != CodeBadRequest {
+		t.Errorf("error = %v, want code %d", err, CodeBadRequest)
+	}
+
+	if _, err = client.WriteData("echo", make([]byte, MaxDatagramSize)); err != ErrDatagramTooLarge {
+		t.Errorf("error = %v, want %v", err, ErrDatagramTooLarge)
+	}
+	if _, err = client.Notify("notify", []byte("ping")); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	select {
+	case body := <-notified:
+		if body != "ping" {
+			t.Errorf("body = %q, want %q", body, "ping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The one-way request was not served")
+	}
+}
@@ -0,0 +1,66 @@
+package srv
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// uploadChunkSize is the size of the chunks UploadFile sends, between which it
+// reports its progress.
+const uploadChunkSize = 32 << 10
+
+// UploadFile is used to send the file at path as the body of a request to the
+// endpoint, and wait for the response. The file is streamed to the connection
+// in chunks instead of being read into memory, and progress, if not nil, is
+// called after every chunk with the bytes sent so far and the size of the file.
+// If the server rejects the upload with an error frame, the error is an *Error;
+// files larger than the server's MaxBodySize are only accepted by endpoints
+// added with AddRequestEndpointUnbuffered. The upload has no Timeout, so its
+// response is waited for without the deadline of an earlier request.
+//
+// The size of the file is taken before sending it, so it should not change
+// during the upload: if it shrinks, the upload fails partway through, and the
+// connection should not be used anymore.
+func (c *Client) UploadFile(endpoint, path string, progress func(sent, total int64)) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return errors.Wrap(err, "could not open file")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return errors.Wrap(err, "could not stat file")
+	}
+	total := info.Size()
+
+	if _, err = c.WriteMeta(Metadata{Endpoint: endpoint, BodySize: total}); err != nil {
+		return err
+	}
+	buf := make([]byte, uploadChunkSize)
+
+	for sent := int64(0); sent < total; {
+		chunk := buf
+
+		if remaining := total - sent; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err = io.ReadFull(f, chunk); err != nil {
+			return errors.Wrapf(err, "could not read file after %d of %d bytes", sent, total)
+		}
+		if _, err = c.Write(chunk); err != nil {
+			return err
+		}
+		sent += int64(len(chunk))
+
+		if progress != nil {
+			progress(sent, total)
+		}
+	}
+	_, err = c.ReadResponse()
+	return err
+}
@@ -0,0 +1,198 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestClientUploadFile(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 3*uploadChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	src := filepath.Join(dir, "src")
+
+	if err := os.WriteFile(src, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	s := NewInMemoryServer()
+	s.AddRequestEndpoint("upload", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		f, err := os.Create(dst)
+
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(f, r)
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	var sent []int64
+
+	err := client.UploadFile("upload", src, func(n, total int64) {
+		if total != int64(len(content)) {
+			t.Errorf("total = %d, want %d", total, len(content))
+		}
+		sent = append(sent, n)
+	})
+	if err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("uploaded %d bytes, %v, want the %d bytes of the file", len(got), err, len(content))
+	}
+	want := []int64{uploadChunkSize, 2 * uploadChunkSize, 3 * uploadChunkSize, int64(len(content))}
+
+	if len(sent) != len(want) {
+		t.Fatalf("progress = %v, want %v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("progress = %v, want %v", sent, want)
+			break
+		}
+	}
+
+	// Rejections are reported, as long as the server can drain the body and
+	// keep the connection.
+	small := filepath.Join(dir, "small")
+
+	if err = os.WriteFile(small, content[:100], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var e *Error
+
+	if err = client.UploadFile("missing", small, nil); !errors.As(err, &e) || e.Code != CodeNotFound {
+		t.Errorf("error = %v, want code %d", err, CodeNotFound)
+	}
+	if err = client.UploadFile("upload", filepath.Join(dir, "missing"), nil); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("error = %v, want the file not to exist", err)
+	}
+}
+
+func TestClientUploadFileAfterTimedRequest(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+
+	if err := os.WriteFile(src, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newEchoServer()
+	s.AddRequestEndpoint("upload", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	timeout := 50 * time.Millisecond
+
+	if _, err := client.Send(Request{Meta: Metadata{Endpoint: "echo", Timeout: timeout}, Body: []byte("timed")}); err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	time.Sleep(timeout + responseGrace)
+
+	if err := client.UploadFile("upload", src, nil); err != nil {
+		t.Fatalf("Should not return an error, got %v", err)
+	}
+	if client.failed.Load() {
+		t.Error("The connection should not be marked as failed")
+	}
+}
+
+func TestServerRequestEndpointUnbuffered(t *testing.T) {
+	s := newEchoServer()
+	s.MaxDrainBytes = 0     // Unbuffered bodies are skipped whatever their size.
+	s.MaxBodySize = 1 << 20 // Nor are they limited to MaxBodySize.
+	s.AddRequestEndpointUnbuffered("count", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		if _, ok := r.(*bytes.Buffer); ok {
+			return errors.New("the body was buffered")
+		}
+		counter := &countingReader{r: r}
+
+		if _, err := io.Copy(io.Discard, counter); err != nil {
+			return err
+		}
+		_, err := fmt.Fprint(w, counter.n)
+		return err
+	})
+	s.AddRequestEndpointUnbuffered("peek", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.CopyN(w, r, 5)
+		return err
+	})
+	s.AddRequestEndpointUnbuffered("fail", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		io.CopyN(io.Discard, r, 5)
+		return &Error{Code: CodeUnprocessableEntity, Message: "rejected"}
+	})
+	s.AddRequestEndpointAlias("tally", "count")
+	client := s.NewInMemoryClient()
+
+	defer client.Close()
+
+	large := bytes.Repeat([]byte("0123456789"), 800<<10) // 8000 KiB.
+
+	tests := []struct {
+		name     string
+		endpoint string
+		body     []byte
+		want     string
+		wantCode ErrorCode
+	}{
+		{"large body", "count", large, fmt.Sprint(len(large)), 0},
+		{"empty body", "count", nil, "0", 0},
+		{"alias", "tally", large[:100], "100", 0},
+		{"partly read", "peek", large, "01234", 0},
+		{"error", "fail", large, "", CodeUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		// The requests share the client, so they run one after the other.
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Send(Request{Meta: Metadata{Endpoint: tt.endpoint}, Body: tt.body})
+
+			if code, _ := ErrorCodeOf(err); code != tt.wantCode || (code == 0 && err != nil) {
+				t.Fatalf("error = %v, want code %d", err, tt.wantCode)
+			}
+			if string(resp.Body) != tt.want {
+				t.Errorf("body = %q, want %q", resp.Body, tt.want)
+			}
+
+			// The next request is read from the right place.
+			if resp, err = client.Send(Request{Meta: Metadata{Endpoint: "echo"}, Body: []byte("next")}); err != nil || string(resp.Body) != "next" {
+				t.Errorf("body = %q, %v, want %q", resp.Body, err, "next")
+			}
+		})
+	}
+}
+
+func TestServerRequestEndpointUnbufferedTruncated(t *testing.T) {
+	s := NewInMemoryServer()
+	result := make(chan error, 1)
+	s.AddRequestEndpointUnbuffered("count", func(ctx context.Context, meta Metadata, w io.Writer, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		result <- err
+		return err
+	})
+	client := s.NewInMemoryClient()
+
+	if _, err := client.Write(append(Metadata{Endpoint: "count", BodySize: 1 << 20}.Encode(), "short"...)); err != nil {
+		t.Fatalf("Could not write request: %v", err)
+	}
+	client.Close()
+
+	if err := <-result; err != io.ErrUnexpectedEOF {
+		t.Errorf("error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}